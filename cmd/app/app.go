@@ -1,29 +1,43 @@
 package app
 
 import (
+	"context"
+
 	"crm-lead-service/internal/service/consumer_rabbitmq"
 	storageDb "crm-lead-service/internal/storage/db"
 	"crm-lead-service/pkg/database"
 	"crm-lead-service/pkg/rabbitmq"
 )
 
+type Config struct {
+	QueueName string
+	Storage   storageDb.Config
+	Consumer  consumer_rabbitmq.Config
+}
+
 type Handler struct {
 	Client    *rabbitmq.Client
 	DB        *storageDb.Storage
 	QueueName string
+	Consumer  consumer_rabbitmq.Config
 }
 
-func NewHandler(rabbit *rabbitmq.Client, db *database.ConnectionDatabase, queueName string) *Handler {
-	storage, _ := storageDb.NewStorage(db)
+func NewHandler(rabbit *rabbitmq.Client, db *database.ConnectionDatabase, config Config) (*Handler, error) {
+	storage, err := storageDb.NewStorage(db, config.Storage)
+	if err != nil {
+		return nil, err
+	}
 	return &Handler{
 		Client:    rabbit,
 		DB:        storage,
-		QueueName: queueName,
-	}
+		QueueName: config.QueueName,
+		Consumer:  config.Consumer,
+	}, nil
 }
 
-func (h *Handler) Run() (bool, error) {
-	err := consumer_rabbitmq.Listener(h.Client, h.DB, h.QueueName)
+// Run обрабатывает сообщения до отмены ctx или закрытия клиента RabbitMQ
+func (h *Handler) Run(ctx context.Context) (bool, error) {
+	err := consumer_rabbitmq.Listener(ctx, h.Client, h.DB, h.QueueName, h.Consumer)
 	if err != nil {
 		return false, err
 	}
@@ -7,12 +7,19 @@ type EventTypeEnum string
 const (
 	EventTypeInsert EventTypeEnum = "insert"
 	EventTypeUpdate EventTypeEnum = "update"
+	EventTypeDelete EventTypeEnum = "delete"
+	EventTypeUpsert EventTypeEnum = "upsert"
 )
 
 type Message struct {
 	EventType EventTypeEnum `json:"event_type"`
 	Data      []Fields      `json:"data"`
 	Schema    Schema        `json:"schema"`
+	// Source приложение, опубликовавшее сообщение. Если не задано, берется app_id сообщения RabbitMQ
+	Source string `json:"source,omitempty"`
+	// Redelivered сообщение доставлено повторно (повтор после ошибки, ожидание родительской
+	// строки или более раннего события строки): его схема могла устареть
+	Redelivered bool `json:"-"`
 }
 
 // Fields аттрибуты модели
@@ -26,6 +33,23 @@ type Schema struct {
 	TableName  string                `json:"tableName"`
 	Columns    map[string]ColumnInfo `json:"columns"`
 	PrimaryKey []string              `json:"primaryKey"`
+	// SchemaName схема PostgreSQL (namespace) таблицы, переопределяет настройки сервиса
+	SchemaName string `json:"schemaName,omitempty"`
+	// RenamedColumns подсказка о переименованных колонках: новое имя -> старое имя
+	RenamedColumns map[string]string `json:"renamedColumns,omitempty"`
+	// Indexes индексы таблицы: имя -> колонки
+	Indexes map[string][]string `json:"indexes,omitempty"`
+	// UniqueKeys уникальные индексы таблицы: имя -> колонки
+	UniqueKeys map[string][]string `json:"uniqueKeys,omitempty"`
+	// ForeignKeys внешние ключи таблицы: имя -> описание
+	ForeignKeys map[string]ForeignKey `json:"foreignKeys,omitempty"`
+}
+
+// ForeignKey внешний ключ: колонки таблицы ссылаются на колонки родительской таблицы
+type ForeignKey struct {
+	Columns    []string `json:"columns"`
+	RefTable   string   `json:"refTable"`
+	RefColumns []string `json:"refColumns"`
 }
 
 // ColumnInfo представляет информацию о колонке
@@ -77,3 +101,21 @@ func (m *Message) GetFieldValue(fieldName string) (interface{}, bool) {
 	}
 	return nil, false
 }
+
+// GetKeyValue возвращает значение поля для поиска строки: new_value,
+// а если он null (например, в событии delete) — old_value
+func (m *Message) GetKeyValue(fieldName string) (interface{}, bool) {
+	for _, change := range m.Data {
+		if change.Field != fieldName {
+			continue
+		}
+		if change.NewValue != nil {
+			return change.NewValue, true
+		}
+		if change.OldValue != nil {
+			return change.OldValue, true
+		}
+		return nil, false
+	}
+	return nil, false
+}
@@ -0,0 +1,94 @@
+package consumer_rabbitmq
+
+import (
+	"log"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// outcome чем завершилась обработка сообщения
+type outcome int
+
+const (
+	// outcomeAck сообщение записано или передано в другую очередь - подтверждаем
+	outcomeAck outcome = iota
+	// outcomeRequeue сообщение нужно вернуть в очередь
+	outcomeRequeue
+)
+
+// pendingDelivery сообщение, полученное из очереди и еще не подтвержденное брокеру
+type pendingDelivery struct {
+	delivery amqp.Delivery
+	done     bool
+	outcome  outcome
+}
+
+// ackTracker подтверждает сообщения строго в порядке получения. Воркеры завершают
+// обработку в произвольном порядке, но сообщение подтверждается только после того,
+// как завершены все полученные до него, поэтому Ack(multiple=true) никогда
+// не захватывает сообщение, которое еще в обработке
+type ackTracker struct {
+	mu      sync.Mutex
+	pending []*pendingDelivery
+}
+
+// track регистрирует полученное сообщение. Вызывается в порядке получения
+func (t *ackTracker) track(delivery amqp.Delivery) *pendingDelivery {
+	entry := &pendingDelivery{delivery: delivery}
+
+	t.mu.Lock()
+	t.pending = append(t.pending, entry)
+	t.mu.Unlock()
+
+	return entry
+}
+
+// complete отмечает сообщение обработанным и подтверждает все завершенные сообщения
+// от начала очереди ожидания
+func (t *ackTracker) complete(entry *pendingDelivery, result outcome) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	entry.done = true
+	entry.outcome = result
+
+	// Подряд идущие Ack одного канала подтверждаем одним Ack(multiple=true) по последнему
+	var lastAck *amqp.Delivery
+	flushAck := func() {
+		if lastAck == nil {
+			return
+		}
+		if err := lastAck.Ack(true); err != nil {
+			log.Printf("Error acknowledging messages: %v", err)
+		}
+		lastAck = nil
+	}
+
+	released := 0
+	for _, pending := range t.pending {
+		if !pending.done {
+			break
+		}
+		released++
+
+		delivery := pending.delivery
+		// После переподключения delivery tag начинаются заново на новом канале
+		if lastAck != nil && lastAck.Acknowledger != delivery.Acknowledger {
+			flushAck()
+		}
+
+		switch pending.outcome {
+		case outcomeAck:
+			lastAck = &delivery
+		case outcomeRequeue:
+			flushAck()
+			if err := delivery.Nack(false, true); err != nil {
+				log.Printf("Error returning message to queue: %v", err)
+			}
+		}
+	}
+	flushAck()
+
+	t.pending = t.pending[released:]
+}
@@ -0,0 +1,122 @@
+package consumer_rabbitmq
+
+import (
+	"fmt"
+	"testing"
+
+	"crm-lead-service/internal/domain"
+	"crm-lead-service/internal/service/schema_database"
+	storageDb "crm-lead-service/internal/storage/db"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// fakeAcknowledger записывает вызовы подтверждения
+type fakeAcknowledger struct {
+	calls []string
+}
+
+func (f *fakeAcknowledger) Ack(tag uint64, multiple bool) error {
+	f.calls = append(f.calls, fmt.Sprintf("ack %d multiple=%t", tag, multiple))
+	return nil
+}
+
+func (f *fakeAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	f.calls = append(f.calls, fmt.Sprintf("nack %d requeue=%t", tag, requeue))
+	return nil
+}
+
+func (f *fakeAcknowledger) Reject(tag uint64, requeue bool) error {
+	f.calls = append(f.calls, fmt.Sprintf("reject %d requeue=%t", tag, requeue))
+	return nil
+}
+
+func assertCalls(t *testing.T, got []string, expected ...string) {
+	t.Helper()
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("Expected calls %v, got %v", expected, got)
+	}
+}
+
+// TestAckTracker проверяет, что подтверждения уходят строго в порядке получения
+func TestAckTracker(t *testing.T) {
+	t.Run("Later message waits for earlier ones", func(t *testing.T) {
+		acknowledger := &fakeAcknowledger{}
+		tracker := &ackTracker{}
+
+		first := tracker.track(amqp.Delivery{Acknowledger: acknowledger, DeliveryTag: 1})
+		second := tracker.track(amqp.Delivery{Acknowledger: acknowledger, DeliveryTag: 2})
+		third := tracker.track(amqp.Delivery{Acknowledger: acknowledger, DeliveryTag: 3})
+
+		tracker.complete(third, outcomeAck)
+		tracker.complete(second, outcomeAck)
+		assertCalls(t, acknowledger.calls)
+
+		tracker.complete(first, outcomeAck)
+		assertCalls(t, acknowledger.calls, "ack 3 multiple=true")
+	})
+
+	t.Run("Nack splits acknowledged runs", func(t *testing.T) {
+		acknowledger := &fakeAcknowledger{}
+		tracker := &ackTracker{}
+
+		first := tracker.track(amqp.Delivery{Acknowledger: acknowledger, DeliveryTag: 1})
+		second := tracker.track(amqp.Delivery{Acknowledger: acknowledger, DeliveryTag: 2})
+		third := tracker.track(amqp.Delivery{Acknowledger: acknowledger, DeliveryTag: 3})
+
+		tracker.complete(second, outcomeRequeue)
+		tracker.complete(third, outcomeAck)
+		tracker.complete(first, outcomeAck)
+
+		assertCalls(t, acknowledger.calls, "ack 1 multiple=true", "nack 2 requeue=true", "ack 3 multiple=true")
+	})
+
+	t.Run("Channel change flushes acknowledgements per channel", func(t *testing.T) {
+		oldChannel := &fakeAcknowledger{}
+		newChannel := &fakeAcknowledger{}
+		tracker := &ackTracker{}
+
+		first := tracker.track(amqp.Delivery{Acknowledger: oldChannel, DeliveryTag: 7})
+		second := tracker.track(amqp.Delivery{Acknowledger: newChannel, DeliveryTag: 1})
+
+		tracker.complete(second, outcomeAck)
+		tracker.complete(first, outcomeAck)
+
+		assertCalls(t, oldChannel.calls, "ack 7 multiple=true")
+		assertCalls(t, newChannel.calls, "ack 1 multiple=true")
+	})
+}
+
+// TestShardIndex проверяет, что события одной строки попадают к одному воркеру
+func TestShardIndex(t *testing.T) {
+	message := func(table string, eventType domain.EventTypeEnum, value interface{}, old interface{}) *domain.Message {
+		return &domain.Message{
+			EventType: eventType,
+			Data:      []domain.Fields{{Field: "id", NewValue: value, OldValue: old}},
+			Schema:    domain.Schema{TableName: table, PrimaryKey: []string{"id"}},
+		}
+	}
+
+	cons := &consumer{storage: &storageDb.Storage{SchemaService: &schema_database.SchemaService{
+		Routes: []schema_database.TableRoute{{Match: "app1_leads", Table: "leads"}, {Match: "app2_leads", Table: "leads"}},
+	}}}
+	shard := func(m *domain.Message, workers int) int {
+		return shardIndex(cons.rowKey(m), workers)
+	}
+
+	insert := shard(message("leads", domain.EventTypeInsert, 42, nil), 8)
+	del := shard(message("leads", domain.EventTypeDelete, nil, 42), 8)
+	if insert != del {
+		t.Errorf("Expected insert and delete of one row on the same worker, got %d and %d", insert, del)
+	}
+
+	first := cons.rowKey(message("app1_leads", domain.EventTypeUpdate, 42, nil))
+	second := cons.rowKey(message("app2_leads", domain.EventTypeDelete, nil, 42))
+	if first != second {
+		t.Errorf("Expected one row key for sources routed to one table, got %q and %q", first, second)
+	}
+
+	if got := shard(message("leads", domain.EventTypeInsert, 42, nil), 1); got != 0 {
+		t.Errorf("Expected worker 0 for single worker, got %d", got)
+	}
+}
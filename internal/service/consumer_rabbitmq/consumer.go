@@ -1,71 +1,362 @@
 package consumer_rabbitmq
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"log"
+	"strings"
+	"sync"
+	"time"
 
 	"crm-lead-service/internal/domain"
-	storageDb "crm-lead-service/internal/storage/db"
-	"crm-lead-service/pkg/rabbitmq"
+	"crm-lead-service/internal/service/schema_database"
+
+	amqp "github.com/rabbitmq/amqp091-go"
 )
 
-func Listener(c *rabbitmq.Client, storage *storageDb.Storage, queueName string) error {
-	msgs, err := c.RabbitmqChannel.Consume(
-		queueName, // queue
-		"",        // consumer
-		false,     // auto-ack (отключаем автоматическое подтверждение)
-		false,     // exclusive
-		false,     // no-local
-		false,     // no-wait
-		nil,       // args
-	)
+type Config struct {
+	// BatchSize максимальное число сообщений в пачке, 0 или 1 - обработка по одному
+	BatchSize int
+	// BatchTimeout сколько ждать добора пачки после первого сообщения
+	BatchTimeout time.Duration
+	// DeadLetterExchange и DeadLetterQueue куда отправляются сообщения, которые нельзя обработать.
+	// Нужно задать хотя бы одно из них, иначе такие сообщения было бы некуда деть
+	DeadLetterExchange string
+	DeadLetterQueue    string
+	// ParkingQueue куда откладываются сообщения, ждущие ручного изменения схемы (режим plan)
+	// или так и не дождавшиеся родительской строки. Если не задана, такие сообщения уходят в dead letter
+	ParkingQueue string
+	// MaxAttempts сколько раз пытаться записать сообщение, прежде чем отправить его в dead letter.
+	// 0 - повторять бесконечно, тогда нужна RetryMaxDelay
+	MaxAttempts int
+	// RetryBaseDelay задержка перед первым повтором, каждая следующая вдвое больше.
+	// 0 - повтор сразу, без очередей ожидания
+	RetryBaseDelay time.Duration
+	// RetryMaxDelay верхняя граница задержки
+	RetryMaxDelay time.Duration
+	// ParentRetryDelay через сколько повторить сообщение, родительской строки которого
+	// еще нет (нарушен внешний ключ). 0 - такие сообщения сразу откладываются
+	ParentRetryDelay time.Duration
+	// ParentMaxAttempts сколько раз ждать родительскую строку, прежде чем отложить сообщение.
+	// 0 - ждать бесконечно
+	ParentMaxAttempts int
+	// ShutdownTimeout сколько после остановки ждать завершения сообщений в обработке.
+	// По истечении транзакции откатываются, а сообщения возвращаются в очередь
+	ShutdownTimeout time.Duration
+	// Workers число параллельных воркеров. События одной строки (таблица + первичный ключ)
+	// всегда обрабатывает один воркер, поэтому их порядок сохраняется
+	Workers int
+}
+
+// errDeadLetterRequired dead letter не настроен: сообщения, которые нельзя записать, потерялись бы
+var errDeadLetterRequired = errors.New("dead letter exchange or queue is required")
+
+// errRetryMaxDelayRequired повторы без лимита попыток растили бы задержку, а с ней и число
+// очередей ожидания, бесконечно
+var errRetryMaxDelayRequired = errors.New("retry max delay is required when attempts are unlimited")
+
+// publisher публикует копии сообщений (реализуется *rabbitmq.Client)
+type publisher interface {
+	Publish(exchange, routingKey string, msg amqp.Publishing) error
+	DeclareDelayQueue(name, target string, ttl time.Duration) error
+}
+
+// broker выдает сообщения очереди и публикует их копии (реализуется *rabbitmq.Client)
+type broker interface {
+	publisher
+	// Consume возвращает канал сообщений, который закрывается при отмене ctx
+	Consume(ctx context.Context, queueName string) (<-chan amqp.Delivery, error)
+}
+
+// store записывает сообщения в БД (реализуется *storageDb.Storage)
+type store interface {
+	SaveMessage(ctx context.Context, message *domain.Message) error
+	SaveBatch(ctx context.Context, messages []*domain.Message) error
+	Table(message *domain.Message) schema_database.TableRef
+}
+
+type consumer struct {
+	client    publisher
+	storage   store
+	queueName string
+	config    Config
+	// workCtx контекст записи в БД, отменяется через ShutdownTimeout после остановки
+	workCtx context.Context
+	acks    *ackTracker
+	order   *rowOrder
+}
+
+// job сообщение, переданное воркеру
+type job struct {
+	delivery amqp.Delivery
+	message  *domain.Message
+	pending  *pendingDelivery
+	// key ключ строки (см. rowKey), seq порядковый номер события (см. rowOrder)
+	key string
+	seq int64
+}
+
+// Listener обрабатывает сообщения очереди, пока не отменен ctx. После отмены новые
+// сообщения не принимаются, а сообщения в обработке дописываются и подтверждаются
+func Listener(ctx context.Context, c broker, storage store, queueName string, config Config) error {
+	if config.DeadLetterExchange == "" && config.DeadLetterQueue == "" {
+		return errDeadLetterRequired
+	}
+	if config.MaxAttempts <= 0 && config.RetryBaseDelay > 0 && config.RetryMaxDelay <= 0 {
+		return errRetryMaxDelayRequired
+	}
+
+	workCtx, cancelWork := context.WithCancel(context.Background())
+	defer cancelWork()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-workCtx.Done():
+			return
+		}
+		select {
+		case <-time.After(config.ShutdownTimeout):
+			log.Printf("Shutdown timeout %s exceeded, rolling back messages in progress", config.ShutdownTimeout)
+			cancelWork()
+		case <-workCtx.Done():
+		}
+	}()
+
+	cons := &consumer{
+		client:    c,
+		storage:   storage,
+		queueName: queueName,
+		config:    config,
+		workCtx:   workCtx,
+		acks:      &ackTracker{},
+		order:     newRowOrder(),
+	}
+
+	if err := cons.declareDelayQueues(); err != nil {
+		return err
+	}
+
+	// Канал сообщений переживает переподключения к RabbitMQ и закрывается при отмене ctx
+	msgs, err := c.Consume(ctx, queueName)
 	if err != nil {
-		return fmt.Errorf("failed to register a consumer: %w", err)
+		return err
 	}
 
 	log.Printf("Waiting for messages in queue: %s", queueName)
 
+	workers := config.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	batchSize := config.BatchSize
+	if batchSize < 1 {
+		batchSize = 1
+	}
+
+	var wg sync.WaitGroup
+	jobs := make([]chan job, workers)
+	for i := range jobs {
+		jobs[i] = make(chan job, batchSize)
+		wg.Add(1)
+		go func(jobs <-chan job) {
+			defer wg.Done()
+			cons.work(jobs, batchSize)
+		}(jobs[i])
+	}
+
 	for msg := range msgs {
 		log.Printf("Received a message from queue: %s", queueName)
 
-		var message domain.Message
-		err := json.Unmarshal(msg.Body, &message)
-		if err != nil {
-			log.Printf("Error unmarshaling message: %v", err)
-			// Отклоняем сообщение, но не возвращаем его в очередь
-			msg.Nack(false, true)
+		pending := cons.acks.track(msg)
+		message, result, ok := cons.parseDelivery(msg)
+		if !ok {
+			cons.acks.complete(pending, result)
 			continue
 		}
 
-		// Проверяем валидность схемы сообщения
-		isValid, err := message.ValidateMessage()
-		if err != nil || !isValid {
-			log.Printf("Invalid message schema: %v", err)
-			msg.Nack(false, true)
-			continue
+		// События одной строки всегда попадают к одному воркеру и пишутся по порядку
+		j := cons.newJob(msg, message, pending)
+		jobs[shardIndex(j.key, workers)] <- j
+	}
+
+	for i := range jobs {
+		close(jobs[i])
+	}
+	wg.Wait()
+
+	return nil
+}
+
+// newJob собирает задание воркера. Вызывается в порядке получения
+func (c *consumer) newJob(msg amqp.Delivery, message *domain.Message, pending *pendingDelivery) job {
+	return job{
+		delivery: msg,
+		message:  message,
+		pending:  pending,
+		key:      c.rowKey(message),
+		seq:      c.order.sequence(msg),
+	}
+}
+
+// rowKey возвращает ключ строки сообщения: таблица в БД после маршрутизации и значения
+// первичного ключа. События разных источников, которые пишутся в одну таблицу, получают один ключ
+func (c *consumer) rowKey(message *domain.Message) string {
+	var key strings.Builder
+	key.WriteString(c.storage.Table(message).String())
+	for _, pk := range message.Schema.PrimaryKey {
+		value, _ := message.GetKeyValue(pk)
+		key.WriteByte(0)
+		fmt.Fprintf(&key, "%v", value)
+	}
+	return key.String()
+}
+
+// shardIndex выбирает воркера по хешу ключа строки
+func shardIndex(rowKey string, workers int) int {
+	if workers == 1 {
+		return 0
+	}
+
+	hash := fnv.New32a()
+	hash.Write([]byte(rowKey))
+	return int(hash.Sum32() % uint32(workers))
+}
+
+// work обрабатывает сообщения воркера пачками по batchSize штук или по истечении BatchTimeout
+func (c *consumer) work(jobs <-chan job, batchSize int) {
+	batch := make([]job, 0, batchSize)
+	var deadline <-chan time.Time
+
+	for {
+		select {
+		case j, ok := <-jobs:
+			if !ok {
+				c.processBatch(batch)
+				return
+			}
+			batch = append(batch, j)
+			if len(batch) == 1 {
+				deadline = time.After(c.config.BatchTimeout)
+			}
+			if len(batch) < batchSize {
+				continue
+			}
+		case <-deadline:
 		}
 
-		log.Printf("Processing message: EventType=%s, Table=%s, Fields=%d",
-			message.EventType, message.Schema.TableName, len(message.Data))
+		c.processBatch(batch)
+		batch = batch[:0]
+		deadline = nil
+	}
+}
 
-		err = storage.SaveMessage(&message)
-		if err != nil {
-			log.Printf("Error saving message to database: %v", err)
-			// Отклоняем сообщение и возвращаем в очередь для повторной обработки
-			msg.Nack(false, true)
-			continue
+// processBatch записывает пачку одной транзакцией. Если пачка не записалась,
+// сообщения обрабатываются по одному, чтобы ошибка коснулась только сообщения,
+// которое ее вызвало
+func (c *consumer) processBatch(batch []job) {
+	// События строк, которые ждут более раннее событие в очереди ожидания, уходят за ним
+	admitted := make([]job, 0, len(batch))
+	for _, j := range batch {
+		if c.admit(j) {
+			admitted = append(admitted, j)
 		}
+	}
+	batch = admitted
+
+	switch len(batch) {
+	case 0:
+		return
+	case 1:
+		c.acks.complete(batch[0].pending, c.processMessage(batch[0]))
+		return
+	}
 
-		log.Printf("Successfully processed message: Table=%s, EventType=%s",
-			message.Schema.TableName, message.EventType)
+	log.Printf("Processing batch of %d messages", len(batch))
 
-		// Подтверждаем успешную обработку сообщения
-		err = msg.Ack(false)
-		if err != nil {
-			log.Printf("Error acknowledging message: %v", err)
+	messages := make([]*domain.Message, len(batch))
+	for i, j := range batch {
+		messages[i] = j.message
+	}
+
+	err := c.storage.SaveBatch(c.workCtx, messages)
+	if err != nil {
+		if c.workCtx.Err() != nil {
+			log.Printf("Write interrupted by shutdown, returning %d message(s) to queue", len(batch))
+			for _, j := range batch {
+				c.acks.complete(j.pending, outcomeRequeue)
+			}
+			return
 		}
+		log.Printf("Error saving batch of %d messages, falling back to one by one: %v", len(batch), err)
+		for _, j := range batch {
+			// Предыдущее событие строки из этой пачки могло уйти на повтор
+			if c.admit(j) {
+				c.acks.complete(j.pending, c.processMessage(j))
+			}
+		}
+		return
 	}
 
-	return nil
+	log.Printf("Successfully processed batch of %d messages", len(batch))
+
+	// Подтверждение уйдет одним Ack(multiple=true), как только завершатся предыдущие сообщения
+	for _, j := range batch {
+		c.acks.complete(j.pending, outcomeAck)
+	}
+}
+
+// parseDelivery разбирает и валидирует сообщение. Невалидное сообщение уходит в dead letter
+func (c *consumer) parseDelivery(msg amqp.Delivery) (*domain.Message, outcome, bool) {
+	var message domain.Message
+	err := json.Unmarshal(msg.Body, &message)
+	if err != nil {
+		log.Printf("Error unmarshaling message: %v", err)
+		// Повтор не поможет, сразу отправляем в dead letter
+		return nil, c.deadLetter(msg, "", fmt.Errorf("failed to unmarshal message: %w", err)), false
+	}
+
+	// Проверяем валидность схемы сообщения
+	isValid, err := message.ValidateMessage()
+	if err != nil || !isValid {
+		log.Printf("Invalid message schema: %v", err)
+		if err == nil {
+			err = fmt.Errorf("tableName and columns are required")
+		}
+		return nil, c.deadLetter(msg, message.Schema.TableName, fmt.Errorf("invalid message schema: %w", err)), false
+	}
+
+	// Источник нужен правилам маршрутизации таблиц
+	if message.Source == "" {
+		message.Source = msg.AppId
+	}
+	message.Redelivered = redelivered(msg)
+
+	return &message, outcomeAck, true
+}
+
+// processMessage записывает одно сообщение и возвращает, как его подтвердить
+func (c *consumer) processMessage(j job) outcome {
+	message := j.message
+	log.Printf("Processing message: EventType=%s, Table=%s, Fields=%d",
+		message.EventType, message.Schema.TableName, len(message.Data))
+
+	err := c.storage.SaveMessage(c.workCtx, message)
+	if err != nil {
+		if c.workCtx.Err() != nil {
+			// Транзакция уже откатилась, поэтому в БД от сообщения ничего не осталось
+			log.Printf("Write interrupted by shutdown, returning message to queue: Table=%s", message.Schema.TableName)
+			return outcomeRequeue
+		}
+		log.Printf("Error saving message to database: %v", err)
+		return c.retry(j, err)
+	}
+
+	log.Printf("Successfully processed message: Table=%s, EventType=%s",
+		message.Schema.TableName, message.EventType)
+
+	return outcomeAck
 }
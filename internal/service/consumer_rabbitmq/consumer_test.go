@@ -0,0 +1,138 @@
+package consumer_rabbitmq
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"crm-lead-service/internal/domain"
+	"crm-lead-service/internal/service/schema_database"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// TestListenerRequiresDeadLetter проверяет, что консьюмер без dead letter не запускается
+func TestListenerRequiresDeadLetter(t *testing.T) {
+	err := Listener(context.Background(), nil, nil, "white_data", Config{MaxAttempts: 5})
+	if !errors.Is(err, errDeadLetterRequired) {
+		t.Errorf("Expected errDeadLetterRequired, got %v", err)
+	}
+}
+
+// TestListenerRequiresRetryMaxDelay проверяет, что повторы без лимита попыток требуют верхней границы задержки
+func TestListenerRequiresRetryMaxDelay(t *testing.T) {
+	config := Config{DeadLetterQueue: "white_data.dlq", RetryBaseDelay: time.Second}
+	err := Listener(context.Background(), nil, nil, "white_data", config)
+	if !errors.Is(err, errRetryMaxDelayRequired) {
+		t.Errorf("Expected errRetryMaxDelayRequired, got %v", err)
+	}
+}
+
+// fakeBroker отдает заданные сообщения и, как клиент RabbitMQ, закрывает канал при отмене ctx
+type fakeBroker struct {
+	fakePublisher
+	deliveries []amqp.Delivery
+	// sent закрывается, когда все сообщения переданы консьюмеру
+	sent chan struct{}
+}
+
+func (b *fakeBroker) Consume(ctx context.Context, _ string) (<-chan amqp.Delivery, error) {
+	msgs := make(chan amqp.Delivery)
+	go func() {
+		defer close(msgs)
+		for _, delivery := range b.deliveries {
+			msgs <- delivery
+		}
+		close(b.sent)
+		<-ctx.Done()
+	}()
+	return msgs, nil
+}
+
+// blockingStore держит запись, пока ее не отпустят release или отмена контекста записи
+type blockingStore struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingStore) SaveMessage(ctx context.Context, _ *domain.Message) error {
+	s.started <- struct{}{}
+	select {
+	case <-s.release:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *blockingStore) SaveBatch(context.Context, []*domain.Message) error {
+	return fmt.Errorf("batches are not supported")
+}
+
+func (s *blockingStore) Table(message *domain.Message) schema_database.TableRef {
+	return schema_database.TableRef{Schema: "public", Name: message.Schema.TableName}
+}
+
+// TestListenerShutdown проверяет остановку консьюмера: сообщение в обработке дописывается
+// и подтверждается, а по истечении ShutdownTimeout запись откатывается и все сообщения,
+// в том числе ждущие в очереди воркера, возвращаются брокеру до выхода из Listener
+func TestListenerShutdown(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages int
+		timeout  time.Duration
+		release  bool
+		expected []string
+	}{
+		{"Message in progress is finished", 1, time.Minute, true, []string{"ack 1 multiple=true"}},
+		{"Messages are requeued after timeout", 2, 20 * time.Millisecond, false,
+			[]string{"nack 1 requeue=true", "nack 2 requeue=true"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			acknowledger := &fakeAcknowledger{}
+			client := &fakeBroker{sent: make(chan struct{})}
+			for id := 1; id <= tt.messages; id++ {
+				body, _ := json.Marshal(domain.Message{
+					EventType: domain.EventTypeInsert,
+					Data:      []domain.Fields{{Field: "id", NewValue: id}},
+					Schema: domain.Schema{
+						TableName:  "leads",
+						PrimaryKey: []string{"id"},
+						Columns:    map[string]domain.ColumnInfo{"id": {Name: "id", Type: "integer"}},
+					},
+				})
+				client.deliveries = append(client.deliveries,
+					amqp.Delivery{Acknowledger: acknowledger, DeliveryTag: uint64(id), Body: body})
+			}
+			storage := &blockingStore{started: make(chan struct{}, tt.messages), release: make(chan struct{})}
+			config := Config{DeadLetterQueue: "white_data.dlq", MaxAttempts: 5, ShutdownTimeout: tt.timeout}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan error, 1)
+			go func() { done <- Listener(ctx, client, storage, "white_data", config) }()
+
+			// Первое сообщение в обработке, остальные ждут в очереди воркера
+			<-storage.started
+			<-client.sent
+			cancel()
+			if tt.release {
+				close(storage.release)
+			}
+
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Fatalf("Expected no error, got %v", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Listener did not stop")
+			}
+			assertCalls(t, acknowledger.calls, tt.expected...)
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package consumer_rabbitmq
+
+import (
+	"expvar"
+	"log"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	// headerRetryCount сколько раз сообщение уже не удалось обработать
+	headerRetryCount = "x-retry-count"
+	// headerDeliveryCount счетчик доставок quorum-очередей
+	headerDeliveryCount = "x-delivery-count"
+	headerError         = "x-error"
+	headerTable         = "x-table"
+	headerOriginalQueue = "x-original-queue"
+	headerFailedAt      = "x-failed-at"
+	// headerParentWaitCount сколько раз сообщение ждало родительскую строку
+	headerParentWaitCount = "x-parent-wait-count"
+)
+
+// Счетчики отложенных сообщений и ожиданий родительской строки, доступны через expvar по /debug/vars
+var (
+	parkedMessages = expvar.NewInt("parked_messages")
+	parentWaits    = expvar.NewInt("parent_waits")
+)
+
+// deadLetter отправляет в dead letter сообщение, которое не имеет смысла повторять
+func (c *consumer) deadLetter(msg amqp.Delivery, tableName string, cause error) outcome {
+	return c.publishDeadLetter(msg, tableName, retryCount(msg)+1, cause)
+}
+
+// publishDeadLetter публикует сообщение в dead letter с заголовками об ошибке, после чего
+// оригинал можно подтвердить. Dead letter обязателен (см. Listener), поэтому сообщение не теряется
+func (c *consumer) publishDeadLetter(msg amqp.Delivery, tableName string, attempts int, cause error) outcome {
+	headers := c.failureHeaders(msg, tableName, attempts, cause)
+	err := c.client.Publish(c.config.DeadLetterExchange, c.config.DeadLetterQueue, republishing(msg, headers))
+	if err != nil {
+		// Терять сообщение нельзя, возвращаем его в очередь
+		log.Printf("Error publishing message to dead letter: %v", err)
+		return outcomeRequeue
+	}
+
+	log.Printf("Message sent to dead letter: Table=%s, Attempts=%d, Error=%v", tableName, attempts, cause)
+
+	return outcomeAck
+}
+
+// park откладывает сообщение, ждущее ручного изменения схемы или так и не дождавшееся
+// родительской строки, в очередь отложенных. После исправления причины сообщения
+// возвращаются в основную очередь вручную (например, shovel).
+// Если очередь отложенных не задана, сообщение уходит в dead letter
+func (c *consumer) park(msg amqp.Delivery, tableName string, cause error) outcome {
+	if c.config.ParkingQueue == "" {
+		return c.deadLetter(msg, tableName, cause)
+	}
+
+	headers := c.failureHeaders(msg, tableName, retryCount(msg), cause)
+	err := c.client.Publish("", c.config.ParkingQueue, republishing(msg, headers))
+	if err != nil {
+		log.Printf("Error publishing message to parking queue: %v", err)
+		return outcomeRequeue
+	}
+
+	parkedMessages.Add(1)
+	log.Printf("Message parked: Table=%s, Queue=%s, Error=%v", tableName, c.config.ParkingQueue, cause)
+
+	return outcomeAck
+}
+
+// failureHeaders возвращает заголовки полученного сообщения с описанием ошибки
+func (c *consumer) failureHeaders(msg amqp.Delivery, tableName string, attempts int, cause error) amqp.Table {
+	headers := copyHeaders(msg.Headers)
+	headers[headerError] = cause.Error()
+	headers[headerRetryCount] = int32(attempts)
+	headers[headerOriginalQueue] = c.queueName
+	headers[headerFailedAt] = time.Now().UTC().Format(time.RFC3339)
+	if tableName != "" {
+		headers[headerTable] = tableName
+	}
+	return headers
+}
+
+// retryCount возвращает число неудачных попыток обработки из заголовков сообщения
+func retryCount(msg amqp.Delivery) int {
+	count := headerInt(msg.Headers, headerRetryCount)
+	if deliveries := headerInt(msg.Headers, headerDeliveryCount); deliveries > count {
+		count = deliveries
+	}
+	return count
+}
+
+// redelivered сообщает, что сообщение уже доставлялось: брокер вернул его в очередь,
+// или это копия из очереди ожидания
+func redelivered(msg amqp.Delivery) bool {
+	_, waitedForRow := msg.Headers[headerOrderSeq]
+	return msg.Redelivered || waitedForRow || retryCount(msg) > 0 || headerInt(msg.Headers, headerParentWaitCount) > 0
+}
+
+// headerInt читает целочисленный заголовок, приводя числовые типы AMQP к int
+func headerInt(headers amqp.Table, name string) int {
+	switch v := headers[name].(type) {
+	case int:
+		return v
+	case int8:
+		return int(v)
+	case int16:
+		return int(v)
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case uint8:
+		return int(v)
+	case uint16:
+		return int(v)
+	case uint32:
+		return int(v)
+	default:
+		return 0
+	}
+}
+
+// copyHeaders копирует заголовки, чтобы не менять заголовки полученного сообщения
+func copyHeaders(headers amqp.Table) amqp.Table {
+	result := make(amqp.Table, len(headers)+5)
+	for key, value := range headers {
+		result[key] = value
+	}
+	return result
+}
+
+// republishing собирает публикацию из полученного сообщения с новыми заголовками
+func republishing(msg amqp.Delivery, headers amqp.Table) amqp.Publishing {
+	return amqp.Publishing{
+		Headers:         headers,
+		ContentType:     msg.ContentType,
+		ContentEncoding: msg.ContentEncoding,
+		DeliveryMode:    amqp.Persistent,
+		Priority:        msg.Priority,
+		CorrelationId:   msg.CorrelationId,
+		MessageId:       msg.MessageId,
+		Timestamp:       msg.Timestamp,
+		Type:            msg.Type,
+		AppId:           msg.AppId,
+		Body:            msg.Body,
+	}
+}
@@ -0,0 +1,141 @@
+package consumer_rabbitmq
+
+import (
+	"expvar"
+	"log"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// headerOrderSeq порядковый номер события, под которым оно ждет в очереди ожидания
+const headerOrderSeq = "x-order-seq"
+
+// orderGrace сколько сверх задержки очереди ожидания ждать возврата события строки,
+// прежде чем перестать задерживать за ним следующие события
+const orderGrace = 10 * time.Minute
+
+// orderWaits счетчик событий, отправленных ждать более раннее событие своей строки
+var orderWaits = expvar.NewInt("order_waits")
+
+// delayQueue очередь ожидания и ее задержка
+type delayQueue struct {
+	name  string
+	delay time.Duration
+}
+
+// waitingRow события строки, которые ждут в очередях ожидания
+type waitingRow struct {
+	// queue очередь, в которую ушло последнее событие строки
+	queue delayQueue
+	// seqs порядковые номера ждущих событий и сроки, до которых их ждать
+	seqs map[int64]time.Time
+}
+
+// rowOrder сохраняет порядок событий строки, пока одно из них ждет в очереди ожидания.
+// Иначе следующие события обгоняли бы повтор: например, устаревший update возвращался бы
+// после delete и воскрешал строку. Пока строка ждет событие, следующие события уходят
+// за ним в ту же очередь ожидания и возвращаются в порядке получения.
+// Состояние хранится в памяти процесса и не переживает перезапуск
+type rowOrder struct {
+	mu   sync.Mutex
+	next int64
+	rows map[string]*waitingRow
+}
+
+func newRowOrder() *rowOrder {
+	// Номера, выданные после перезапуска, больше номеров событий, ждущих с прошлого запуска
+	return &rowOrder{next: time.Now().UnixNano(), rows: make(map[string]*waitingRow)}
+}
+
+// sequence возвращает порядковый номер события: из заголовка, если событие уже ждало,
+// иначе новый. Вызывается в порядке получения
+func (o *rowOrder) sequence(msg amqp.Delivery) int64 {
+	if seq, ok := msg.Headers[headerOrderSeq].(int64); ok && seq > 0 {
+		return seq
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.next++
+	return o.next
+}
+
+// admit сообщает, можно ли записать событие сейчас. Если строка ждет более раннее
+// событие, возвращает очередь ожидания, в которую за ним нужно отправить это событие
+func (o *rowOrder) admit(key string, seq int64) (delayQueue, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	row, ok := o.rows[key]
+	if !ok {
+		return delayQueue{}, true
+	}
+
+	// Событие вернулось из очереди ожидания и больше не задерживает остальные
+	delete(row.seqs, seq)
+
+	now := time.Now()
+	earlier := false
+	for waiting, deadline := range row.seqs {
+		if now.After(deadline) {
+			// Событие так и не вернулось (например, очередь ожидания очистили)
+			delete(row.seqs, waiting)
+			continue
+		}
+		if waiting < seq {
+			earlier = true
+		}
+	}
+	if len(row.seqs) == 0 {
+		delete(o.rows, key)
+	}
+
+	return row.queue, !earlier
+}
+
+// wait отмечает, что событие строки ушло в очередь ожидания
+func (o *rowOrder) wait(key string, seq int64, queue delayQueue) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	row, ok := o.rows[key]
+	if !ok {
+		row = &waitingRow{seqs: make(map[int64]time.Time)}
+		o.rows[key] = row
+	}
+	row.queue = queue
+	row.seqs[seq] = time.Now().Add(queue.delay + orderGrace)
+}
+
+// admit пропускает событие к записи или отправляет его за более ранним событием строки
+// в очередь ожидания. Возвращает false, если событие уже завершено
+func (c *consumer) admit(j job) bool {
+	queue, ok := c.order.admit(j.key, j.seq)
+	if ok {
+		return true
+	}
+
+	c.acks.complete(j.pending, c.waitRow(j, queue))
+	return false
+}
+
+// waitRow отправляет событие в очередь ожидания за более ранним событием своей строки
+func (c *consumer) waitRow(j job, queue delayQueue) outcome {
+	headers := copyHeaders(j.delivery.Headers)
+	headers[headerOrderSeq] = j.seq
+
+	err := c.client.Publish("", queue.name, republishing(j.delivery, headers))
+	if err != nil {
+		log.Printf("Error republishing message to keep row order: %v", err)
+		return outcomeRequeue
+	}
+
+	c.order.wait(j.key, j.seq, queue)
+	orderWaits.Add(1)
+	log.Printf("Earlier event of the row is waiting, sending message after it to %s: Table=%s",
+		queue.name, j.message.Schema.TableName)
+
+	return outcomeAck
+}
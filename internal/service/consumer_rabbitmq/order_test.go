@@ -0,0 +1,133 @@
+package consumer_rabbitmq
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"crm-lead-service/internal/domain"
+	"crm-lead-service/internal/service/schema_database"
+
+	"github.com/lib/pq"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// fakeStore записывает события и возвращает заданные ошибки по типу события
+type fakeStore struct {
+	errs  map[domain.EventTypeEnum][]error
+	saved []domain.EventTypeEnum
+}
+
+func (s *fakeStore) SaveMessage(_ context.Context, message *domain.Message) error {
+	if errs := s.errs[message.EventType]; len(errs) > 0 {
+		s.errs[message.EventType] = errs[1:]
+		return errs[0]
+	}
+	s.saved = append(s.saved, message.EventType)
+	return nil
+}
+
+func (s *fakeStore) SaveBatch(context.Context, []*domain.Message) error {
+	return fmt.Errorf("batches are not supported")
+}
+
+func (s *fakeStore) Table(message *domain.Message) schema_database.TableRef {
+	return schema_database.TableRef{Schema: "public", Name: message.Schema.TableName}
+}
+
+// publication опубликованная копия сообщения
+type publication struct {
+	routingKey string
+	msg        amqp.Publishing
+}
+
+// fakePublisher записывает публикации и объявленные очереди ожидания
+type fakePublisher struct {
+	published []publication
+	declared  []string
+}
+
+func (p *fakePublisher) Publish(_, routingKey string, msg amqp.Publishing) error {
+	p.published = append(p.published, publication{routingKey: routingKey, msg: msg})
+	return nil
+}
+
+func (p *fakePublisher) DeclareDelayQueue(name, _ string, _ time.Duration) error {
+	p.declared = append(p.declared, name)
+	return nil
+}
+
+// TestRowOrderDuringRetry проверяет, что событие строки не обгоняет повтор
+// более раннего события: delete ждет update в той же очереди ожидания
+func TestRowOrderDuringRetry(t *testing.T) {
+	storage := &fakeStore{errs: map[domain.EventTypeEnum][]error{
+		domain.EventTypeUpdate: {&pq.Error{Code: "40001"}},
+	}}
+	client := &fakePublisher{}
+	acknowledger := &fakeAcknowledger{}
+	cons := &consumer{
+		client:    client,
+		storage:   storage,
+		queueName: "white_data",
+		config:    Config{MaxAttempts: 5, RetryBaseDelay: time.Second, DeadLetterQueue: "white_data.dlq"},
+		workCtx:   context.Background(),
+		acks:      &ackTracker{},
+		order:     newRowOrder(),
+	}
+
+	tag := uint64(0)
+	receive := func(headers amqp.Table, body []byte) {
+		t.Helper()
+		tag++
+		msg := amqp.Delivery{Acknowledger: acknowledger, DeliveryTag: tag, Headers: headers, Body: body}
+		pending := cons.acks.track(msg)
+		message, _, ok := cons.parseDelivery(msg)
+		if !ok {
+			t.Fatalf("Failed to parse message %s", body)
+		}
+		cons.processBatch([]job{cons.newJob(msg, message, pending)})
+	}
+	event := func(eventType domain.EventTypeEnum, value, old interface{}) []byte {
+		body, _ := json.Marshal(domain.Message{
+			EventType: eventType,
+			Data:      []domain.Fields{{Field: "id", NewValue: value, OldValue: old}},
+			Schema: domain.Schema{
+				TableName:  "leads",
+				PrimaryKey: []string{"id"},
+				Columns:    map[string]domain.ColumnInfo{"id": {Name: "id", Type: "integer"}},
+			},
+		})
+		return body
+	}
+
+	receive(nil, event(domain.EventTypeUpdate, 42, 42))
+	receive(nil, event(domain.EventTypeDelete, nil, 42))
+
+	if len(storage.saved) != 0 {
+		t.Fatalf("Expected nothing saved while update waits for retry, got %v", storage.saved)
+	}
+	if len(client.published) != 2 {
+		t.Fatalf("Expected update and delete in delay queue, got %d publication(s)", len(client.published))
+	}
+	for _, p := range client.published {
+		if p.routingKey != "white_data.retry.1000" {
+			t.Errorf("Expected delay queue 'white_data.retry.1000', got '%s'", p.routingKey)
+		}
+	}
+
+	// Брокер возвращает копии из очереди ожидания в порядке публикации
+	for _, p := range client.published {
+		receive(p.msg.Headers, p.msg.Body)
+	}
+
+	expected := []domain.EventTypeEnum{domain.EventTypeUpdate, domain.EventTypeDelete}
+	if fmt.Sprint(storage.saved) != fmt.Sprint(expected) {
+		t.Errorf("Expected events saved in order %v, got %v", expected, storage.saved)
+	}
+	if len(cons.order.rows) != 0 {
+		t.Errorf("Expected no waiting rows after replay, got %d", len(cons.order.rows))
+	}
+	assertCalls(t, acknowledger.calls, "ack 1 multiple=true", "ack 2 multiple=true", "ack 3 multiple=true", "ack 4 multiple=true")
+}
@@ -0,0 +1,243 @@
+package consumer_rabbitmq
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"crm-lead-service/internal/service/schema_database"
+
+	"github.com/lib/pq"
+)
+
+type errorClass int
+
+const (
+	// errorTransient временная ошибка: повтор через некоторое время может пройти успешно
+	errorTransient errorClass = iota
+	// errorPermanent постоянная ошибка: повтор даст тот же результат
+	errorPermanent
+)
+
+func (e errorClass) String() string {
+	if e == errorPermanent {
+		return "permanent"
+	}
+	return "transient"
+}
+
+// transientCodes коды и классы ошибок PostgreSQL, после которых имеет смысл повторить запись
+var transientCodes = []string{
+	"08",    // connection_exception
+	"40001", // serialization_failure
+	"40P01", // deadlock_detected
+	"53",    // insufficient_resources
+	"55P03", // lock_not_available
+	"57014", // query_canceled
+	"57P01", // admin_shutdown
+	"57P02", // crash_shutdown
+	"57P03", // cannot_connect_now
+}
+
+// classifyError определяет, временная ли ошибка записи в БД.
+// Неизвестные коды PostgreSQL считаются временными, чтобы не терять сообщения,
+// остальные ошибки без признаков проблем с соединением - постоянными (ошибки данных сообщения)
+func classifyError(err error) errorClass {
+	// Конфликт схемы требует ручного вмешательства, повтор не поможет
+	var conflict *schema_database.SchemaConflictError
+	if errors.As(err, &conflict) {
+		return errorPermanent
+	}
+
+	// Недопустимое имя из сообщения не станет допустимым при повторе
+	var invalid *schema_database.InvalidIdentifierError
+	if errors.As(err, &invalid) {
+		return errorPermanent
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		code := string(pqErr.Code)
+		for _, transient := range transientCodes {
+			if strings.HasPrefix(code, transient) {
+				return errorTransient
+			}
+		}
+		switch pqErr.Code.Class() {
+		case "22", // data_exception: несовпадение типов, переполнение и т.п.
+			"23", // integrity_constraint_violation: NOT NULL, UNIQUE, CHECK
+			"42": // syntax_error_or_access_rule_violation
+			return errorPermanent
+		}
+		return errorTransient
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) ||
+		errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, sql.ErrConnDone) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, context.DeadlineExceeded) {
+		return errorTransient
+	}
+
+	return errorPermanent
+}
+
+// retryDelay возвращает задержку перед попыткой attempt: base, 2*base, 4*base... но не больше max
+func retryDelay(attempt int, base, max time.Duration) time.Duration {
+	delay := base
+	for i := 1; i < attempt; i++ {
+		delay *= 2
+		if max > 0 && delay >= max {
+			return max
+		}
+	}
+	if max > 0 && delay > max {
+		return max
+	}
+	return delay
+}
+
+// delayQueueName имя очереди ожидания для задержки delay
+func delayQueueName(queueName string, delay time.Duration) string {
+	return fmt.Sprintf("%s.retry.%d", queueName, delay.Milliseconds())
+}
+
+// declareDelayQueues объявляет очереди ожидания для всех уровней задержки и для ожидания
+// родительской строки. Сообщение лежит в очереди ожидания TTL и возвращается брокером в основную очередь
+func (c *consumer) declareDelayQueues() error {
+	var delays []time.Duration
+	if c.config.RetryBaseDelay > 0 {
+		// Без лимита попыток задержка растет до RetryMaxDelay, дальше очередь та же
+		for attempt := 1; c.config.MaxAttempts <= 0 || attempt < c.config.MaxAttempts; attempt++ {
+			delay := retryDelay(attempt, c.config.RetryBaseDelay, c.config.RetryMaxDelay)
+			delays = append(delays, delay)
+			if c.config.MaxAttempts <= 0 && delay >= c.config.RetryMaxDelay {
+				break
+			}
+		}
+	}
+	if c.config.ParentRetryDelay > 0 {
+		delays = append(delays, c.config.ParentRetryDelay)
+	}
+
+	declared := make(map[time.Duration]bool)
+	for _, delay := range delays {
+		if declared[delay] {
+			continue
+		}
+		err := c.client.DeclareDelayQueue(delayQueueName(c.queueName, delay), c.queueName, delay)
+		if err != nil {
+			return err
+		}
+		declared[delay] = true
+	}
+
+	return nil
+}
+
+// isMissingParent сообщает, что запись нарушила внешний ключ: родительской строки еще нет
+// или удаляемую строку еще держат дочерние. Реплика получает таблицы из разных очередей
+// и пачек, поэтому порядок строк не гарантирован и повтор позже обычно проходит
+func isMissingParent(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23503"
+}
+
+// retry обрабатывает ошибку записи: сообщения, ждущие изменения схемы, откладываются,
+// сообщения без родительской строки ждут ее отдельно от лимита попыток, постоянные ошибки сразу уходят в dead letter,
+// временные повторяются через очереди ожидания с экспоненциальной задержкой.
+// Когда попытки исчерпаны, сообщение уходит в dead letter. Пока сообщение ждет повтора,
+// следующие события его строки ждут за ним (см. rowOrder)
+func (c *consumer) retry(j job, cause error) outcome {
+	msg, tableName := j.delivery, j.message.Schema.TableName
+
+	// Изменение схемы ждет ручного применения, повторять до него бессмысленно
+	var pending *schema_database.SchemaChangePendingError
+	if errors.As(cause, &pending) {
+		return c.park(msg, tableName, cause)
+	}
+
+	if isMissingParent(cause) {
+		return c.waitParent(j, cause)
+	}
+
+	class := classifyError(cause)
+	if class == errorPermanent {
+		log.Printf("Permanent error, sending to dead letter: Table=%s", tableName)
+		return c.deadLetter(msg, tableName, cause)
+	}
+
+	// Без лимита попыток (MaxAttempts <= 0) сообщение повторяется бесконечно, но тоже через очереди ожидания
+	attempts := retryCount(msg) + 1
+	if c.config.MaxAttempts > 0 && attempts >= c.config.MaxAttempts {
+		log.Printf("Message exceeded %d attempts, sending to dead letter: Table=%s", c.config.MaxAttempts, tableName)
+		return c.publishDeadLetter(msg, tableName, attempts, cause)
+	}
+
+	// Nack не умеет менять заголовки, поэтому публикуем копию со счетчиком
+	headers := copyHeaders(msg.Headers)
+	headers[headerRetryCount] = int32(attempts)
+	headers[headerOrderSeq] = j.seq
+
+	queue := delayQueue{name: c.queueName}
+	if c.config.RetryBaseDelay > 0 {
+		queue.delay = retryDelay(attempts, c.config.RetryBaseDelay, c.config.RetryMaxDelay)
+		queue.name = delayQueueName(c.queueName, queue.delay)
+		limit := "unlimited"
+		if c.config.MaxAttempts > 0 {
+			limit = fmt.Sprint(c.config.MaxAttempts)
+		}
+		log.Printf("Transient error, retrying in %s (attempt %d/%s): Table=%s",
+			queue.delay, attempts, limit, tableName)
+	}
+
+	err := c.client.Publish("", queue.name, republishing(msg, headers))
+	if err != nil {
+		log.Printf("Error republishing message for retry: %v", err)
+		return outcomeRequeue
+	}
+	c.order.wait(j.key, j.seq, queue)
+
+	// Копия уже в очереди, оригинал подтверждаем
+	return outcomeAck
+}
+
+// waitParent повторяет сообщение, которому не хватает родительской строки, через
+// ParentRetryDelay, не расходуя MaxAttempts: родитель обычно приходит следом.
+// Если родитель так и не появился, сообщение откладывается в очередь отложенных
+func (c *consumer) waitParent(j job, cause error) outcome {
+	msg, tableName := j.delivery, j.message.Schema.TableName
+	attempts := headerInt(msg.Headers, headerParentWaitCount) + 1
+	if c.config.ParentRetryDelay <= 0 || (c.config.ParentMaxAttempts > 0 && attempts >= c.config.ParentMaxAttempts) {
+		log.Printf("Parent row is still missing after %d attempt(s): Table=%s", attempts, tableName)
+		return c.park(msg, tableName, cause)
+	}
+
+	headers := copyHeaders(msg.Headers)
+	headers[headerParentWaitCount] = int32(attempts)
+	headers[headerOrderSeq] = j.seq
+
+	queue := delayQueue{name: delayQueueName(c.queueName, c.config.ParentRetryDelay), delay: c.config.ParentRetryDelay}
+	err := c.client.Publish("", queue.name, republishing(msg, headers))
+	if err != nil {
+		log.Printf("Error republishing message to wait for parent row: %v", err)
+		return outcomeRequeue
+	}
+	c.order.wait(j.key, j.seq, queue)
+
+	parentWaits.Add(1)
+	log.Printf("Parent row is missing, retrying in %s (attempt %d): Table=%s",
+		c.config.ParentRetryDelay, attempts, tableName)
+
+	return outcomeAck
+}
@@ -0,0 +1,152 @@
+package consumer_rabbitmq
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"crm-lead-service/internal/domain"
+	"crm-lead-service/internal/service/schema_database"
+
+	"github.com/lib/pq"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// TestClassifyError проверяет разделение ошибок на временные и постоянные
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected errorClass
+	}{
+		{"Connection failure", &pq.Error{Code: "08006"}, errorTransient},
+		{"Serialization failure", &pq.Error{Code: "40001"}, errorTransient},
+		{"Deadlock", &pq.Error{Code: "40P01"}, errorTransient},
+		{"Admin shutdown", &pq.Error{Code: "57P01"}, errorTransient},
+		{"Too many connections", &pq.Error{Code: "53300"}, errorTransient},
+		{"Not null violation", &pq.Error{Code: "23502"}, errorPermanent},
+		{"Invalid text representation", &pq.Error{Code: "22P02"}, errorPermanent},
+		{"Datatype mismatch", &pq.Error{Code: "42804"}, errorPermanent},
+		{"Unknown PostgreSQL code", &pq.Error{Code: "XX000"}, errorTransient},
+		{"Wrapped PostgreSQL error", fmt.Errorf("failed to insert data: %w", &pq.Error{Code: "40P01"}), errorTransient},
+		{"Bad connection", fmt.Errorf("failed to begin transaction: %w", driver.ErrBadConn), errorTransient},
+		{"Message data error", errors.New("no primary key values found"), errorPermanent},
+		{"Schema conflict", fmt.Errorf("failed to check/update schema: %w",
+			&schema_database.SchemaConflictError{Table: "leads", Column: "id"}), errorPermanent},
+		{"Invalid identifier", &schema_database.InvalidIdentifierError{Kind: "table", Name: `leads"`, Reason: "invalid characters"}, errorPermanent},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := classifyError(tt.err); got != tt.expected {
+				t.Errorf("Expected %s, got %s", tt.expected, got)
+			}
+		})
+	}
+}
+
+// TestIsMissingParent проверяет распознавание нарушения внешнего ключа
+func TestIsMissingParent(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{"Foreign key violation", fmt.Errorf("failed to commit transaction: %w", &pq.Error{Code: "23503"}), true},
+		{"Unique violation", &pq.Error{Code: "23505"}, false},
+		{"Not a PostgreSQL error", errors.New("no primary key values found"), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isMissingParent(tt.err); got != tt.expected {
+				t.Errorf("Expected %t, got %t", tt.expected, got)
+			}
+		})
+	}
+}
+
+// TestRetryDelay проверяет экспоненциальную задержку с верхней границей
+func TestRetryDelay(t *testing.T) {
+	base := time.Second
+	max := 10 * time.Second
+
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}
+	for i, want := range expected {
+		if got := retryDelay(i+1, base, max); got != want {
+			t.Errorf("Attempt %d: expected %s, got %s", i+1, want, got)
+		}
+	}
+
+	if got := retryDelay(5, base, 0); got != 16*time.Second {
+		t.Errorf("Expected unbounded delay 16s, got %s", got)
+	}
+}
+
+// TestDelayQueueName проверяет имя очереди ожидания
+func TestDelayQueueName(t *testing.T) {
+	if got := delayQueueName("white_data", 1500*time.Millisecond); got != "white_data.retry.1500" {
+		t.Errorf("Expected 'white_data.retry.1500', got '%s'", got)
+	}
+}
+
+// TestRedelivered проверяет распознавание повторно доставленных сообщений
+func TestRedelivered(t *testing.T) {
+	tests := []struct {
+		name     string
+		delivery amqp.Delivery
+		expected bool
+	}{
+		{"Fresh message", amqp.Delivery{}, false},
+		{"Returned by broker", amqp.Delivery{Redelivered: true}, true},
+		{"Retry copy", amqp.Delivery{Headers: amqp.Table{headerRetryCount: int32(1)}}, true},
+		{"Parent wait copy", amqp.Delivery{Headers: amqp.Table{headerParentWaitCount: int32(1)}}, true},
+		{"Row order copy", amqp.Delivery{Headers: amqp.Table{headerOrderSeq: int64(42)}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := redelivered(tt.delivery); got != tt.expected {
+				t.Errorf("Expected %t, got %t", tt.expected, got)
+			}
+		})
+	}
+}
+
+// TestRetryUnlimitedAttempts проверяет, что без лимита попыток сообщение повторяется
+// через очереди ожидания с задержкой не больше RetryMaxDelay, а не возвращается в очередь сразу
+func TestRetryUnlimitedAttempts(t *testing.T) {
+	client := &fakePublisher{}
+	cons := &consumer{
+		client:    client,
+		queueName: "white_data",
+		config:    Config{RetryBaseDelay: time.Second, RetryMaxDelay: 4 * time.Second, DeadLetterQueue: "white_data.dlq"},
+		order:     newRowOrder(),
+	}
+
+	if err := cons.declareDelayQueues(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	expected := []string{"white_data.retry.1000", "white_data.retry.2000", "white_data.retry.4000"}
+	if fmt.Sprint(client.declared) != fmt.Sprint(expected) {
+		t.Errorf("Expected delay queues %v, got %v", expected, client.declared)
+	}
+
+	j := job{
+		delivery: amqp.Delivery{Headers: amqp.Table{headerRetryCount: int32(100)}},
+		message:  &domain.Message{Schema: domain.Schema{TableName: "leads"}},
+		key:      "public.leads\x0042",
+		seq:      1,
+	}
+	if got := cons.retry(j, &pq.Error{Code: "40001"}); got != outcomeAck {
+		t.Errorf("Expected message acknowledged after republishing, got %v", got)
+	}
+	if len(client.published) != 1 || client.published[0].routingKey != "white_data.retry.4000" {
+		t.Fatalf("Expected retry through 'white_data.retry.4000', got %+v", client.published)
+	}
+	if got := client.published[0].msg.Headers[headerRetryCount]; got != int32(101) {
+		t.Errorf("Expected retry count 101, got %v", got)
+	}
+}
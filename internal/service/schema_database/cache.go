@@ -0,0 +1,168 @@
+package schema_database
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"crm-lead-service/internal/domain"
+
+	"github.com/lib/pq"
+)
+
+// listenerPingInterval как часто проверяется соединение слушателя LISTEN/NOTIFY
+const listenerPingInterval = 90 * time.Second
+
+// CacheConfig настройки кеша колонок таблиц
+type CacheConfig struct {
+	// Enabled включает кеш: проверка схемы без изменений не обращается к information_schema
+	Enabled bool
+	// TTL время жизни записи, 0 - без ограничения
+	TTL time.Duration
+	// NotifyChannel канал LISTEN/NOTIFY для сброса кеша на всех репликах, пусто - не используется
+	NotifyChannel string
+}
+
+// cachedTable колонки таблицы на момент загрузки
+type cachedTable struct {
+	columns  map[string]domain.ColumnInfo
+	loadedAt time.Time
+}
+
+// schemaCache колонки существующих таблиц по имени таблицы. Методы nil-кеша
+// ничего не делают, поэтому выключенный кеш - это nil
+type schemaCache struct {
+	mu     sync.RWMutex
+	ttl    time.Duration
+	tables map[string]cachedTable
+}
+
+func newSchemaCache(config CacheConfig) *schemaCache {
+	if !config.Enabled {
+		return nil
+	}
+	return &schemaCache{
+		ttl:    config.TTL,
+		tables: make(map[string]cachedTable),
+	}
+}
+
+// get возвращает колонки таблицы. Возвращенный map нельзя изменять
+func (c *schemaCache) get(tableName string) (map[string]domain.ColumnInfo, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	table, ok := c.tables[tableName]
+	if !ok || (c.ttl > 0 && time.Since(table.loadedAt) > c.ttl) {
+		return nil, false
+	}
+	return table.columns, true
+}
+
+func (c *schemaCache) set(tableName string, columns map[string]domain.ColumnInfo) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	c.tables[tableName] = cachedTable{columns: columns, loadedAt: time.Now()}
+	c.mu.Unlock()
+}
+
+func (c *schemaCache) invalidate(tableName string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	delete(c.tables, tableName)
+	c.mu.Unlock()
+}
+
+func (c *schemaCache) clear() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	c.tables = make(map[string]cachedTable)
+	c.mu.Unlock()
+}
+
+// Invalidate сбрасывает кеш колонок таблицы
+func (s *SchemaService) Invalidate(table TableRef) {
+	s.invalidateTable(table.String())
+}
+
+// invalidateTable сбрасывает кеш колонок и последовательностей таблицы
+func (s *SchemaService) invalidateTable(tableName string) {
+	s.cache.invalidate(tableName)
+	s.sequences.invalidate(tableName)
+}
+
+// InvalidateChanged сбрасывает кеш таблиц, измененных в транзакции сервиса (см. WithTx).
+// Вызывается после коммита или отката: пока транзакция не завершена, другие воркеры
+// могли снова загрузить в кеш схему без ее изменений
+func (s *SchemaService) InvalidateChanged() {
+	for tableName := range s.ddlTables {
+		s.invalidateTable(tableName)
+	}
+}
+
+// ListenInvalidations подписывается на канал NotifyChannel и сбрасывает кеш по DDL
+// других реплик. После разрыва соединения кеш очищается целиком: уведомления могли потеряться
+func (s *SchemaService) ListenInvalidations(dsn string) {
+	if s.cache == nil || s.notifyChannel == "" {
+		return
+	}
+
+	s.listener = pq.NewListener(dsn, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("Schema cache listener error: %v", err)
+		}
+	})
+	if err := s.listener.Listen(s.notifyChannel); err != nil {
+		// Канал запомнен слушателем и будет подписан после подключения
+		log.Printf("Error listening to schema notifications: %v", err)
+	}
+
+	go func() {
+		ticker := time.NewTicker(listenerPingInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case notification, ok := <-s.listener.Notify:
+				if !ok {
+					return
+				}
+				// nil приходит после переподключения
+				if notification == nil {
+					s.cache.clear()
+					s.sequences.clear()
+					continue
+				}
+				s.invalidateTable(notification.Extra)
+			case <-ticker.C:
+				if err := s.listener.Ping(); err != nil {
+					log.Printf("Schema cache listener ping failed: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// Close прерывает фоновые сверки таблиц и останавливает слушателя уведомлений
+func (s *SchemaService) Close() error {
+	if s.jobs != nil {
+		s.jobs.close()
+	}
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Close()
+}
@@ -0,0 +1,89 @@
+package schema_database
+
+import (
+	"testing"
+	"time"
+
+	"crm-lead-service/internal/domain"
+)
+
+// TestSchemaCache проверяет хранение, сброс и время жизни записей кеша
+func TestSchemaCache(t *testing.T) {
+	columns := map[string]domain.ColumnInfo{"id": {Name: "id", DbType: "integer"}}
+
+	t.Run("Disabled cache", func(t *testing.T) {
+		cache := newSchemaCache(CacheConfig{})
+		cache.set("leads", columns)
+		if _, ok := cache.get("leads"); ok {
+			t.Error("Expected disabled cache to miss")
+		}
+	})
+
+	t.Run("Invalidate", func(t *testing.T) {
+		cache := newSchemaCache(CacheConfig{Enabled: true})
+		cache.set("leads", columns)
+		cache.set("users", columns)
+
+		if _, ok := cache.get("leads"); !ok {
+			t.Fatal("Expected cached table")
+		}
+
+		cache.invalidate("leads")
+		if _, ok := cache.get("leads"); ok {
+			t.Error("Expected invalidated table to miss")
+		}
+		if _, ok := cache.get("users"); !ok {
+			t.Error("Expected other tables to stay cached")
+		}
+
+		cache.clear()
+		if _, ok := cache.get("users"); ok {
+			t.Error("Expected cleared cache to miss")
+		}
+	})
+
+	t.Run("TTL", func(t *testing.T) {
+		cache := newSchemaCache(CacheConfig{Enabled: true, TTL: time.Minute})
+		cache.tables["leads"] = cachedTable{columns: columns, loadedAt: time.Now().Add(-2 * time.Minute)}
+
+		if _, ok := cache.get("leads"); ok {
+			t.Error("Expected expired table to miss")
+		}
+	})
+}
+
+// TestCompareSchemasFromCache проверяет, что схема из кеша сравнивается без запросов к БД
+func TestCompareSchemasFromCache(t *testing.T) {
+	// db не задан: любой запрос к БД приведет к панике
+	service := &SchemaService{cache: newSchemaCache(CacheConfig{Enabled: true})}
+	service.cache.set("public.leads", map[string]domain.ColumnInfo{
+		"id":    {Name: "id", DbType: "bigint"},
+		"email": {Name: "email", DbType: "character varying", Size: intPtr(255), AllowNull: true},
+	})
+
+	schema := domain.Schema{
+		TableName: "leads",
+		Columns: map[string]domain.ColumnInfo{
+			"id":    {Name: "id", Type: "bigint"},
+			"email": {Name: "email", Type: "string", Size: intPtr(255), AllowNull: true},
+			"phone": {Name: "phone", Type: "string", Size: intPtr(20), AllowNull: true},
+		},
+		PrimaryKey: []string{"id"},
+	}
+
+	exists, err := service.TableExists(TableRef{Schema: "public", Name: "leads"})
+	if err != nil || !exists {
+		t.Fatalf("Expected cached table to exist, got %t, %v", exists, err)
+	}
+
+	diff, err := service.CompareSchemas(schema)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(diff.MissingColumns) != 1 || diff.MissingColumns[0] != "phone" {
+		t.Errorf("Expected missing phone column, got %v", diff.MissingColumns)
+	}
+	if len(diff.TypeChanges) != 0 || len(diff.DefaultChanges) != 0 || len(diff.NullabilityChanges) != 0 {
+		t.Errorf("Expected no column changes, got %+v", diff)
+	}
+}
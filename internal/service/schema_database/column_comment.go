@@ -0,0 +1,47 @@
+package schema_database
+
+import (
+	"fmt"
+
+	"crm-lead-service/internal/domain"
+)
+
+// CommentChange новый комментарий колонки
+type CommentChange struct {
+	Column  string
+	Comment string
+}
+
+// columnComment возвращает комментарий колонки из схемы сообщения, пустая строка - без комментария
+func columnComment(column domain.ColumnInfo) string {
+	if column.Comment == nil {
+		return ""
+	}
+	return *column.Comment
+}
+
+// compareColumnComment возвращает новый комментарий колонки. Если в схеме сообщения
+// комментария нет, комментарий в БД не трогается
+func compareColumnComment(column, dbColumn domain.ColumnInfo) *CommentChange {
+	desired := columnComment(column)
+	if desired == "" || desired == columnComment(dbColumn) {
+		return nil
+	}
+	return &CommentChange{Column: dbColumn.Name, Comment: desired}
+}
+
+// commentQuery возвращает COMMENT ON COLUMN
+func commentQuery(table TableRef, column, comment string) string {
+	return fmt.Sprintf(`COMMENT ON COLUMN %s.%s IS %s`, table.Quoted(), QuoteIdentifier(column), formatDefaultValue(comment))
+}
+
+// AlterColumnComments устанавливает комментарии колонок
+func (s *SchemaService) AlterColumnComments(table TableRef, changes []CommentChange) error {
+	for _, change := range changes {
+		if err := s.execDDL(table, commentQuery(table, change.Column, change.Comment)); err != nil {
+			return fmt.Errorf("failed to comment column %s: %w", change.Column, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,260 @@
+package schema_database
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"crm-lead-service/internal/domain"
+)
+
+// DefaultChange смена значения по умолчанию, пустой To - DROP DEFAULT
+type DefaultChange struct {
+	Column string
+	From   string
+	To     string
+}
+
+// NullabilityChange снятие или установка NOT NULL. Backfill - значение,
+// которым заполняются NULL перед установкой ограничения
+type NullabilityChange struct {
+	Column    string
+	AllowNull bool
+	Backfill  string
+}
+
+// nullableRecheckInterval через сколько снова проверить NULL в колонке, на которую не удалось
+// установить NOT NULL. До этого ужесточение без значения для заполнения не попадает в diff,
+// чтобы каждое сообщение таблицы не брало блокировку и не сканировало колонку
+const nullableRecheckInterval = 10 * time.Minute
+
+// keptNullableColumns колонки, оставленные nullable из-за NULL в них, общий для всех копий сервиса.
+// Методы nil-значения ничего не делают
+type keptNullableColumns struct {
+	mu      sync.Mutex
+	columns map[string]map[string]time.Time
+}
+
+func newKeptNullableColumns() *keptNullableColumns {
+	return &keptNullableColumns{columns: make(map[string]map[string]time.Time)}
+}
+
+// keep запоминает, что NOT NULL на колонку не установлен
+func (k *keptNullableColumns) keep(tableName, column string) {
+	if k == nil {
+		return
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.columns[tableName] == nil {
+		k.columns[tableName] = make(map[string]time.Time)
+	}
+	k.columns[tableName][column] = time.Now()
+}
+
+// kept сообщает, что NOT NULL на колонку недавно не удалось установить
+func (k *keptNullableColumns) kept(tableName, column string) bool {
+	if k == nil {
+		return false
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	keptAt, ok := k.columns[tableName][column]
+	if ok && time.Since(keptAt) > nullableRecheckInterval {
+		delete(k.columns[tableName], column)
+		return false
+	}
+	return ok
+}
+
+// skipNullability сообщает, что ужесточение колонки пропускается: NULL нечем заполнить,
+// а недавняя проверка уже нашла их в колонке
+func (s *SchemaService) skipNullability(table TableRef, change NullabilityChange) bool {
+	return !change.AllowNull && change.Backfill == "" && s.keptNullable.kept(table.String(), change.Column)
+}
+
+// castSuffix приведение типа в конце выражения: 'a'::character varying, '{}'::integer[]
+var castSuffix = regexp.MustCompile(`(?i)::[a-z_ ]+(\[\])*$`)
+
+// columnDefault возвращает значение по умолчанию новой колонки: явное из схемы сообщения,
+// а для NOT NULL без явного значения - значение по типу. Пустая строка - без значения
+func columnDefault(column domain.ColumnInfo, columnType string) string {
+	if defaultValue := formatDefaultValue(column.DefaultValue); defaultValue != "" {
+		return defaultValue
+	}
+	if !column.AllowNull {
+		return typeDefault(columnType)
+	}
+	return ""
+}
+
+// typeDefault возвращает значение по умолчанию по типу, пустая строка - его нет
+func typeDefault(columnType string) string {
+	return strings.TrimPrefix(getDefaultForType(columnType), " DEFAULT ")
+}
+
+// normalizeDefault приводит выражение по умолчанию к виду, в котором его можно сравнить
+// с column_default из information_schema: PostgreSQL добавляет приведения типов и скобки
+func normalizeDefault(expression string) string {
+	expression = strings.TrimSpace(expression)
+	for {
+		trimmed := castSuffix.ReplaceAllString(expression, "")
+		if strings.HasPrefix(trimmed, "(") && strings.HasSuffix(trimmed, ")") {
+			trimmed = trimmed[1 : len(trimmed)-1]
+		}
+		trimmed = strings.TrimSpace(trimmed)
+		if trimmed == expression {
+			break
+		}
+		expression = trimmed
+	}
+
+	// Строки оставляем как есть, остальное сравниваем без учета регистра
+	if strings.HasPrefix(expression, "'") && strings.HasSuffix(expression, "'") && len(expression) >= 2 {
+		// Отрицательные числа PostgreSQL хранит в кавычках: '-1'::integer
+		inner := expression[1 : len(expression)-1]
+		if _, err := strconv.ParseFloat(inner, 64); err == nil {
+			return inner
+		}
+		return expression
+	}
+
+	expression = strings.ToLower(expression)
+	if expression == "now()" {
+		return "current_timestamp"
+	}
+	return expression
+}
+
+// compareColumnConstraints сравнивает NOT NULL и значение по умолчанию колонки в БД
+// с ожидаемыми по схеме сообщения. Сверяется только явное значение по умолчанию: значение
+// по типу, с которым колонка могла быть создана, не добавляется и не удаляется
+func (s *SchemaService) compareColumnConstraints(schema domain.Schema, column, dbColumn domain.ColumnInfo) (*DefaultChange, *NullabilityChange) {
+	desired := formatDefaultValue(column.DefaultValue)
+	current := ""
+	if expression, ok := dbColumn.DefaultValue.(map[string]interface{}); ok {
+		current, _ = expression["expression"].(string)
+	}
+
+	// Колонки первичного ключа всегда NOT NULL, а их значения приходят в сообщении
+	if isKeyColumn(schema, dbColumn.Name) {
+		return nil, nil
+	}
+
+	var defaultChange *DefaultChange
+	// Значения из последовательностей (serial, identity) не трогаем
+	if !strings.HasPrefix(strings.ToLower(current), "nextval(") &&
+		normalizeDefault(current) != normalizeDefault(desired) &&
+		(desired != "" || !s.isTypeDefault(column, current)) {
+		defaultChange = &DefaultChange{Column: dbColumn.Name, From: current, To: desired}
+	}
+
+	var nullabilityChange *NullabilityChange
+	if column.AllowNull != dbColumn.AllowNull {
+		nullabilityChange = &NullabilityChange{
+			Column:    dbColumn.Name,
+			AllowNull: column.AllowNull,
+			Backfill:  desired,
+		}
+	}
+
+	return defaultChange, nullabilityChange
+}
+
+// isTypeDefault сообщает, что значение по умолчанию колонки в БД - значение по типу,
+// которое сервис дает новым NOT NULL колонкам без явного значения. Значения по типу
+// прежних версий (legacyDefaultForType, legacyType) тоже не удаляются после обновления
+func (s *SchemaService) isTypeDefault(column domain.ColumnInfo, current string) bool {
+	columnType := s.mapTypeToPostgres(column)
+	for _, fallback := range []string{
+		getDefaultForType(columnType),
+		legacyDefaultForType(columnType),
+		legacyDefaultForType(legacyType(column)),
+	} {
+		fallback = strings.TrimPrefix(fallback, " DEFAULT ")
+		if fallback != "" && normalizeDefault(current) == normalizeDefault(fallback) {
+			return true
+		}
+	}
+	return false
+}
+
+// AlterColumnDefaults устанавливает или удаляет значения по умолчанию
+func (s *SchemaService) AlterColumnDefaults(table TableRef, changes []DefaultChange) error {
+	for _, change := range changes {
+		query := fmt.Sprintf(`ALTER TABLE %s ALTER COLUMN %s DROP DEFAULT`, table.Quoted(), QuoteIdentifier(change.Column))
+		if change.To != "" {
+			query = fmt.Sprintf(`ALTER TABLE %s ALTER COLUMN %s SET DEFAULT %s`,
+				table.Quoted(), QuoteIdentifier(change.Column), change.To)
+		}
+
+		if err := s.execDDL(table, query); err != nil {
+			return fmt.Errorf("failed to change default of column %s: %w", change.Column, err)
+		}
+	}
+
+	return nil
+}
+
+// AlterColumnNullability снимает или устанавливает NOT NULL. Перед установкой
+// существующие NULL заполняются значением по умолчанию; если его нет, а NULL в колонке есть,
+// ограничение не устанавливается и колонка остается nullable до следующей проверки (см. skipNullability)
+func (s *SchemaService) AlterColumnNullability(table TableRef, changes []NullabilityChange) error {
+	for _, change := range changes {
+		if change.AllowNull {
+			query := fmt.Sprintf(`ALTER TABLE %s ALTER COLUMN %s DROP NOT NULL`, table.Quoted(), QuoteIdentifier(change.Column))
+			if err := s.execDDL(table, query); err != nil {
+				return fmt.Errorf("failed to drop not null on column %s: %w", change.Column, err)
+			}
+			continue
+		}
+
+		if change.Backfill != "" {
+			query := fmt.Sprintf(`UPDATE %s SET %s = %s WHERE %s IS NULL`,
+				table.Quoted(), QuoteIdentifier(change.Column), change.Backfill, QuoteIdentifier(change.Column))
+			if s.planning() {
+				*s.plan = append(*s.plan, query)
+			} else if _, err := s.db.Exec(query); err != nil {
+				return fmt.Errorf("failed to backfill nulls in column %s: %w", change.Column, err)
+			}
+		} else if !s.planning() {
+			// В плане колонки может еще не быть, NULL проверяются при применении
+			var hasNulls bool
+			query := fmt.Sprintf(`SELECT EXISTS (SELECT 1 FROM %s WHERE %s IS NULL)`, table.Quoted(), QuoteIdentifier(change.Column))
+			if err := s.db.QueryRow(query).Scan(&hasNulls); err != nil {
+				return fmt.Errorf("failed to check nulls in column %s: %w", change.Column, err)
+			}
+			if hasNulls {
+				s.keptNullable.keep(table.String(), change.Column)
+				log.Printf("Column %s.%s is kept nullable: it contains NULL values and has no default to backfill them",
+					table, change.Column)
+				continue
+			}
+		}
+
+		query := fmt.Sprintf(`ALTER TABLE %s ALTER COLUMN %s SET NOT NULL`, table.Quoted(), QuoteIdentifier(change.Column))
+		if err := s.execDDL(table, query); err != nil {
+			return fmt.Errorf("failed to set not null on column %s: %w", change.Column, err)
+		}
+	}
+
+	return nil
+}
+
+// isKeyColumn сообщает, входит ли колонка в первичный ключ схемы
+func isKeyColumn(schema domain.Schema, columnName string) bool {
+	for _, pk := range schema.PrimaryKey {
+		if pk == columnName {
+			return true
+		}
+	}
+	return false
+}
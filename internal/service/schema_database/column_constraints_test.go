@@ -0,0 +1,161 @@
+package schema_database
+
+import (
+	"testing"
+
+	"crm-lead-service/internal/domain"
+)
+
+// TestNormalizeDefault проверяет сравнение значений по умолчанию с column_default
+func TestNormalizeDefault(t *testing.T) {
+	tests := []struct {
+		current string
+		desired string
+	}{
+		{"'new'::character varying", "'new'"},
+		{"0", "0"},
+		{"'-1'::integer", "-1"},
+		{"(0)::numeric", "0"},
+		{"false", "false"},
+		{"now()", "CURRENT_TIMESTAMP"},
+		{"'{}'::integer[]", "'{}'"},
+		// Значение по типу в том виде, в каком PostgreSQL возвращает его в column_default
+		{"'00:00:00'::interval", typeDefault("INTERVAL")},
+		{"'{}'::jsonb", typeDefault("JSONB")},
+		{"CURRENT_DATE", typeDefault("DATE")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.current, func(t *testing.T) {
+			if got, expected := normalizeDefault(tt.current), normalizeDefault(tt.desired); got != expected {
+				t.Errorf("Expected %q and %q to be equal, got %q and %q", tt.current, tt.desired, got, expected)
+			}
+		})
+	}
+
+	if normalizeDefault("'New'::character varying") == normalizeDefault("'new'") {
+		t.Error("Expected string defaults to be case sensitive")
+	}
+}
+
+// TestCompareColumnConstraints проверяет обнаружение изменений NOT NULL и значений по умолчанию
+func TestCompareColumnConstraints(t *testing.T) {
+	service := &SchemaService{}
+	schema := domain.Schema{TableName: "leads", PrimaryKey: []string{"id"}}
+	dbDefault := func(expression string) interface{} {
+		return map[string]interface{}{"expression": expression}
+	}
+
+	t.Run("No changes", func(t *testing.T) {
+		column := domain.ColumnInfo{Name: "status", Type: "string", Size: intPtr(20), DefaultValue: "new"}
+		dbColumn := domain.ColumnInfo{Name: "status", AllowNull: false, DefaultValue: dbDefault("'new'::character varying")}
+
+		defaultChange, nullabilityChange := service.compareColumnConstraints(schema, column, dbColumn)
+		if defaultChange != nil || nullabilityChange != nil {
+			t.Errorf("Expected no changes, got %+v and %+v", defaultChange, nullabilityChange)
+		}
+	})
+
+	t.Run("Default dropped and column relaxed", func(t *testing.T) {
+		column := domain.ColumnInfo{Name: "status", Type: "string", AllowNull: true}
+		dbColumn := domain.ColumnInfo{Name: "status", AllowNull: false, DefaultValue: dbDefault("'new'::character varying")}
+
+		defaultChange, nullabilityChange := service.compareColumnConstraints(schema, column, dbColumn)
+		if defaultChange == nil || defaultChange.To != "" {
+			t.Errorf("Expected DROP DEFAULT, got %+v", defaultChange)
+		}
+		if nullabilityChange == nil || !nullabilityChange.AllowNull {
+			t.Errorf("Expected DROP NOT NULL, got %+v", nullabilityChange)
+		}
+	})
+
+	t.Run("Column tightened with backfill", func(t *testing.T) {
+		column := domain.ColumnInfo{Name: "amount", Type: "integer", DefaultValue: 5}
+		dbColumn := domain.ColumnInfo{Name: "amount", AllowNull: true}
+
+		defaultChange, nullabilityChange := service.compareColumnConstraints(schema, column, dbColumn)
+		if defaultChange == nil || defaultChange.To != "5" {
+			t.Errorf("Expected SET DEFAULT 5, got %+v", defaultChange)
+		}
+		if nullabilityChange == nil || nullabilityChange.AllowNull || nullabilityChange.Backfill != "5" {
+			t.Errorf("Expected SET NOT NULL with backfill 5, got %+v", nullabilityChange)
+		}
+	})
+
+	t.Run("Type default is not reconciled", func(t *testing.T) {
+		column := domain.ColumnInfo{Name: "amount", Type: "integer"}
+		for _, dbColumn := range []domain.ColumnInfo{
+			{Name: "amount", AllowNull: false},
+			{Name: "amount", AllowNull: false, DefaultValue: dbDefault("0")},
+		} {
+			defaultChange, nullabilityChange := service.compareColumnConstraints(schema, column, dbColumn)
+			if defaultChange != nil || nullabilityChange != nil {
+				t.Errorf("Expected no changes for default %v, got %+v and %+v", dbColumn.DefaultValue, defaultChange, nullabilityChange)
+			}
+		}
+	})
+
+	t.Run("Legacy type default is kept", func(t *testing.T) {
+		column := domain.ColumnInfo{Name: "code", Type: "citext", DbType: "citext"}
+		dbColumn := domain.ColumnInfo{Name: "code", AllowNull: false, DefaultValue: dbDefault("''::citext")}
+
+		defaultChange, _ := service.compareColumnConstraints(schema, column, dbColumn)
+		if defaultChange != nil {
+			t.Errorf("Expected legacy type default to be kept, got %+v", defaultChange)
+		}
+	})
+
+	t.Run("Column tightened without default", func(t *testing.T) {
+		column := domain.ColumnInfo{Name: "amount", Type: "integer"}
+		dbColumn := domain.ColumnInfo{Name: "amount", AllowNull: true}
+
+		defaultChange, nullabilityChange := service.compareColumnConstraints(schema, column, dbColumn)
+		if defaultChange != nil {
+			t.Errorf("Expected no default change, got %+v", defaultChange)
+		}
+		if nullabilityChange == nil || nullabilityChange.AllowNull || nullabilityChange.Backfill != "" {
+			t.Errorf("Expected SET NOT NULL without backfill, got %+v", nullabilityChange)
+		}
+	})
+
+	t.Run("Primary key and sequence are skipped", func(t *testing.T) {
+		column := domain.ColumnInfo{Name: "id", Type: "integer", AllowNull: true}
+		dbColumn := domain.ColumnInfo{Name: "id", AllowNull: false, DefaultValue: dbDefault("nextval('leads_id_seq'::regclass)")}
+
+		defaultChange, nullabilityChange := service.compareColumnConstraints(schema, column, dbColumn)
+		if defaultChange != nil || nullabilityChange != nil {
+			t.Errorf("Expected no changes, got %+v and %+v", defaultChange, nullabilityChange)
+		}
+	})
+}
+
+// TestColumnDefault проверяет значение по умолчанию для новых NOT NULL колонок
+func TestColumnDefault(t *testing.T) {
+	tests := []struct {
+		name       string
+		column     domain.ColumnInfo
+		columnType string
+		expected   string
+	}{
+		{"Explicit default", domain.ColumnInfo{DefaultValue: "new"}, "VARCHAR(20)", "'new'"},
+		{"Expression default", domain.ColumnInfo{DefaultValue: map[string]interface{}{"expression": "CURRENT_TIMESTAMP"}}, "TIMESTAMPTZ", "CURRENT_TIMESTAMP"},
+		{"Integer fallback", domain.ColumnInfo{}, "BIGINT", "0"},
+		{"Interval fallback", domain.ColumnInfo{}, "INTERVAL", "'00:00:00'"},
+		{"Character varying fallback", domain.ColumnInfo{}, "CHARACTER VARYING(20)", "''"},
+		{"Point is not an integer", domain.ColumnInfo{}, "POINT", ""},
+		{"Range is not an integer", domain.ColumnInfo{}, "INT4RANGE", ""},
+		{"Array fallback", domain.ColumnInfo{}, "INTEGER[]", "'{}'"},
+		{"Date fallback", domain.ColumnInfo{}, "DATE", "CURRENT_DATE"},
+		{"Jsonb fallback", domain.ColumnInfo{}, "JSONB", "'{}'"},
+		{"Unknown type", domain.ColumnInfo{}, "UUID", ""},
+		{"Nullable column", domain.ColumnInfo{AllowNull: true}, "BIGINT", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := columnDefault(tt.column, tt.columnType); got != tt.expected {
+				t.Errorf("Expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
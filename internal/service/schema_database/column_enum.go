@@ -0,0 +1,134 @@
+package schema_database
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"crm-lead-service/internal/domain"
+)
+
+// EnumChange расширение списка допустимых значений колонки
+type EnumChange struct {
+	Column string
+	Values []string
+}
+
+// enumLiteral строковый литерал в определении CHECK-ограничения
+var enumLiteral = regexp.MustCompile(`'((?:[^']|'')*)'`)
+
+// enumConstraintName имя CHECK-ограничения со списком значений колонки
+func enumConstraintName(column string) string {
+	return shortIdentifier(column + "_enum")
+}
+
+// legacyEnumConstraintName имя, которое ограничению давали прежние версии: длинное имя
+// просто обрезалось. Отличается от enumConstraintName только у колонок длиннее 58 байт
+func legacyEnumConstraintName(column string) string {
+	name := column + "_enum"
+	if len(name) > maxIdentifierLength {
+		name = name[:maxIdentifierLength]
+	}
+	return name
+}
+
+// columnEnumConstraint возвращает имя существующего ограничения значений колонки
+// среди ограничений таблицы (см. getEnumValues)
+func columnEnumConstraint(constraints map[string][]string, column string) (string, bool) {
+	for _, name := range []string{enumConstraintName(column), legacyEnumConstraintName(column)} {
+		if _, exists := constraints[name]; exists {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// enumCheck возвращает определение CHECK-ограничения для значений колонки
+func enumCheck(column string, values []string) string {
+	quoted := make([]string, len(values))
+	for i, value := range values {
+		quoted[i] = formatDefaultValue(value)
+	}
+	return fmt.Sprintf(`CONSTRAINT %s CHECK (%s IN (%s))`,
+		QuoteIdentifier(enumConstraintName(column)), QuoteIdentifier(column), strings.Join(quoted, ", "))
+}
+
+// parseEnumCheck извлекает значения из определения ограничения (pg_get_constraintdef)
+func parseEnumCheck(definition string) []string {
+	var values []string
+	for _, match := range enumLiteral.FindAllStringSubmatch(definition, -1) {
+		values = append(values, strings.ReplaceAll(match[1], "''", "'"))
+	}
+	return values
+}
+
+// getEnumValues читает значения CHECK-ограничений колонок таблицы: имя колонки -> значения
+func (s *SchemaService) getEnumValues(table TableRef) (map[string][]string, error) {
+	query := `
+		SELECT conname, pg_get_constraintdef(oid)
+		FROM pg_constraint
+		WHERE conrelid = (quote_ident($1) || '.' || quote_ident($2))::regclass AND contype = 'c'
+	`
+
+	rows, err := s.db.Query(query, table.Schema, table.Name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query check constraints: %w", err)
+	}
+	defer rows.Close()
+
+	constraints := make(map[string][]string)
+	for rows.Next() {
+		var name, definition string
+		if err := rows.Scan(&name, &definition); err != nil {
+			return nil, fmt.Errorf("failed to scan check constraint: %w", err)
+		}
+		constraints[name] = parseEnumCheck(definition)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows iteration error: %w", err)
+	}
+
+	return constraints, nil
+}
+
+// compareEnumValues возвращает расширение списка значений, если в схеме сообщения есть значения,
+// которых нет в ограничении колонки. Значения не удаляются: в таблице могут остаться строки с ними
+func compareEnumValues(column, dbColumn domain.ColumnInfo) *EnumChange {
+	if len(column.EnumValues) == 0 {
+		return nil
+	}
+
+	values := append([]string(nil), dbColumn.EnumValues...)
+	changed := len(values) == 0
+	for _, value := range column.EnumValues {
+		if !slices.Contains(values, value) {
+			values = append(values, value)
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	return &EnumChange{Column: dbColumn.Name, Values: values}
+}
+
+// AlterColumnEnums заменяет ограничения значений колонок. Новое ограничение создается
+// NOT VALID: существующие строки не проверяются, таблица не сканируется
+func (s *SchemaService) AlterColumnEnums(table TableRef, changes []EnumChange) error {
+	for _, change := range changes {
+		drop := fmt.Sprintf(`DROP CONSTRAINT IF EXISTS %s`, QuoteIdentifier(enumConstraintName(change.Column)))
+		if legacy := legacyEnumConstraintName(change.Column); legacy != enumConstraintName(change.Column) {
+			drop += fmt.Sprintf(`, DROP CONSTRAINT IF EXISTS %s`, QuoteIdentifier(legacy))
+		}
+		query := fmt.Sprintf(`ALTER TABLE %s %s, ADD %s NOT VALID`,
+			table.Quoted(), drop, enumCheck(change.Column, change.Values))
+		if err := s.execDDL(table, query); err != nil {
+			return fmt.Errorf("failed to change values of column %s: %w", change.Column, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,82 @@
+package schema_database
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"crm-lead-service/internal/domain"
+)
+
+// TestParseEnumCheck проверяет разбор значений из определения CHECK-ограничения
+func TestParseEnumCheck(t *testing.T) {
+	definition := `CHECK (((status)::text = ANY ((ARRAY['new'::character varying, 'in progress'::character varying, 'won''t'::character varying])::text[])))`
+	expected := []string{"new", "in progress", "won't"}
+
+	if got := parseEnumCheck(definition); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+
+	check := enumCheck("status", []string{"new", "won't"})
+	if got := parseEnumCheck(check); !reflect.DeepEqual(got, []string{"new", "won't"}) {
+		t.Errorf("Expected values to survive quoting, got %q", got)
+	}
+}
+
+// TestEnumConstraintName проверяет, что длинное имя ограничения обрезается по границе символа,
+// а разные длинные колонки получают разные ограничения
+func TestEnumConstraintName(t *testing.T) {
+	if got := enumConstraintName("status"); got != "status_enum" {
+		t.Errorf("Expected status_enum, got %s", got)
+	}
+
+	// Кириллица занимает два байта: обрезка по байтам разрезала бы букву
+	multibyte := enumConstraintName("a" + strings.Repeat("я", 31))
+	if len(multibyte) > maxIdentifierLength || !utf8.ValidString(multibyte) {
+		t.Errorf("Expected valid name of at most %d bytes, got %q (%d bytes)", maxIdentifierLength, multibyte, len(multibyte))
+	}
+
+	// Обрезанное "<колонка>_enum" совпало бы с именем для колонки "<колонка>_"
+	first := enumConstraintName(strings.Repeat("a", 62))
+	second := enumConstraintName(strings.Repeat("a", 62) + "_")
+	if first == second {
+		t.Errorf("Expected different long columns to get different constraints, got %s", first)
+	}
+
+	// Ограничение, созданное прежней версией, находится по старому имени
+	long := strings.Repeat("a", 60)
+	constraints := map[string][]string{legacyEnumConstraintName(long): {"new"}}
+	if name, exists := columnEnumConstraint(constraints, long); !exists || name != long+"_en" {
+		t.Errorf("Expected legacy constraint %s_en, got %q", long, name)
+	}
+}
+
+// TestCompareEnumValues проверяет, что список значений только расширяется
+func TestCompareEnumValues(t *testing.T) {
+	dbColumn := domain.ColumnInfo{Name: "status", EnumValues: []string{"new", "won"}}
+
+	tests := []struct {
+		name     string
+		values   []string
+		current  []string
+		expected *EnumChange
+	}{
+		{"Same values", []string{"won", "new"}, dbColumn.EnumValues, nil},
+		{"Value removed", []string{"new"}, dbColumn.EnumValues, nil},
+		{"Value added", []string{"new", "lost"}, dbColumn.EnumValues,
+			&EnumChange{Column: "status", Values: []string{"new", "won", "lost"}}},
+		{"No constraint", []string{"new"}, nil, &EnumChange{Column: "status", Values: []string{"new"}}},
+		{"Not an enum", nil, dbColumn.EnumValues, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			current := domain.ColumnInfo{Name: "status", EnumValues: tt.current}
+			got := compareEnumValues(domain.ColumnInfo{EnumValues: tt.values}, current)
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("Expected %+v, got %+v", tt.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,198 @@
+package schema_database
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"crm-lead-service/internal/domain"
+
+	"github.com/lib/pq"
+)
+
+// columnMapping правило преобразования абстрактного типа Yii в тип PostgreSQL
+type columnMapping struct {
+	// pgType тип по умолчанию
+	pgType string
+	// sized тип с длиной из Size: VARCHAR(255)
+	sized string
+	// unsigned более широкий тип для беззнаковых значений
+	unsigned string
+	// native типы dbType, которые сохраняются как есть: колонка пришла из PostgreSQL
+	native []string
+}
+
+// columnTypes типы PostgreSQL для абстрактных типов Yii (ColumnInfo.Type)
+var columnTypes = map[string]columnMapping{
+	"tinyint":   {pgType: "SMALLINT"},
+	"smallint":  {pgType: "SMALLINT", unsigned: "INTEGER"},
+	"integer":   {pgType: "INTEGER", unsigned: "BIGINT"},
+	"bigint":    {pgType: "BIGINT", unsigned: "NUMERIC(20,0)"},
+	"float":     {pgType: "DOUBLE PRECISION", native: []string{"float4", "real"}},
+	"double":    {pgType: "DOUBLE PRECISION"},
+	"decimal":   {pgType: "NUMERIC"},
+	"money":     {pgType: "NUMERIC(19,4)", native: []string{"money"}},
+	"char":      {pgType: "CHAR", sized: "CHAR"},
+	"string":    {pgType: "TEXT", sized: "VARCHAR"},
+	"text":      {pgType: "TEXT"},
+	"boolean":   {pgType: "BOOLEAN"},
+	"date":      {pgType: "DATE"},
+	"time":      {pgType: "TIME", native: []string{"timetz"}},
+	"datetime":  {pgType: "TIMESTAMP"},
+	"timestamp": {pgType: "TIMESTAMPTZ"},
+	"binary":    {pgType: "BYTEA"},
+	"json":      {pgType: "JSONB", native: []string{"json", "jsonb"}},
+}
+
+// mapTypeToPostgres преобразует тип из схемы в тип PostgreSQL. Колонка с Dimension
+// становится массивом; при DisableArraySupport значения приходят строкой-литералом
+// массива PostgreSQL, тип колонки от этого не меняется
+func (s *SchemaService) mapTypeToPostgres(column domain.ColumnInfo) string {
+	columnType := scalarType(column)
+	if column.Dimension > 0 && !strings.HasSuffix(columnType, "[]") {
+		columnType += "[]"
+	}
+	return columnType
+}
+
+// scalarType возвращает тип PostgreSQL колонки без учета массива
+func scalarType(column domain.ColumnInfo) string {
+	if rawDbType(column) {
+		return strings.ToUpper(column.DbType)
+	}
+
+	mapping, known := columnTypes[column.Type]
+	if !known {
+		return "TEXT"
+	}
+
+	switch {
+	// Автоинкрементный ключ остается целым, иначе его нельзя сделать identity
+	case column.Unsigned && mapping.unsigned != "" && !column.AutoIncrement:
+		return mapping.unsigned
+	case mapping.sized != "" && column.Size != nil && *column.Size > 0:
+		return fmt.Sprintf("%s(%d)", mapping.sized, *column.Size)
+	case column.Type == "decimal" && column.Precision != nil:
+		scale := 0
+		if column.Scale != nil {
+			scale = *column.Scale
+		}
+		return fmt.Sprintf("NUMERIC(%d,%d)", *column.Precision, scale)
+	}
+
+	return mapping.pgType
+}
+
+// legacyType возвращает тип, который колонке давали версии сервиса до полного сопоставления
+// типов Yii: unsigned не учитывался, а типы кроме перечисленных брались из dbType как есть
+func legacyType(column domain.ColumnInfo) string {
+	var columnType string
+	switch column.Type {
+	case "bigint", "integer", "smallint":
+		columnType = strings.ToUpper(column.Type)
+	case "string":
+		columnType = "TEXT"
+		if column.Size != nil {
+			columnType = fmt.Sprintf("VARCHAR(%d)", *column.Size)
+		}
+	case "text":
+		columnType = "TEXT"
+	case "boolean":
+		columnType = "BOOLEAN"
+	case "date":
+		columnType = "DATE"
+	case "timestamp":
+		columnType = "TIMESTAMPTZ"
+	case "double":
+		columnType = "DOUBLE PRECISION"
+	default:
+		columnType = "TEXT"
+		if column.DbType != "" {
+			columnType = strings.ToUpper(column.DbType)
+		}
+	}
+	if column.Dimension > 0 && !strings.HasSuffix(columnType, "[]") {
+		columnType += "[]"
+	}
+	return columnType
+}
+
+// rawDbType сообщает, что тип колонки берется из dbType как есть: абстрактный тип
+// неизвестен или dbType - родной тип PostgreSQL того же вида
+func rawDbType(column domain.ColumnInfo) bool {
+	if column.DbType == "" {
+		return false
+	}
+	mapping, known := columnTypes[column.Type]
+	return !known || slices.Contains(mapping.native, nativeTypeName(column.DbType))
+}
+
+// rawTypes типы PostgreSQL, которые можно взять из dbType как есть, помимо известных typeAliases
+var rawTypes = map[string]bool{
+	"inet": true, "cidr": true, "macaddr": true, "citext": true, "xml": true, "hstore": true,
+	"tsvector": true, "tsquery": true, "bit": true, "bit varying": true, "varbit": true,
+	"point": true, "line": true, "lseg": true, "box": true, "path": true, "polygon": true, "circle": true,
+	"int4range": true, "int8range": true, "numrange": true, "tsrange": true, "tstzrange": true, "daterange": true,
+}
+
+// rawTypePattern dbType: имя типа, необязательный модификатор (n) или (n,m), который может стоять
+// внутри имени ("timestamp(0) with time zone"), и размерность массива
+var rawTypePattern = regexp.MustCompile(`^([a-z][a-z0-9_ ]*?)(?: *\( *[0-9]+ *(?:, *[0-9]+ *)?\) *([a-z ]*?))? *(?:\[\])*$`)
+
+// knownRawType сообщает, что dbType - известный тип PostgreSQL и его можно подставить в DDL
+// как есть. Лишние слова ("integer PRIMARY KEY", "int REFERENCES users") делают тип неизвестным
+func knownRawType(dbType string) bool {
+	match := rawTypePattern.FindStringSubmatch(strings.ToLower(strings.TrimSpace(dbType)))
+	if match == nil {
+		return false
+	}
+	name := strings.Join(strings.Fields(match[1]+" "+match[2]), " ")
+	_, aliased := typeAliases[name]
+	return aliased || rawTypes[name]
+}
+
+// nativeTypeName возвращает имя dbType без модификаторов: "int(10) unsigned" -> "int"
+func nativeTypeName(dbType string) string {
+	name := strings.ToLower(strings.TrimSpace(dbType))
+	if open := strings.IndexAny(name, "( "); open >= 0 {
+		name = name[:open]
+	}
+	return strings.TrimSuffix(name, "[]")
+}
+
+// EncodeValue приводит значение из сообщения к виду, который принимает драйвер:
+// объекты и массивы JSON-колонок сериализуются в JSON, массивы колонок с Dimension -
+// в литерал массива PostgreSQL. Строки (DisableJSONSupport, DisableArraySupport)
+// передаются как есть, PostgreSQL разберет их сам
+func EncodeValue(column domain.ColumnInfo, value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		// ArrayExpression из Yii: значения массива лежат в поле value
+		if inner, ok := v["value"]; ok && column.Dimension > 0 && column.DeserializeArrayColumnToArrayExpression {
+			return EncodeValue(column, inner)
+		}
+		return encodeJSON(value)
+	case []interface{}:
+		if column.Dimension > 0 {
+			literal, err := pq.GenericArray{A: v}.Value()
+			if err != nil {
+				return encodeJSON(value)
+			}
+			return literal
+		}
+		return encodeJSON(value)
+	default:
+		return value
+	}
+}
+
+// encodeJSON сериализует значение в JSON, при ошибке возвращает его без изменений
+func encodeJSON(value interface{}) interface{} {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return value
+	}
+	return string(data)
+}
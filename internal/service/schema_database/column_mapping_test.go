@@ -0,0 +1,77 @@
+package schema_database
+
+import (
+	"testing"
+
+	"crm-lead-service/internal/domain"
+)
+
+// TestMapTypeToPostgres проверяет преобразование типов Yii в типы PostgreSQL
+func TestMapTypeToPostgres(t *testing.T) {
+	service := &SchemaService{}
+
+	tests := []struct {
+		name     string
+		column   domain.ColumnInfo
+		expected string
+	}{
+		{"String with size", domain.ColumnInfo{Type: "string", Size: intPtr(255)}, "VARCHAR(255)"},
+		{"String without size", domain.ColumnInfo{Type: "string"}, "TEXT"},
+		{"Char", domain.ColumnInfo{Type: "char", Size: intPtr(2)}, "CHAR(2)"},
+		{"Tinyint", domain.ColumnInfo{Type: "tinyint", DbType: "tinyint(1)"}, "SMALLINT"},
+		{"Unsigned smallint", domain.ColumnInfo{Type: "smallint", Unsigned: true}, "INTEGER"},
+		{"Unsigned integer", domain.ColumnInfo{Type: "integer", DbType: "int(10) unsigned", Unsigned: true}, "BIGINT"},
+		{"Unsigned bigint", domain.ColumnInfo{Type: "bigint", Unsigned: true}, "NUMERIC(20,0)"},
+		{"Unsigned auto increment", domain.ColumnInfo{Type: "bigint", Unsigned: true, AutoIncrement: true}, "BIGINT"},
+		{"Decimal", domain.ColumnInfo{Type: "decimal", Precision: intPtr(10), Scale: intPtr(2)}, "NUMERIC(10,2)"},
+		{"Decimal without precision", domain.ColumnInfo{Type: "decimal"}, "NUMERIC"},
+		{"Float", domain.ColumnInfo{Type: "float", DbType: "float"}, "DOUBLE PRECISION"},
+		{"Float4 from PostgreSQL", domain.ColumnInfo{Type: "float", DbType: "float4"}, "FLOAT4"},
+		{"Datetime", domain.ColumnInfo{Type: "datetime", DbType: "datetime"}, "TIMESTAMP"},
+		{"Timestamp", domain.ColumnInfo{Type: "timestamp"}, "TIMESTAMPTZ"},
+		{"Binary", domain.ColumnInfo{Type: "binary", DbType: "blob"}, "BYTEA"},
+		{"JSON from MySQL", domain.ColumnInfo{Type: "json", DbType: "json"}, "JSON"},
+		{"JSON by default", domain.ColumnInfo{Type: "json"}, "JSONB"},
+		{"Array", domain.ColumnInfo{Type: "integer", DbType: "int4", Dimension: 1}, "INTEGER[]"},
+		{"Array without support", domain.ColumnInfo{Type: "string", DbType: "text", Dimension: 1, DisableArraySupport: true}, "TEXT[]"},
+		{"Unknown type", domain.ColumnInfo{Type: "geometry", DbType: "geometry"}, "GEOMETRY"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := service.mapTypeToPostgres(tt.column); got != tt.expected {
+				t.Errorf("Expected %s, got %s", tt.expected, got)
+			}
+		})
+	}
+}
+
+// TestEncodeValue проверяет приведение JSON-объектов и массивов к значениям драйвера
+func TestEncodeValue(t *testing.T) {
+	array := domain.ColumnInfo{Type: "string", Dimension: 1}
+	jsonColumn := domain.ColumnInfo{Type: "json"}
+
+	tests := []struct {
+		name     string
+		column   domain.ColumnInfo
+		value    interface{}
+		expected interface{}
+	}{
+		{"JSON object", jsonColumn, map[string]interface{}{"a": 1.0}, `{"a":1}`},
+		{"JSON array", jsonColumn, []interface{}{1.0, "b"}, `[1,"b"]`},
+		{"JSON string", domain.ColumnInfo{Type: "json", DisableJSONSupport: true}, `{"a":1}`, `{"a":1}`},
+		{"Array", array, []interface{}{"a", "b,c"}, `{"a","b,c"}`},
+		{"Array literal", domain.ColumnInfo{Type: "string", Dimension: 1, DisableArraySupport: true}, "{a,b}", "{a,b}"},
+		{"Array expression", domain.ColumnInfo{Type: "string", Dimension: 1, DeserializeArrayColumnToArrayExpression: true},
+			map[string]interface{}{"value": []interface{}{"a"}}, `{"a"}`},
+		{"Scalar", domain.ColumnInfo{Type: "integer"}, 1.0, 1.0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := EncodeValue(tt.column, tt.value); got != tt.expected {
+				t.Errorf("Expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,273 @@
+package schema_database
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"crm-lead-service/internal/domain"
+)
+
+type DroppedColumnPolicy string
+
+const (
+	// DroppedColumnIgnore колонка, пропавшая из схемы сообщения, остается как есть
+	DroppedColumnIgnore DroppedColumnPolicy = "ignore"
+	// DroppedColumnDeprecate колонка помечается устаревшей в комментарии и становится nullable
+	DroppedColumnDeprecate DroppedColumnPolicy = "deprecate"
+	// DroppedColumnDrop колонка помечается устаревшей и удаляется по истечении GracePeriod
+	DroppedColumnDrop DroppedColumnPolicy = "drop"
+)
+
+// deprecatedMarker префикс комментария устаревшей колонки, за ним время пометки в RFC3339
+const deprecatedMarker = "sdr:deprecated since "
+
+// ColumnPolicyConfig настройки обработки удаленных и переименованных колонок
+type ColumnPolicyConfig struct {
+	// Dropped что делать с колонкой, которой больше нет в схеме сообщения
+	Dropped DroppedColumnPolicy
+	// GracePeriod сколько колонка остается помеченной перед удалением (для DroppedColumnDrop)
+	GracePeriod time.Duration
+	// MissingMessages в скольких сообщениях подряд колонки не должно быть, прежде чем применить
+	// политику. Одно сообщение со старой схемой (другой источник, отставший продюсер)
+	// не должно помечать живую колонку. 0 или 1 - достаточно одного сообщения
+	MissingMessages int
+	// Renames переименования по таблицам: таблица -> новое имя -> старое имя
+	Renames map[string]map[string]string
+}
+
+// ColumnRename переименование колонки
+type ColumnRename struct {
+	From string
+	To   string
+	// Enum у колонки есть ограничение значений, оно переименовывается вместе с ней
+	Enum bool
+}
+
+// DroppedColumn колонка таблицы, которой нет в схеме сообщения
+type DroppedColumn struct {
+	Name      string
+	AllowNull bool
+	// DeprecatedAt время пометки, нулевое - колонка еще не помечена
+	DeprecatedAt time.Time
+}
+
+// columnSightings в каком по счету сообщении таблицы колонка встречалась последний раз.
+// Учитываются только записанные свежие сообщения (см. ObserveSchema), хранится в памяти процесса
+type columnSightings struct {
+	mu     sync.Mutex
+	tables map[string]*tableSightings
+}
+
+type tableSightings struct {
+	// messages число учтенных сообщений таблицы
+	messages int
+	// seen колонка -> номер последнего сообщения с ней
+	seen map[string]int
+}
+
+func newColumnSightings() *columnSightings {
+	return &columnSightings{tables: make(map[string]*tableSightings)}
+}
+
+// observe учитывает колонки сообщения таблицы
+func (c *columnSightings) observe(table string, columns map[string]domain.ColumnInfo) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	sightings, ok := c.tables[table]
+	if !ok {
+		sightings = &tableSightings{seen: make(map[string]int)}
+		c.tables[table] = sightings
+	}
+	sightings.messages++
+	for columnName := range columns {
+		sightings.seen[columnName] = sightings.messages
+	}
+}
+
+// missingFor возвращает, в скольких последних учтенных сообщениях таблицы не было колонки
+func (c *columnSightings) missingFor(table, column string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	sightings, ok := c.tables[table]
+	if !ok {
+		return 0
+	}
+	return sightings.messages - sightings.seen[column]
+}
+
+// ObserveSchema учитывает схему записанного сообщения для поиска удаленных колонок.
+// Вызывается один раз для каждого свежего сообщения после коммита; повторно доставленные
+// сообщения не учитываются, их схема могла устареть
+func (s *SchemaService) ObserveSchema(schema domain.Schema) {
+	if s.ColumnPolicy.MissingMessages <= 1 {
+		return
+	}
+	s.sightings.observe(s.Table(schema).String(), schema.Columns)
+}
+
+// ForRedelivery возвращает копию сервиса для повторно доставленного сообщения:
+// его схема могла устареть, поэтому пропавшие из нее колонки не считаются удаленными
+func (s *SchemaService) ForRedelivery() *SchemaService {
+	service := *s
+	service.ColumnPolicy.Dropped = DroppedColumnIgnore
+	return &service
+}
+
+// columnMissingLongEnough сообщает, что колонки нет в текущем сообщении и в
+// MissingMessages-1 предыдущих записанных сообщениях таблицы
+func (s *SchemaService) columnMissingLongEnough(table TableRef, column string) bool {
+	if s.ColumnPolicy.MissingMessages <= 1 {
+		return true
+	}
+	return s.sightings.missingFor(table.String(), column)+1 >= s.ColumnPolicy.MissingMessages
+}
+
+// LoadRenames читает файл переименований вида {"таблица": {"новое имя": "старое имя"}}
+func LoadRenames(path string) (map[string]map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read renames file: %w", err)
+	}
+
+	var renames map[string]map[string]string
+	if err := json.Unmarshal(data, &renames); err != nil {
+		return nil, fmt.Errorf("failed to parse renames file: %w", err)
+	}
+
+	return renames, nil
+}
+
+// columnRenames возвращает переименования для таблицы: подсказка из сообщения
+// дополняет и переопределяет файл переименований
+func (s *SchemaService) columnRenames(schema domain.Schema) map[string]string {
+	renames := make(map[string]string)
+	for to, from := range s.ColumnPolicy.Renames[schema.TableName] {
+		renames[to] = from
+	}
+	for to, from := range schema.RenamedColumns {
+		renames[to] = from
+	}
+	return renames
+}
+
+// deprecatedAt разбирает время пометки из комментария колонки
+func deprecatedAt(comment *string) time.Time {
+	if comment == nil || !strings.HasPrefix(*comment, deprecatedMarker) {
+		return time.Time{}
+	}
+	markedAt, err := time.Parse(time.RFC3339, strings.TrimPrefix(*comment, deprecatedMarker))
+	if err != nil {
+		return time.Time{}
+	}
+	return markedAt
+}
+
+// RenameColumns переименовывает колонки
+func (s *SchemaService) RenameColumns(table TableRef, renames []ColumnRename) error {
+	for _, rename := range renames {
+		query := fmt.Sprintf(`ALTER TABLE %s RENAME COLUMN %s TO %s`, table.Quoted(), QuoteIdentifier(rename.From), QuoteIdentifier(rename.To))
+		if err := s.execDDL(table, query); err != nil {
+			return fmt.Errorf("failed to rename column %s to %s: %w", rename.From, rename.To, err)
+		}
+		if rename.Enum {
+			if err := s.renameEnumConstraint(table, rename); err != nil {
+				return err
+			}
+		}
+		log.Printf("Column %s.%s renamed to %s", table, rename.From, rename.To)
+	}
+
+	return nil
+}
+
+// renameEnumConstraint переименовывает ограничение значений вслед за колонкой. Ограничение
+// могло быть создано прежней версией под другим именем (см. legacyEnumConstraintName)
+func (s *SchemaService) renameEnumConstraint(table TableRef, rename ColumnRename) error {
+	constraints, err := s.getEnumValues(table)
+	if err != nil {
+		return err
+	}
+	from, exists := columnEnumConstraint(constraints, rename.From)
+	if !exists {
+		return nil
+	}
+
+	query := fmt.Sprintf(`ALTER TABLE %s RENAME CONSTRAINT %s TO %s`,
+		table.Quoted(), QuoteIdentifier(from), QuoteIdentifier(enumConstraintName(rename.To)))
+	if err := s.execDDL(table, query); err != nil {
+		return fmt.Errorf("failed to rename values constraint of column %s: %w", rename.From, err)
+	}
+	return nil
+}
+
+// RestoreColumns снимает пометку с колонок, которые снова пришли в схеме сообщения
+func (s *SchemaService) RestoreColumns(table TableRef, columns []string) error {
+	for _, columnName := range columns {
+		query := fmt.Sprintf(`COMMENT ON COLUMN %s.%s IS NULL`, table.Quoted(), QuoteIdentifier(columnName))
+		if err := s.execDDL(table, query); err != nil {
+			return fmt.Errorf("failed to restore column %s: %w", columnName, err)
+		}
+	}
+
+	return nil
+}
+
+// droppedColumnPending сообщает, что с пропавшей колонкой еще нужно что-то сделать:
+// пометить ее или удалить по истечении GracePeriod
+func (s *SchemaService) droppedColumnPending(column DroppedColumn) bool {
+	if column.DeprecatedAt.IsZero() {
+		return true
+	}
+	return s.ColumnPolicy.Dropped == DroppedColumnDrop && time.Since(column.DeprecatedAt) >= s.ColumnPolicy.GracePeriod
+}
+
+// HandleDroppedColumns применяет политику к колонкам, которых нет в схеме сообщения
+func (s *SchemaService) HandleDroppedColumns(table TableRef, columns []DroppedColumn) error {
+	for _, column := range columns {
+		if column.DeprecatedAt.IsZero() {
+			if err := s.deprecateColumn(table, column); err != nil {
+				return err
+			}
+			column.DeprecatedAt = time.Now()
+		}
+
+		if !s.droppedColumnPending(column) {
+			continue
+		}
+
+		query := fmt.Sprintf(`ALTER TABLE %s DROP COLUMN IF EXISTS %s`, table.Quoted(), QuoteIdentifier(column.Name))
+		if err := s.execDDL(table, query); err != nil {
+			return fmt.Errorf("failed to drop column %s: %w", column.Name, err)
+		}
+		log.Printf("Column %s.%s dropped after grace period", table, column.Name)
+	}
+
+	return nil
+}
+
+// deprecateColumn помечает колонку устаревшей. NOT NULL снимается, чтобы запись
+// без этой колонки не нарушала ограничение
+func (s *SchemaService) deprecateColumn(table TableRef, column DroppedColumn) error {
+	comment := deprecatedMarker + time.Now().UTC().Format(time.RFC3339)
+	query := fmt.Sprintf(`COMMENT ON COLUMN %s.%s IS '%s'`, table.Quoted(), QuoteIdentifier(column.Name), comment)
+	if err := s.execDDL(table, query); err != nil {
+		return fmt.Errorf("failed to deprecate column %s: %w", column.Name, err)
+	}
+
+	if !column.AllowNull {
+		query := fmt.Sprintf(`ALTER TABLE %s ALTER COLUMN %s DROP NOT NULL`, table.Quoted(), QuoteIdentifier(column.Name))
+		if err := s.execDDL(table, query); err != nil {
+			return fmt.Errorf("failed to drop not null on column %s: %w", column.Name, err)
+		}
+	}
+
+	log.Printf("Column %s.%s is missing from the message schema and marked deprecated", table, column.Name)
+	return nil
+}
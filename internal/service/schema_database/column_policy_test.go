@@ -0,0 +1,82 @@
+package schema_database
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"crm-lead-service/internal/domain"
+)
+
+// TestDeprecatedAt проверяет разбор пометки устаревшей колонки из комментария
+func TestDeprecatedAt(t *testing.T) {
+	comment := func(value string) *string {
+		return &value
+	}
+
+	expected := time.Date(2024, 12, 2, 10, 0, 0, 0, time.UTC)
+	if got := deprecatedAt(comment("sdr:deprecated since 2024-12-02T10:00:00Z")); !got.Equal(expected) {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+
+	for _, value := range []*string{nil, comment("Email пользователя"), comment("sdr:deprecated since yesterday")} {
+		if got := deprecatedAt(value); !got.IsZero() {
+			t.Errorf("Expected zero time, got %v", got)
+		}
+	}
+}
+
+// TestColumnRenames проверяет, что подсказка из сообщения переопределяет файл переименований
+func TestColumnRenames(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "renames.json")
+	content := `{"users": {"email_address": "email", "full_name": "name"}}`
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	renames, err := LoadRenames(path)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	service := &SchemaService{ColumnPolicy: ColumnPolicyConfig{Renames: renames}}
+	got := service.columnRenames(domain.Schema{
+		TableName:      "users",
+		RenamedColumns: map[string]string{"full_name": "fio"},
+	})
+
+	if got["email_address"] != "email" {
+		t.Errorf("Expected email_address to be renamed from email, got %q", got["email_address"])
+	}
+	if got["full_name"] != "fio" {
+		t.Errorf("Expected message hint to win, got %q", got["full_name"])
+	}
+
+	if len(service.columnRenames(domain.Schema{TableName: "leads"})) != 0 {
+		t.Error("Expected no renames for other tables")
+	}
+}
+
+// TestDroppedColumnPending проверяет, что помеченная колонка не изменяет схему до конца GracePeriod
+func TestDroppedColumnPending(t *testing.T) {
+	deprecate := &SchemaService{ColumnPolicy: ColumnPolicyConfig{Dropped: DroppedColumnDeprecate}}
+	drop := &SchemaService{ColumnPolicy: ColumnPolicyConfig{Dropped: DroppedColumnDrop, GracePeriod: time.Hour}}
+
+	fresh := DroppedColumn{Name: "legacy"}
+	marked := DroppedColumn{Name: "legacy", DeprecatedAt: time.Now().Add(-time.Minute)}
+	expired := DroppedColumn{Name: "legacy", DeprecatedAt: time.Now().Add(-2 * time.Hour)}
+
+	if !deprecate.droppedColumnPending(fresh) || !drop.droppedColumnPending(fresh) {
+		t.Error("Expected unmarked column to be pending")
+	}
+	if deprecate.droppedColumnPending(expired) {
+		t.Error("Expected marked column to stay with deprecate policy")
+	}
+	if drop.droppedColumnPending(marked) {
+		t.Error("Expected column to wait for grace period")
+	}
+	if !drop.droppedColumnPending(expired) {
+		t.Error("Expected column to be dropped after grace period")
+	}
+}
@@ -0,0 +1,263 @@
+package schema_database
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"crm-lead-service/internal/domain"
+)
+
+// TypeChange безопасное расширение типа колонки
+type TypeChange struct {
+	Column string
+	From   string
+	To     string
+}
+
+// SchemaConflictError изменение схемы, которое нельзя применить автоматически:
+// сужение или несовместимая смена типа колонки
+type SchemaConflictError struct {
+	Table   string
+	Column  string
+	Current string
+	Desired string
+	Reason  string
+}
+
+func (e *SchemaConflictError) Error() string {
+	return fmt.Sprintf("schema conflict in %s.%s: cannot change %s to %s: %s",
+		e.Table, e.Column, e.Current, e.Desired, e.Reason)
+}
+
+// pgType нормализованный тип колонки PostgreSQL
+type pgType struct {
+	name string
+	// length длина varchar/char, 0 - без ограничения
+	length int
+	// precision и scale для numeric, precision 0 - без ограничения
+	precision int
+	scale     int
+	array     bool
+}
+
+func (t pgType) String() string {
+	var result string
+	switch {
+	case (t.name == "varchar" || t.name == "char") && t.length > 0:
+		result = fmt.Sprintf("%s(%d)", strings.ToUpper(t.name), t.length)
+	case t.name == "numeric" && t.precision > 0:
+		result = fmt.Sprintf("NUMERIC(%d,%d)", t.precision, t.scale)
+	default:
+		result = strings.ToUpper(t.name)
+	}
+	if t.array {
+		result += "[]"
+	}
+	return result
+}
+
+// typeAliases приводит синонимы типов PostgreSQL к одному имени
+var typeAliases = map[string]string{
+	"int":                         "integer",
+	"int4":                        "integer",
+	"integer":                     "integer",
+	"serial":                      "integer",
+	"int2":                        "smallint",
+	"smallint":                    "smallint",
+	"smallserial":                 "smallint",
+	"int8":                        "bigint",
+	"bigint":                      "bigint",
+	"bigserial":                   "bigint",
+	"decimal":                     "numeric",
+	"numeric":                     "numeric",
+	"real":                        "real",
+	"float4":                      "real",
+	"float":                       "double precision",
+	"float8":                      "double precision",
+	"double":                      "double precision",
+	"double precision":            "double precision",
+	"varchar":                     "varchar",
+	"character varying":           "varchar",
+	"char":                        "char",
+	"character":                   "char",
+	"bpchar":                      "char",
+	"text":                        "text",
+	"bool":                        "boolean",
+	"boolean":                     "boolean",
+	"date":                        "date",
+	"timestamp":                   "timestamp",
+	"timestamp without time zone": "timestamp",
+	"timestamptz":                 "timestamptz",
+	"timestamp with time zone":    "timestamptz",
+	"time":                        "time",
+	"time without time zone":      "time",
+	"timetz":                      "timetz",
+	"time with time zone":         "timetz",
+	"json":                        "json",
+	"jsonb":                       "jsonb",
+	"uuid":                        "uuid",
+	"bytea":                       "bytea",
+	"interval":                    "interval",
+	"money":                       "money",
+}
+
+// parsePgType разбирает SQL-тип вида "VARCHAR(255)", "NUMERIC(10,2)", "INTEGER[]"
+func parsePgType(sqlType string) (pgType, bool) {
+	var result pgType
+
+	sqlType = strings.ToLower(strings.TrimSpace(sqlType))
+	if strings.HasSuffix(sqlType, "[]") {
+		result.array = true
+		sqlType = strings.TrimSpace(strings.TrimSuffix(sqlType, "[]"))
+	}
+
+	var args []int
+	if open := strings.Index(sqlType, "("); open >= 0 {
+		closing := strings.Index(sqlType, ")")
+		if closing < open {
+			return pgType{}, false
+		}
+		for _, arg := range strings.Split(sqlType[open+1:closing], ",") {
+			number, err := strconv.Atoi(strings.TrimSpace(arg))
+			if err != nil {
+				return pgType{}, false
+			}
+			args = append(args, number)
+		}
+		// "timestamp(6) with time zone": модификатор стоит в середине
+		sqlType = strings.TrimSpace(sqlType[:open] + sqlType[closing+1:])
+		sqlType = strings.Join(strings.Fields(sqlType), " ")
+	}
+
+	name, known := typeAliases[sqlType]
+	if !known {
+		return pgType{}, false
+	}
+	result.name = name
+
+	switch name {
+	case "varchar", "char":
+		if len(args) > 0 {
+			result.length = args[0]
+		} else if name == "char" {
+			result.length = 1
+		}
+	case "numeric":
+		if len(args) > 0 {
+			result.precision = args[0]
+		}
+		if len(args) > 1 {
+			result.scale = args[1]
+		}
+	}
+
+	return result, true
+}
+
+// dbColumnType собирает тип колонки из данных information_schema (см. GetTableColumns)
+func dbColumnType(column domain.ColumnInfo) (pgType, bool) {
+	result, ok := parsePgType(column.DbType)
+	if !ok {
+		return pgType{}, false
+	}
+
+	result.array = column.Dimension > 0
+	switch result.name {
+	case "varchar", "char":
+		result.length = 0
+		if column.Size != nil {
+			result.length = *column.Size
+		}
+	case "numeric":
+		result.precision, result.scale = 0, 0
+		if column.Precision != nil {
+			result.precision = *column.Precision
+		}
+		if column.Scale != nil {
+			result.scale = *column.Scale
+		}
+	}
+
+	return result, true
+}
+
+// integerDigits сколько десятичных цифр гарантированно помещается в целый тип
+var integerDigits = map[string]int{
+	"smallint": 5,
+	"integer":  10,
+	"bigint":   19,
+}
+
+// integerRank порядок целых типов по размеру
+var integerRank = map[string]int{
+	"smallint": 1,
+	"integer":  2,
+	"bigint":   3,
+}
+
+// compareTypes сравнивает текущий тип колонки с желаемым. Возвращает changed=true,
+// если тип нужно поменять, и ошибку-причину, если смена не является безопасным расширением
+func compareTypes(current, desired pgType) (bool, string) {
+	if current == desired {
+		return false, ""
+	}
+
+	if current.array != desired.array {
+		return true, "array and scalar types are incompatible"
+	}
+
+	from, to := current.name, desired.name
+
+	switch {
+	case integerRank[from] > 0 && integerRank[to] > 0:
+		if integerRank[to] > integerRank[from] {
+			return true, ""
+		}
+		return true, "integer type narrowing"
+
+	case integerRank[from] > 0 && to == "numeric":
+		if desired.precision == 0 || desired.precision-desired.scale >= integerDigits[from] {
+			return true, ""
+		}
+		return true, "numeric precision is too small for integer values"
+
+	case from == "numeric" && to == "numeric":
+		if desired.precision == 0 {
+			return true, ""
+		}
+		if current.precision == 0 {
+			return true, "unbounded numeric cannot be limited"
+		}
+		if desired.scale >= current.scale && desired.precision-desired.scale >= current.precision-current.scale {
+			return true, ""
+		}
+		return true, "numeric precision or scale narrowing"
+
+	case from == "real" && to == "double precision":
+		return true, ""
+
+	case (from == "varchar" || from == "char") && (to == "varchar" || to == "text"):
+		if to == "text" || desired.length == 0 || (current.length > 0 && desired.length >= current.length) {
+			return true, ""
+		}
+		return true, "string length narrowing"
+
+	case from == "char" && to == "char":
+		if desired.length >= current.length {
+			return true, ""
+		}
+		return true, "string length narrowing"
+
+	case from == "date" && (to == "timestamp" || to == "timestamptz"):
+		return true, ""
+
+	case from == "timestamp" && to == "timestamptz":
+		return true, ""
+
+	case from == "json" && to == "jsonb":
+		return true, ""
+	}
+
+	return true, "incompatible types"
+}
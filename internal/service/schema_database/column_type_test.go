@@ -0,0 +1,153 @@
+package schema_database
+
+import (
+	"testing"
+
+	"crm-lead-service/internal/domain"
+)
+
+func intPtr(value int) *int {
+	return &value
+}
+
+// TestParsePgType проверяет разбор SQL-типов из mapTypeToPostgres
+func TestParsePgType(t *testing.T) {
+	tests := []struct {
+		sqlType  string
+		expected pgType
+	}{
+		{"VARCHAR(255)", pgType{name: "varchar", length: 255}},
+		{"TEXT", pgType{name: "text"}},
+		{"NUMERIC(10,2)", pgType{name: "numeric", precision: 10, scale: 2}},
+		{"DECIMAL(12, 4)", pgType{name: "numeric", precision: 12, scale: 4}},
+		{"INT(11)", pgType{name: "integer"}},
+		{"TIMESTAMPTZ", pgType{name: "timestamptz"}},
+		{"DOUBLE PRECISION", pgType{name: "double precision"}},
+		{"INTEGER[]", pgType{name: "integer", array: true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.sqlType, func(t *testing.T) {
+			got, ok := parsePgType(tt.sqlType)
+			if !ok {
+				t.Fatalf("Expected %s to be parsed", tt.sqlType)
+			}
+			if got != tt.expected {
+				t.Errorf("Expected %+v, got %+v", tt.expected, got)
+			}
+		})
+	}
+
+	if _, ok := parsePgType("GEOMETRY"); ok {
+		t.Error("Expected unknown type not to be parsed")
+	}
+}
+
+// TestDbColumnType проверяет сборку типа из information_schema
+func TestDbColumnType(t *testing.T) {
+	got, ok := dbColumnType(domain.ColumnInfo{DbType: "character varying", Size: intPtr(100)})
+	if !ok || got != (pgType{name: "varchar", length: 100}) {
+		t.Errorf("Expected VARCHAR(100), got %+v", got)
+	}
+
+	got, ok = dbColumnType(domain.ColumnInfo{DbType: "numeric", Precision: intPtr(8), Scale: intPtr(2)})
+	if !ok || got != (pgType{name: "numeric", precision: 8, scale: 2}) {
+		t.Errorf("Expected NUMERIC(8,2), got %+v", got)
+	}
+
+	got, ok = dbColumnType(domain.ColumnInfo{DbType: "int4", Dimension: 1})
+	if !ok || got != (pgType{name: "integer", array: true}) {
+		t.Errorf("Expected INTEGER[], got %+v", got)
+	}
+}
+
+// TestCompareTypes проверяет, какие смены типа считаются безопасным расширением
+func TestCompareTypes(t *testing.T) {
+	tests := []struct {
+		name     string
+		current  string
+		desired  string
+		changed  bool
+		conflict bool
+	}{
+		{"Same type", "VARCHAR(100)", "VARCHAR(100)", false, false},
+		{"Integer to bigint", "INTEGER", "BIGINT", true, false},
+		{"Bigint to integer", "BIGINT", "INTEGER", true, true},
+		{"Integer to wide numeric", "INTEGER", "NUMERIC(12,2)", true, false},
+		{"Integer to narrow numeric", "INTEGER", "NUMERIC(8,2)", true, true},
+		{"Numeric grows", "NUMERIC(10,2)", "NUMERIC(12,4)", true, false},
+		{"Numeric scale shrinks", "NUMERIC(10,2)", "NUMERIC(10,1)", true, true},
+		{"Numeric integer part shrinks", "NUMERIC(10,2)", "NUMERIC(10,4)", true, true},
+		{"Unbounded numeric limited", "NUMERIC", "NUMERIC(10,2)", true, true},
+		{"Varchar grows", "VARCHAR(100)", "VARCHAR(255)", true, false},
+		{"Varchar shrinks", "VARCHAR(255)", "VARCHAR(100)", true, true},
+		{"Varchar to text", "VARCHAR(255)", "TEXT", true, false},
+		{"Text to varchar", "TEXT", "VARCHAR(255)", true, true},
+		{"Real to double", "REAL", "DOUBLE PRECISION", true, false},
+		{"Timestamp to timestamptz", "TIMESTAMP", "TIMESTAMPTZ", true, false},
+		{"Timestamptz to date", "TIMESTAMPTZ", "DATE", true, true},
+		{"Text to integer", "TEXT", "INTEGER", true, true},
+		{"Scalar to array", "INTEGER", "INTEGER[]", true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			current, _ := parsePgType(tt.current)
+			desired, _ := parsePgType(tt.desired)
+
+			changed, reason := compareTypes(current, desired)
+			if changed != tt.changed {
+				t.Errorf("Expected changed=%t, got %t", tt.changed, changed)
+			}
+			if (reason != "") != tt.conflict {
+				t.Errorf("Expected conflict=%t, got reason %q", tt.conflict, reason)
+			}
+		})
+	}
+}
+
+// TestCompareColumnTypeLegacy проверяет, что колонки, созданные по прежним правилам
+// сопоставления типов, не переписываются, пока тип в схеме источника не изменился
+func TestCompareColumnTypeLegacy(t *testing.T) {
+	service := &SchemaService{}
+	table := TableRef{Schema: "public", Name: "leads"}
+
+	tests := []struct {
+		name     string
+		column   domain.ColumnInfo
+		dbColumn domain.ColumnInfo
+		expected string
+	}{
+		{"Unsigned integer created as integer",
+			domain.ColumnInfo{Name: "views", Type: "integer", DbType: "int(10) unsigned", Unsigned: true},
+			domain.ColumnInfo{Name: "views", DbType: "integer"}, ""},
+		{"Unsigned bigint created as bigint",
+			domain.ColumnInfo{Name: "total", Type: "bigint", DbType: "bigint(20) unsigned", Unsigned: true},
+			domain.ColumnInfo{Name: "total", DbType: "bigint"}, ""},
+		{"Float created from dbType",
+			domain.ColumnInfo{Name: "rate", Type: "float", DbType: "real"},
+			domain.ColumnInfo{Name: "rate", DbType: "real"}, ""},
+		{"Source widened integer to bigint",
+			domain.ColumnInfo{Name: "views", Type: "bigint", DbType: "bigint(20)"},
+			domain.ColumnInfo{Name: "views", DbType: "integer"}, "BIGINT"},
+		{"Unsigned integer on smallint column",
+			domain.ColumnInfo{Name: "views", Type: "integer", DbType: "int(10) unsigned", Unsigned: true},
+			domain.ColumnInfo{Name: "views", DbType: "smallint"}, "BIGINT"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			change, err := service.compareColumnType(table, tt.column, tt.dbColumn)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			got := ""
+			if change != nil {
+				got = change.To
+			}
+			if got != tt.expected {
+				t.Errorf("Expected type change to %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,306 @@
+package schema_database
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"strings"
+
+	"crm-lead-service/internal/domain"
+	"crm-lead-service/pkg/database"
+
+	"github.com/lib/pq"
+)
+
+type ForeignKeyMode string
+
+const (
+	// ForeignKeysRecord внешние ключи только записываются в таблицу _sdr_foreign_keys:
+	// связи видны тем, кто читает реплику, а порядок прихода строк не важен
+	ForeignKeysRecord ForeignKeyMode = "record"
+	// ForeignKeysCreate в таблицах создаются отложенные ограничения внешних ключей
+	ForeignKeysCreate ForeignKeyMode = "create"
+)
+
+// foreignKeysTableName таблица внешних ключей, записанных в режиме ForeignKeysRecord
+const foreignKeysTableName = "_sdr_foreign_keys"
+
+// foreignKeyLockTimeout сколько ждать блокировку таблиц при добавлении ограничения.
+// Ожидающий ALTER TABLE блокирует запись в таблицы, поэтому ждать долго нельзя
+const foreignKeyLockTimeout = "5s"
+
+// foreignKeyDef внешний ключ из схемы сообщения или из БД
+type foreignKeyDef struct {
+	name       string
+	columns    []string
+	refTable   TableRef
+	refColumns []string
+}
+
+// foreignKeysTable возвращает таблицу записанных внешних ключей в схеме по умолчанию
+func (s *SchemaService) foreignKeysTable() TableRef {
+	return TableRef{Schema: s.defaultNamespace(), Name: foreignKeysTableName}
+}
+
+// EnsureForeignKeyTable создает таблицу записанных внешних ключей в режиме ForeignKeysRecord
+func (s *SchemaService) EnsureForeignKeyTable(ctx context.Context, db *sql.DB) error {
+	if s.ForeignKeys == ForeignKeysCreate {
+		return nil
+	}
+
+	table := s.foreignKeysTable()
+	return ensureServiceTable(ctx, db, table,
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+			"table_schema" TEXT NOT NULL,
+			"table_name" TEXT NOT NULL,
+			"name" TEXT NOT NULL,
+			"columns" TEXT[] NOT NULL,
+			"ref_schema" TEXT NOT NULL,
+			"ref_table" TEXT NOT NULL,
+			"ref_columns" TEXT[] NOT NULL,
+			"updated_at" TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY ("table_schema", "table_name", "name")
+		)`, table.Quoted()),
+	)
+}
+
+// refTable возвращает родительскую таблицу внешнего ключа. Имя со схемой ("crm.leads")
+// используется как есть, имя без схемы размещается по тем же правилам, что и таблица сообщения
+func (s *SchemaService) refTable(name string) TableRef {
+	if namespace, table, found := strings.Cut(name, "."); found {
+		return TableRef{Schema: namespace, Name: table}
+	}
+	return s.Table(domain.Schema{TableName: name})
+}
+
+// desiredForeignKeys возвращает внешние ключи из схемы сообщения в порядке имен.
+// Имя ограничения строится как имя индекса, чтобы не совпасть с ограничениями других таблиц
+func (s *SchemaService) desiredForeignKeys(table TableRef, schema domain.Schema) []foreignKeyDef {
+	var keys []foreignKeyDef
+	for name, key := range schema.ForeignKeys {
+		keys = append(keys, foreignKeyDef{
+			name:       indexName(table, name),
+			columns:    key.Columns,
+			refTable:   s.refTable(key.RefTable),
+			refColumns: key.RefColumns,
+		})
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].name < keys[j].name
+	})
+	return keys
+}
+
+// foreignKeysHash возвращает хеш внешних ключей схемы сообщения
+func foreignKeysHash(keys []foreignKeyDef) string {
+	hash := sha256.New()
+	for _, key := range keys {
+		fmt.Fprintf(hash, "%s|%s|%s|%s\n", key.name, strings.Join(key.columns, ","),
+			key.refTable, strings.Join(key.refColumns, ","))
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// getForeignKeys читает ограничения внешних ключей таблицы из pg_constraint
+func (s *SchemaService) getForeignKeys(table TableRef) (map[string]foreignKeyDef, error) {
+	query := `
+		SELECT c.conname, rn.nspname, r.relname,
+			ARRAY(
+				SELECT a.attname::text FROM unnest(c.conkey) WITH ORDINALITY AS k(attnum, ord)
+				JOIN pg_attribute a ON a.attrelid = c.conrelid AND a.attnum = k.attnum
+				ORDER BY k.ord
+			),
+			ARRAY(
+				SELECT a.attname::text FROM unnest(c.confkey) WITH ORDINALITY AS k(attnum, ord)
+				JOIN pg_attribute a ON a.attrelid = c.confrelid AND a.attnum = k.attnum
+				ORDER BY k.ord
+			)
+		FROM pg_constraint c
+		JOIN pg_class r ON r.oid = c.confrelid
+		JOIN pg_namespace rn ON rn.oid = r.relnamespace
+		WHERE c.conrelid = $1::regclass AND c.contype = 'f'
+	`
+
+	rows, err := s.db.Query(query, table.Quoted())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query foreign keys: %w", err)
+	}
+	defer rows.Close()
+
+	keys := make(map[string]foreignKeyDef)
+	for rows.Next() {
+		var key foreignKeyDef
+		err := rows.Scan(&key.name, &key.refTable.Schema, &key.refTable.Name,
+			pq.Array(&key.columns), pq.Array(&key.refColumns))
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan foreign key: %w", err)
+		}
+		keys[key.name] = key
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows iteration error: %w", err)
+	}
+
+	return keys, nil
+}
+
+// foreignKeyStatements возвращает DDL, приводящий внешний ключ таблицы к схеме сообщения,
+// или nil, если ограничение уже совпадает. Ограничение создается DEFERRABLE INITIALLY DEFERRED,
+// чтобы дочерняя строка могла прийти в пачке раньше родительской, и NOT VALID, чтобы
+// не проверять существующие строки и не сканировать таблицу
+func foreignKeyStatements(table TableRef, key foreignKeyDef, current map[string]foreignKeyDef) []string {
+	existing, exists := current[key.name]
+	if exists && existing.refTable == key.refTable &&
+		slices.Equal(existing.columns, key.columns) && slices.Equal(existing.refColumns, key.refColumns) {
+		return nil
+	}
+
+	var statements []string
+	if exists {
+		statements = append(statements, fmt.Sprintf(`ALTER TABLE %s DROP CONSTRAINT IF EXISTS %s`, table.Quoted(), QuoteIdentifier(key.name)))
+	}
+	statements = append(statements, fmt.Sprintf(
+		`ALTER TABLE %s ADD CONSTRAINT %s FOREIGN KEY (%s) REFERENCES %s (%s) DEFERRABLE INITIALLY DEFERRED NOT VALID`,
+		table.Quoted(), QuoteIdentifier(key.name), quoteIdentifiers(key.columns), key.refTable.Quoted(), quoteIdentifiers(key.refColumns)))
+	return statements
+}
+
+// EnsureForeignKeys сверяет внешние ключи таблицы с foreignKeys схемы сообщения в фоне,
+// после коммита данных: в режиме ForeignKeysCreate создает ограничения, иначе записывает
+// ключи в таблицу _sdr_foreign_keys. Ключи одной схемы сверяются один раз
+func (s *SchemaService) EnsureForeignKeys(schema domain.Schema) {
+	if s.jobs == nil || len(schema.ForeignKeys) == 0 {
+		return
+	}
+
+	table := s.Table(schema)
+	desired := s.desiredForeignKeys(table, schema)
+	s.jobs.run("foreign keys:"+table.String(), foreignKeysHash(desired), func() (bool, error) {
+		if s.ForeignKeys == ForeignKeysCreate {
+			return s.forSchema(schema).createForeignKeys(table, desired)
+		}
+		return s.recordForeignKeys(table, desired)
+	})
+}
+
+// recordForeignKeys записывает внешние ключи таблицы в _sdr_foreign_keys. Ключи,
+// которых больше нет в сообщении, не удаляются, как и ограничения в режиме ForeignKeysCreate
+func (s *SchemaService) recordForeignKeys(table TableRef, keys []foreignKeyDef) (bool, error) {
+	query := fmt.Sprintf(
+		`INSERT INTO %s ("table_schema", "table_name", "name", "columns", "ref_schema", "ref_table", "ref_columns")
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT ("table_schema", "table_name", "name") DO UPDATE SET
+			"columns" = EXCLUDED."columns",
+			"ref_schema" = EXCLUDED."ref_schema",
+			"ref_table" = EXCLUDED."ref_table",
+			"ref_columns" = EXCLUDED."ref_columns",
+			"updated_at" = CURRENT_TIMESTAMP`,
+		s.foreignKeysTable().Quoted(),
+	)
+
+	for _, key := range keys {
+		_, err := s.pool.ExecContext(s.jobs.ctx, query, table.Schema, table.Name, key.name,
+			pq.Array(key.columns), key.refTable.Schema, key.refTable.Name, pq.Array(key.refColumns))
+		if err != nil {
+			return false, fmt.Errorf("failed to record foreign key %s: %w", key.name, err)
+		}
+	}
+
+	return true, nil
+}
+
+// createForeignKeys создает недостающие ограничения внешних ключей, каждое в своей транзакции.
+// Ключ, родительской таблицы которого еще нет, пропускается и проверяется на следующих сообщениях.
+// Возвращает false, если ключи нужно проверить снова
+func (s *SchemaService) createForeignKeys(table TableRef, desired []foreignKeyDef) (bool, error) {
+	ctx := s.jobs.ctx
+
+	reader := *s
+	reader.db = database.BindContext(ctx, s.pool)
+	current, err := reader.getForeignKeys(table)
+	if err != nil {
+		return false, err
+	}
+
+	checked := true
+	var errs []error
+	for _, key := range desired {
+		statements := foreignKeyStatements(table, key, current)
+		if len(statements) == 0 {
+			continue
+		}
+
+		exists, err := reader.TableExists(key.refTable)
+		if err != nil {
+			return false, err
+		}
+		if !exists {
+			checked = false
+			continue
+		}
+
+		if s.Mode == SchemaModePlan {
+			for _, statement := range statements {
+				log.Printf("Foreign key change pending approval: Table=%s, Statement=%s", table, statement)
+				if err := s.recordPlannedDDL(table, statement); err != nil {
+					return false, err
+				}
+			}
+			continue
+		}
+
+		if err := s.addForeignKey(ctx, table, statements); err != nil {
+			// Ошибку данных (родительские колонки без уникального индекса) повтор не исправит,
+			// занятые таблицы и остановку сервиса - исправит
+			if lockNotAvailable(err) || ctx.Err() != nil {
+				checked = false
+			}
+			errs = append(errs, fmt.Errorf("failed to add foreign key %s: %w", key.name, err))
+		}
+	}
+
+	return checked, errors.Join(errs...)
+}
+
+// addForeignKey выполняет DDL одного внешнего ключа под блокировкой изменения схемы таблицы
+func (s *SchemaService) addForeignKey(ctx context.Context, table TableRef, statements []string) error {
+	tx, err := s.pool.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	txService := s.WithTx(ctx, tx)
+	if _, err := txService.db.Exec(fmt.Sprintf(`SET LOCAL lock_timeout = '%s'`, foreignKeyLockTimeout)); err != nil {
+		return fmt.Errorf("failed to set lock timeout: %w", err)
+	}
+	if err := txService.LockTable(table); err != nil {
+		return err
+	}
+
+	for _, statement := range statements {
+		log.Printf("Adding foreign key: Table=%s, Statement=%s", table, statement)
+		if err := txService.execDDL(table, statement); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// lockNotAvailable сообщает, что запрос не дождался блокировки (lock_timeout)
+func lockNotAvailable(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code.Class() == "55"
+}
@@ -0,0 +1,79 @@
+package schema_database
+
+import (
+	"reflect"
+	"testing"
+
+	"crm-lead-service/internal/domain"
+)
+
+// TestForeignKeyStatements проверяет сверку внешних ключей схемы сообщения с ограничениями таблицы
+func TestForeignKeyStatements(t *testing.T) {
+	service := &SchemaService{Namespace: NamespaceConfig{Default: "crm"}}
+	table := TableRef{Schema: "crm", Name: "lead_contacts"}
+	desired := service.desiredForeignKeys(table, domain.Schema{
+		ForeignKeys: map[string]domain.ForeignKey{
+			"lead": {Columns: []string{"lead_id"}, RefTable: "leads", RefColumns: []string{"id"}},
+		},
+	})
+
+	add := `ALTER TABLE "crm"."lead_contacts" ADD CONSTRAINT "lead_contacts_lead" FOREIGN KEY ("lead_id") ` +
+		`REFERENCES "crm"."leads" ("id") DEFERRABLE INITIALLY DEFERRED NOT VALID`
+
+	tests := []struct {
+		name     string
+		current  map[string]foreignKeyDef
+		expected []string
+	}{
+		{"Missing constraint", nil, []string{add}},
+		{
+			"Constraint up to date",
+			map[string]foreignKeyDef{
+				"lead_contacts_lead": {name: "lead_contacts_lead", columns: []string{"lead_id"},
+					refTable: TableRef{Schema: "crm", Name: "leads"}, refColumns: []string{"id"}},
+			},
+			nil,
+		},
+		{
+			"Changed constraint is recreated",
+			map[string]foreignKeyDef{
+				"lead_contacts_lead": {name: "lead_contacts_lead", columns: []string{"lead_id"},
+					refTable: TableRef{Schema: "public", Name: "leads"}, refColumns: []string{"id"}},
+			},
+			[]string{`ALTER TABLE "crm"."lead_contacts" DROP CONSTRAINT IF EXISTS "lead_contacts_lead"`, add},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := foreignKeyStatements(table, desired[0], tt.current); !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("Expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+// TestRefTable проверяет выбор схемы родительской таблицы
+func TestRefTable(t *testing.T) {
+	service := &SchemaService{Namespace: NamespaceConfig{
+		Default:  "crm",
+		Prefixes: map[string]string{"billing_": "billing"},
+	}}
+
+	tests := []struct {
+		name     string
+		expected TableRef
+	}{
+		{"leads", TableRef{Schema: "crm", Name: "leads"}},
+		{"billing_invoices", TableRef{Schema: "billing", Name: "billing_invoices"}},
+		{"archive.leads", TableRef{Schema: "archive", Name: "leads"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := service.refTable(tt.name); got != tt.expected {
+				t.Errorf("Expected %s, got %s", tt.expected, got)
+			}
+		})
+	}
+}
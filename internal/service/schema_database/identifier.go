@@ -0,0 +1,239 @@
+package schema_database
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"crm-lead-service/internal/domain"
+
+	"github.com/lib/pq"
+)
+
+// maxIdentifierLength длина идентификатора PostgreSQL. Более длинные имена PostgreSQL
+// молча обрезает, поэтому имена из сообщений длиннее отклоняются, а производные обрезаются
+const maxIdentifierLength = 63
+
+// shortIdentifier сокращает производное имя (индекса, ограничения) до длины идентификатора
+// PostgreSQL: обрезает по границе символа и добавляет хеш полного имени, чтобы разные
+// длинные имена с общим началом не совпали
+func shortIdentifier(name string) string {
+	if len(name) <= maxIdentifierLength {
+		return name
+	}
+
+	sum := sha256.Sum256([]byte(name))
+	cut := maxIdentifierLength - 9
+	for cut > 0 && !utf8.RuneStart(name[cut]) {
+		cut--
+	}
+	return name[:cut] + "_" + hex.EncodeToString(sum[:4])
+}
+
+// IdentifierConfig ограничения имен таблиц, колонок и других объектов из сообщений
+type IdentifierConfig struct {
+	// Pattern регулярное выражение, которому должно соответствовать каждое имя; nil - любые имена
+	Pattern *regexp.Regexp
+	// AllowedTables таблицы, в которые разрешено писать: "leads" - в схеме, выбранной настройками,
+	// "crm.leads" - в указанной схеме, в том числе выбранной schemaName из сообщения; пусто - любые
+	AllowedTables map[string]bool
+}
+
+// InvalidIdentifierError имя из сообщения, которое нельзя подставить в SQL.
+// Повтор не поможет, сообщение нужно отправить в dead letter
+type InvalidIdentifierError struct {
+	Kind   string
+	Name   string
+	Reason string
+}
+
+func (e *InvalidIdentifierError) Error() string {
+	return fmt.Sprintf("invalid %s name %q: %s", e.Kind, e.Name, e.Reason)
+}
+
+// QuoteIdentifier экранирует имя для подстановки в SQL: оборачивает в двойные кавычки
+// и удваивает кавычки внутри. Все имена из сообщений попадают в SQL только через него
+func QuoteIdentifier(name string) string {
+	return pq.QuoteIdentifier(name)
+}
+
+// quoteIdentifiers экранирует имена колонок и соединяет через запятую
+func quoteIdentifiers(columns []string) string {
+	quoted := make([]string, len(columns))
+	for i, column := range columns {
+		quoted[i] = QuoteIdentifier(column)
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// defaultExpressions выражения значений по умолчанию ({"expression": ...}), которые можно
+// подставить в DDL как есть: литералы с приведением типа, функции текущего времени,
+// генераторы UUID и nextval последовательности. Остальные выражения отклоняются
+var defaultExpressions = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)^(-?[0-9]+(\.[0-9]+)?|'([^'\\]|'')*'|true|false|null)(::[a-z_ ]+(\([0-9, ]*\))?(\[\])*)*$`),
+	regexp.MustCompile(`(?i)^(current_timestamp|current_date|current_time|localtimestamp|localtime)(\([0-6]\))?$`),
+	regexp.MustCompile(`(?i)^(now|clock_timestamp|statement_timestamp|transaction_timestamp|gen_random_uuid|uuid_generate_v4)\(\)$`),
+	regexp.MustCompile(`(?i)^nextval\('("([^"'\\]|"")+"|[a-z_][a-z0-9_$]*)(\.("([^"'\\]|"")+"|[a-z_][a-z0-9_$]*))?'(::regclass)?\)$`),
+}
+
+// checkDefaultValue проверяет выражение значения по умолчанию из схемы сообщения.
+// Обычные значения экранируются при подстановке (см. formatDefaultValue)
+func checkDefaultValue(column string, value interface{}) error {
+	fields, ok := value.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	expression, exists := fields["expression"]
+	if !exists {
+		return nil
+	}
+
+	text := strings.TrimSpace(fmt.Sprintf("%v", expression))
+	for _, pattern := range defaultExpressions {
+		if pattern.MatchString(text) {
+			return nil
+		}
+	}
+	return &InvalidIdentifierError{Kind: "default", Name: text, Reason: fmt.Sprintf("unsupported default expression of column %s", column)}
+}
+
+// checkIdentifier проверяет одно имя из сообщения
+func (c IdentifierConfig) checkIdentifier(kind, name string) error {
+	reason := ""
+	switch {
+	case name == "":
+		reason = "empty name"
+	case len(name) > maxIdentifierLength:
+		reason = fmt.Sprintf("longer than %d bytes", maxIdentifierLength)
+	case !utf8.ValidString(name) || strings.ContainsRune(name, 0):
+		reason = "invalid characters"
+	case c.Pattern != nil && !c.Pattern.MatchString(name):
+		reason = fmt.Sprintf("does not match %s", c.Pattern)
+	default:
+		return nil
+	}
+	return &InvalidIdentifierError{Kind: kind, Name: name, Reason: reason}
+}
+
+// checkQualified проверяет имя, которое может содержать схему: "crm.leads"
+func (c IdentifierConfig) checkQualified(kind, name string) error {
+	if namespace, object, found := strings.Cut(name, "."); found {
+		if err := c.checkIdentifier("schema", namespace); err != nil {
+			return err
+		}
+		name = object
+	}
+	return c.checkIdentifier(kind, name)
+}
+
+// ValidateIdentifiers проверяет все имена из сообщения до того, как они попадут в SQL:
+// таблицу (до и после маршрутизации), схему, колонки схемы и данных, индексы, внешние ключи и последовательности,
+// а также dbType и выражения значений по умолчанию, которые подставляются в DDL без преобразования
+func (s *SchemaService) ValidateIdentifiers(message *domain.Message) error {
+	c := s.Identifiers
+	schema := message.Schema
+
+	if err := c.checkIdentifier("table", schema.TableName); err != nil {
+		return err
+	}
+	if schema.SchemaName != "" {
+		if err := c.checkIdentifier("schema", schema.SchemaName); err != nil {
+			return err
+		}
+	}
+	if len(c.AllowedTables) > 0 && !s.tableAllowed(schema) {
+		return &InvalidIdentifierError{Kind: "table", Name: s.Table(schema).String(), Reason: "table is not allowed"}
+	}
+	// Правило маршрутизации может удлинить имя: "*" -> "raw_*"
+	if routed, excluded := s.Route(message); !excluded && routed != message {
+		if err := c.checkRouted(routed.Schema); err != nil {
+			return err
+		}
+	}
+
+	for name, column := range schema.Columns {
+		if err := c.checkIdentifier("column", name); err != nil {
+			return err
+		}
+		if column.SequenceName != nil && *column.SequenceName != "" {
+			if err := c.checkQualified("sequence", *column.SequenceName); err != nil {
+				return err
+			}
+		}
+		if rawDbType(column) && !knownRawType(column.DbType) {
+			return &InvalidIdentifierError{Kind: "type", Name: column.DbType, Reason: "unknown type"}
+		}
+		if err := checkDefaultValue(name, column.DefaultValue); err != nil {
+			return err
+		}
+	}
+
+	var columns []string
+	columns = append(columns, schema.PrimaryKey...)
+	for name, previous := range schema.RenamedColumns {
+		columns = append(columns, name, previous)
+	}
+	for _, change := range message.Data {
+		columns = append(columns, change.Field)
+	}
+	for _, indexes := range []map[string][]string{schema.Indexes, schema.UniqueKeys} {
+		for name, indexColumns := range indexes {
+			if err := c.checkIdentifier("index", name); err != nil {
+				return err
+			}
+			columns = append(columns, indexColumns...)
+		}
+	}
+	for name, key := range schema.ForeignKeys {
+		if err := c.checkIdentifier("foreign key", name); err != nil {
+			return err
+		}
+		if err := c.checkQualified("table", key.RefTable); err != nil {
+			return err
+		}
+		columns = append(columns, key.Columns...)
+		columns = append(columns, key.RefColumns...)
+	}
+
+	for _, column := range columns {
+		if err := c.checkIdentifier("column", column); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// tableAllowed проверяет таблицу сообщения по AllowedTables. Имя без схемы разрешает таблицу
+// только в схеме, выбранной настройками, чтобы schemaName из сообщения не уводил запись в другую схему
+func (s *SchemaService) tableAllowed(schema domain.Schema) bool {
+	table := s.Table(schema)
+	if s.Identifiers.AllowedTables[table.String()] {
+		return true
+	}
+
+	configured := schema
+	configured.SchemaName = ""
+	return s.Identifiers.AllowedTables[schema.TableName] && s.Table(configured) == table
+}
+
+// checkRouted проверяет имена таблиц, выбранные правилами маршрутизации
+func (c IdentifierConfig) checkRouted(schema domain.Schema) error {
+	if schema.SchemaName != "" {
+		if err := c.checkIdentifier("schema", schema.SchemaName); err != nil {
+			return err
+		}
+	}
+	if err := c.checkIdentifier("table", schema.TableName); err != nil {
+		return err
+	}
+	for _, key := range schema.ForeignKeys {
+		if err := c.checkQualified("table", key.RefTable); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package schema_database
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+
+	"crm-lead-service/internal/domain"
+)
+
+// TestQuoteIdentifier проверяет, что кавычки в имени не закрывают идентификатор
+func TestQuoteIdentifier(t *testing.T) {
+	table := TableRef{Schema: "crm", Name: `leads"; DROP TABLE users; --`}
+	expected := `"crm"."leads""; DROP TABLE users; --"`
+	if got := table.Quoted(); got != expected {
+		t.Errorf("Expected %s, got %s", expected, got)
+	}
+}
+
+// TestValidateIdentifiers проверяет отклонение недопустимых имен из сообщения
+func TestValidateIdentifiers(t *testing.T) {
+	message := func(modify func(m *domain.Message)) *domain.Message {
+		m := &domain.Message{
+			Schema: domain.Schema{
+				TableName:  "leads",
+				Columns:    map[string]domain.ColumnInfo{"id": {Type: "integer"}, "name": {Type: "string"}},
+				PrimaryKey: []string{"id"},
+			},
+			Data: []domain.Fields{{Field: "id"}, {Field: "name"}},
+		}
+		modify(m)
+		return m
+	}
+
+	tests := []struct {
+		name    string
+		config  IdentifierConfig
+		message *domain.Message
+		invalid string
+	}{
+		{"Valid message", IdentifierConfig{}, message(func(m *domain.Message) {}), ""},
+		{"Quote in table name", IdentifierConfig{Pattern: regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)},
+			message(func(m *domain.Message) { m.Schema.TableName = `leads"; DROP TABLE users; --` }), "table"},
+		{"Too long column", IdentifierConfig{},
+			message(func(m *domain.Message) { m.Data[1].Field = strings.Repeat("a", 64) }), "column"},
+		{"Empty primary key", IdentifierConfig{},
+			message(func(m *domain.Message) { m.Schema.PrimaryKey = []string{""} }), "column"},
+		{"Table not allowed", IdentifierConfig{AllowedTables: map[string]bool{"contacts": true}},
+			message(func(m *domain.Message) {}), "table"},
+		{"Allowed table", IdentifierConfig{AllowedTables: map[string]bool{"leads": true}},
+			message(func(m *domain.Message) {}), ""},
+		{"Allowed table redirected to another schema", IdentifierConfig{AllowedTables: map[string]bool{"leads": true}},
+			message(func(m *domain.Message) { m.Schema.SchemaName = "pg_catalog" }), "table"},
+		{"Allowed table in default schema named explicitly", IdentifierConfig{AllowedTables: map[string]bool{"leads": true}},
+			message(func(m *domain.Message) { m.Schema.SchemaName = "public" }), ""},
+		{"Allowed schema-qualified table", IdentifierConfig{AllowedTables: map[string]bool{"crm.leads": true}},
+			message(func(m *domain.Message) { m.Schema.SchemaName = "crm" }), ""},
+		{"Schema-qualified table in another schema", IdentifierConfig{AllowedTables: map[string]bool{"crm.leads": true}},
+			message(func(m *domain.Message) {}), "table"},
+		{"Foreign key to invalid schema", IdentifierConfig{},
+			message(func(m *domain.Message) {
+				m.Schema.ForeignKeys = map[string]domain.ForeignKey{
+					"owner": {Columns: []string{"owner_id"}, RefTable: "\x00.users", RefColumns: []string{"id"}},
+				}
+			}), "schema"},
+		{"Raw dbType with SQL", IdentifierConfig{},
+			message(func(m *domain.Message) {
+				m.Schema.Columns["tags"] = domain.ColumnInfo{Type: "custom", DbType: "text); DROP TABLE users; --"}
+			}), "type"},
+		{"Default expression with SQL", IdentifierConfig{},
+			message(func(m *domain.Message) {
+				m.Schema.Columns["created_at"] = domain.ColumnInfo{Type: "timestamp",
+					DefaultValue: map[string]interface{}{"expression": "now()); DROP TABLE x; --"}}
+			}), "default"},
+		{"Default literal breaking out of quotes", IdentifierConfig{},
+			message(func(m *domain.Message) {
+				m.Schema.Columns["status"] = domain.ColumnInfo{Type: "string",
+					DefaultValue: map[string]interface{}{"expression": `'\''); DROP TABLE x; --'`}}
+			}), "default"},
+		{"Default nextval with quote in sequence name", IdentifierConfig{},
+			message(func(m *domain.Message) {
+				m.Schema.Columns["id"] = domain.ColumnInfo{Type: "integer",
+					DefaultValue: map[string]interface{}{"expression": `nextval('"a'); DROP TABLE x; --"')`}}
+			}), "default"},
+		{"Allowed default expressions", IdentifierConfig{},
+			message(func(m *domain.Message) {
+				for name, expression := range map[string]string{
+					"created_at": "CURRENT_TIMESTAMP",
+					"updated_at": "now()",
+					"uid":        "gen_random_uuid()",
+					"id":         `nextval('crm."leads_id_seq"'::regclass)`,
+					"status":     "'new'::character varying",
+					"tags":       "'{}'::text[]",
+					"rating":     "-1.5",
+				} {
+					m.Schema.Columns[name] = domain.ColumnInfo{Type: "string", DefaultValue: map[string]interface{}{"expression": expression}}
+				}
+			}), ""},
+		{"Raw dbType with primary key", IdentifierConfig{},
+			message(func(m *domain.Message) {
+				m.Schema.Columns["tags"] = domain.ColumnInfo{Type: "custom", DbType: "integer PRIMARY KEY"}
+			}), "type"},
+		{"Raw dbType with unique constraint", IdentifierConfig{},
+			message(func(m *domain.Message) {
+				m.Schema.Columns["tags"] = domain.ColumnInfo{Type: "custom", DbType: "int UNIQUE"}
+			}), "type"},
+		{"Raw dbType with reference", IdentifierConfig{},
+			message(func(m *domain.Message) {
+				m.Schema.Columns["tags"] = domain.ColumnInfo{Type: "custom", DbType: "int REFERENCES users"}
+			}), "type"},
+		{"Raw dbType with identity", IdentifierConfig{},
+			message(func(m *domain.Message) {
+				m.Schema.Columns["tags"] = domain.ColumnInfo{Type: "custom", DbType: "integer GENERATED ALWAYS AS IDENTITY"}
+			}), "type"},
+		{"Raw dbType with modifier after words", IdentifierConfig{},
+			message(func(m *domain.Message) {
+				m.Schema.Columns["tags"] = domain.ColumnInfo{Type: "custom", DbType: "numeric(10) CHECK"}
+			}), "type"},
+		{"Raw dbType array of known type", IdentifierConfig{},
+			message(func(m *domain.Message) {
+				m.Schema.Columns["tags"] = domain.ColumnInfo{Type: "custom", DbType: "character varying(255)[]"}
+				m.Schema.Columns["range"] = domain.ColumnInfo{Type: "custom", DbType: "int4range"}
+				m.Schema.Columns["amount"] = domain.ColumnInfo{Type: "custom", DbType: "NUMERIC(10, 2)"}
+			}), ""},
+		{"Raw dbType with modifiers", IdentifierConfig{},
+			message(func(m *domain.Message) {
+				m.Schema.Columns["created_at"] = domain.ColumnInfo{Type: "custom", DbType: "timestamp(0) without time zone"}
+			}), ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := &SchemaService{Identifiers: tt.config}
+			err := service.ValidateIdentifiers(tt.message)
+
+			var invalid *InvalidIdentifierError
+			switch {
+			case tt.invalid == "" && err != nil:
+				t.Errorf("Expected no error, got %v", err)
+			case tt.invalid != "" && !errors.As(err, &invalid):
+				t.Errorf("Expected invalid %s, got %v", tt.invalid, err)
+			case tt.invalid != "" && invalid.Kind != tt.invalid:
+				t.Errorf("Expected invalid %s, got invalid %s", tt.invalid, invalid.Kind)
+			}
+		})
+	}
+}
@@ -0,0 +1,273 @@
+package schema_database
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"crm-lead-service/internal/domain"
+	"crm-lead-service/pkg/database"
+)
+
+// indexLockClass первый ключ advisory-блокировок построения индексов. Отличается от
+// schemaLockClass, чтобы долгое построение не блокировало изменение схемы таблицы
+const indexLockClass = 0x5349
+
+// indexDef индекс из схемы сообщения или из БД
+type indexDef struct {
+	name    string
+	columns []string
+	unique  bool
+	// valid false у индекса, построение которого через CONCURRENTLY прервалось
+	valid bool
+}
+
+// backgroundJobs фоновые сверки таблиц (индексы, внешние ключи), которые выполняются
+// вне транзакции сообщения. Общий для всех копий сервиса
+type backgroundJobs struct {
+	mu sync.Mutex
+	// checked хеш определений, уже сверенных с таблицей: ключ сверки -> хеш
+	checked map[string]string
+	// running сверки, которые выполняются сейчас
+	running map[string]bool
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+func newBackgroundJobs() *backgroundJobs {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &backgroundJobs{
+		checked: make(map[string]string),
+		running: make(map[string]bool),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+}
+
+// start отмечает начало сверки. false - определения с этим хешем уже сверены или сверка идет
+func (b *backgroundJobs) start(key, hash string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.checked[key] == hash || b.running[key] {
+		return false
+	}
+	b.running[key] = true
+	b.wg.Add(1)
+	return true
+}
+
+// finish завершает сверку; checked - определения с этим хешем больше не проверяются
+func (b *backgroundJobs) finish(key, hash string, checked bool) {
+	b.mu.Lock()
+	delete(b.running, key)
+	if checked {
+		b.checked[key] = hash
+	}
+	b.mu.Unlock()
+	b.wg.Done()
+}
+
+// run выполняет сверку в фоне, если определения с этим хешем еще не сверены
+func (b *backgroundJobs) run(key, hash string, job func() (bool, error)) {
+	if !b.start(key, hash) {
+		return
+	}
+
+	go func() {
+		checked, err := job()
+		if err != nil {
+			log.Printf("Error in background check %s: %v", key, err)
+		}
+		b.finish(key, hash, checked)
+	}()
+}
+
+// close прерывает фоновые сверки и ждет их завершения
+func (b *backgroundJobs) close() {
+	b.cancel()
+	b.wg.Wait()
+}
+
+// indexName имя индекса в БД: имена индексов уникальны в схеме PostgreSQL,
+// поэтому к имени из сообщения добавляется имя таблицы. Длинные имена сокращаются с хешем
+func indexName(table TableRef, name string) string {
+	return shortIdentifier(table.Name + "_" + name)
+}
+
+// desiredIndexes возвращает индексы из схемы сообщения в порядке имен
+func desiredIndexes(table TableRef, schema domain.Schema) []indexDef {
+	var indexes []indexDef
+	for name, columns := range schema.UniqueKeys {
+		indexes = append(indexes, indexDef{name: indexName(table, name), columns: columns, unique: true, valid: true})
+	}
+	for name, columns := range schema.Indexes {
+		indexes = append(indexes, indexDef{name: indexName(table, name), columns: columns, valid: true})
+	}
+	sort.Slice(indexes, func(i, j int) bool {
+		return indexes[i].name < indexes[j].name
+	})
+	return indexes
+}
+
+// indexesHash возвращает хеш индексов схемы сообщения
+func indexesHash(indexes []indexDef) string {
+	hash := sha256.New()
+	for _, index := range indexes {
+		fmt.Fprintf(hash, "%s|%t|%s\n", index.name, index.unique, strings.Join(index.columns, ","))
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// parseIndexColumns извлекает колонки из определения индекса (pg_indexes.indexdef):
+// CREATE INDEX name ON schema.table USING btree (a, "B")
+func parseIndexColumns(definition string) []string {
+	open := strings.LastIndex(definition, "(")
+	closing := strings.LastIndex(definition, ")")
+	if open < 0 || closing < open {
+		return nil
+	}
+
+	var columns []string
+	for _, column := range strings.Split(definition[open+1:closing], ",") {
+		column = strings.TrimSpace(column)
+		if strings.HasPrefix(column, `"`) && strings.HasSuffix(column, `"`) && len(column) >= 2 {
+			column = strings.ReplaceAll(column[1:len(column)-1], `""`, `"`)
+		}
+		columns = append(columns, column)
+	}
+	return columns
+}
+
+// getIndexes читает индексы таблицы из pg_indexes
+func (s *SchemaService) getIndexes(table TableRef) (map[string]indexDef, error) {
+	query := `
+		SELECT ix.indexname, ix.indexdef, i.indisunique, i.indisvalid
+		FROM pg_indexes ix
+		JOIN pg_namespace n ON n.nspname = ix.schemaname
+		JOIN pg_class c ON c.relname = ix.indexname AND c.relnamespace = n.oid
+		JOIN pg_index i ON i.indexrelid = c.oid
+		WHERE ix.schemaname = $1 AND ix.tablename = $2
+	`
+
+	rows, err := s.db.Query(query, table.Schema, table.Name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query indexes: %w", err)
+	}
+	defer rows.Close()
+
+	indexes := make(map[string]indexDef)
+	for rows.Next() {
+		var (
+			index      indexDef
+			definition string
+		)
+		if err := rows.Scan(&index.name, &definition, &index.unique, &index.valid); err != nil {
+			return nil, fmt.Errorf("failed to scan index: %w", err)
+		}
+		index.columns = parseIndexColumns(definition)
+		indexes[index.name] = index
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows iteration error: %w", err)
+	}
+
+	return indexes, nil
+}
+
+// indexStatements возвращает DDL, приводящий индексы таблицы к схеме сообщения. Индексы,
+// которых нет в сообщении, не удаляются: их могли создать вручную для запросов к реплике.
+// Измененный или недостроенный индекс пересоздается
+func indexStatements(table TableRef, desired []indexDef, current map[string]indexDef) []string {
+	var statements []string
+	for _, index := range desired {
+		existing, exists := current[index.name]
+		if exists && existing.valid && existing.unique == index.unique && slices.Equal(existing.columns, index.columns) {
+			continue
+		}
+		if exists {
+			statements = append(statements, fmt.Sprintf(`DROP INDEX CONCURRENTLY IF EXISTS %s.%s`, QuoteIdentifier(table.Schema), QuoteIdentifier(index.name)))
+		}
+
+		unique := ""
+		if index.unique {
+			unique = "UNIQUE "
+		}
+		statements = append(statements, fmt.Sprintf(`CREATE %sINDEX CONCURRENTLY IF NOT EXISTS %s ON %s (%s)`,
+			unique, QuoteIdentifier(index.name), table.Quoted(), quoteIdentifiers(index.columns)))
+	}
+	return statements
+}
+
+// EnsureIndexes сверяет индексы таблицы с indexes и uniqueKeys схемы сообщения в фоне.
+// CREATE INDEX CONCURRENTLY нельзя выполнить в транзакции, поэтому вызывается после коммита
+// данных и не задерживает обработку сообщений. Индексы одной схемы сверяются один раз
+func (s *SchemaService) EnsureIndexes(schema domain.Schema) {
+	if s.jobs == nil || (len(schema.Indexes) == 0 && len(schema.UniqueKeys) == 0) {
+		return
+	}
+
+	table := s.Table(schema)
+	desired := desiredIndexes(table, schema)
+	s.jobs.run("indexes:"+table.String(), indexesHash(desired), func() (bool, error) {
+		return s.forSchema(schema).buildIndexes(table, desired)
+	})
+}
+
+// buildIndexes строит недостающие индексы на отдельном соединении под сессионной
+// advisory-блокировкой таблицы: индекс строит одна реплика. Возвращает false, если
+// индексы не сверены и их нужно проверить снова (блокировку держит другая реплика, сервис остановлен)
+func (s *SchemaService) buildIndexes(table TableRef, desired []indexDef) (bool, error) {
+	ctx := s.jobs.ctx
+	conn, err := s.pool.Conn(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to get connection: %w", err)
+	}
+	defer conn.Close()
+
+	var locked bool
+	query := `SELECT pg_try_advisory_lock($1, hashtext($2))`
+	if err := conn.QueryRowContext(ctx, query, indexLockClass, table.String()).Scan(&locked); err != nil {
+		return false, fmt.Errorf("failed to lock indexes: %w", err)
+	}
+	if !locked {
+		return false, nil
+	}
+	defer conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1, hashtext($2))`, indexLockClass, table.String())
+
+	builder := *s
+	builder.db = database.BindContext(ctx, conn)
+	builder.ddlTables = nil
+
+	current, err := builder.getIndexes(table)
+	if err != nil {
+		return false, err
+	}
+
+	for _, statement := range indexStatements(table, desired, current) {
+		if s.Mode == SchemaModePlan {
+			log.Printf("Index change pending approval: Table=%s, Statement=%s", table, statement)
+			if err := builder.recordPlannedDDL(table, statement); err != nil {
+				return false, err
+			}
+			continue
+		}
+
+		log.Printf("Building index: Table=%s, Statement=%s", table, statement)
+		if err := builder.execDDL(table, statement); err != nil {
+			// Повтор на каждом сообщении снова просканирует таблицу: индекс с дубликатами
+			// в данных пересоздается после перезапуска или изменения схемы индексов
+			return ctx.Err() == nil, fmt.Errorf("failed to build index: %w", err)
+		}
+	}
+
+	return true, nil
+}
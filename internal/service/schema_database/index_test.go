@@ -0,0 +1,115 @@
+package schema_database
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"crm-lead-service/internal/domain"
+)
+
+// TestIndexStatements проверяет сверку индексов схемы сообщения с индексами таблицы
+func TestIndexStatements(t *testing.T) {
+	table := TableRef{Schema: "crm", Name: "leads"}
+	desired := desiredIndexes(table, domain.Schema{
+		Indexes:    map[string][]string{"status": {"status", "created_at"}},
+		UniqueKeys: map[string][]string{"email": {"email"}},
+	})
+
+	create := []string{
+		`CREATE UNIQUE INDEX CONCURRENTLY IF NOT EXISTS "leads_email" ON "crm"."leads" ("email")`,
+		`CREATE INDEX CONCURRENTLY IF NOT EXISTS "leads_status" ON "crm"."leads" ("status", "created_at")`,
+	}
+
+	tests := []struct {
+		name     string
+		current  map[string]indexDef
+		expected []string
+	}{
+		{"Missing indexes", nil, create},
+		{
+			"Indexes up to date",
+			map[string]indexDef{
+				"leads_email":  {name: "leads_email", columns: []string{"email"}, unique: true, valid: true},
+				"leads_status": {name: "leads_status", columns: []string{"status", "created_at"}, valid: true},
+				"leads_manual": {name: "leads_manual", columns: []string{"phone"}, valid: true},
+			},
+			nil,
+		},
+		{
+			"Changed and invalid indexes are rebuilt",
+			map[string]indexDef{
+				"leads_email":  {name: "leads_email", columns: []string{"email"}, unique: true, valid: false},
+				"leads_status": {name: "leads_status", columns: []string{"status"}, valid: true},
+			},
+			[]string{
+				`DROP INDEX CONCURRENTLY IF EXISTS "crm"."leads_email"`,
+				create[0],
+				`DROP INDEX CONCURRENTLY IF EXISTS "crm"."leads_status"`,
+				create[1],
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := indexStatements(table, desired, tt.current); !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("Expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+// TestParseIndexColumns проверяет разбор колонок из pg_indexes.indexdef
+func TestParseIndexColumns(t *testing.T) {
+	definition := `CREATE UNIQUE INDEX leads_email ON crm.leads USING btree (email, "Created At")`
+	expected := []string{"email", "Created At"}
+
+	if got := parseIndexColumns(definition); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+}
+
+// TestIndexName проверяет, что имя индекса уникально в схеме и не длиннее идентификатора PostgreSQL
+func TestIndexName(t *testing.T) {
+	table := TableRef{Schema: "public", Name: "leads"}
+	if got := indexName(table, "email"); got != "leads_email" {
+		t.Errorf("Expected leads_email, got %s", got)
+	}
+
+	long := indexName(table, strings.Repeat("a", 70))
+	if len(long) != maxIdentifierLength {
+		t.Errorf("Expected name of %d bytes, got %d", maxIdentifierLength, len(long))
+	}
+	if long == indexName(table, strings.Repeat("a", 71)) {
+		t.Error("Expected different long names to stay different")
+	}
+
+	multibyte := indexName(table, "a"+strings.Repeat("я", 40))
+	if len(multibyte) > maxIdentifierLength || !utf8.ValidString(multibyte) {
+		t.Errorf("Expected valid name of at most %d bytes, got %q", maxIdentifierLength, multibyte)
+	}
+}
+
+// TestBackgroundJobs проверяет, что определения одной схемы сверяются один раз
+func TestBackgroundJobs(t *testing.T) {
+	builder := newBackgroundJobs()
+
+	if !builder.start("public.leads", "v1") {
+		t.Fatal("Expected first check to start")
+	}
+	if builder.start("public.leads", "v1") {
+		t.Error("Expected running check not to start twice")
+	}
+	builder.finish("public.leads", "v1", true)
+
+	if builder.start("public.leads", "v1") {
+		t.Error("Expected checked indexes not to be checked again")
+	}
+	if !builder.start("public.leads", "v2") {
+		t.Error("Expected changed indexes to be checked")
+	}
+	builder.finish("public.leads", "v2", false)
+	builder.close()
+}
@@ -0,0 +1,131 @@
+package schema_database
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"crm-lead-service/internal/domain"
+)
+
+// journalTableName таблица журнала DDL, выполненных сервисом
+const journalTableName = "_sdr_schema_migrations"
+
+// journalTable возвращает таблицу журнала в схеме по умолчанию
+func (s *SchemaService) journalTable() TableRef {
+	return TableRef{Schema: s.defaultNamespace(), Name: journalTableName}
+}
+
+// EnsureJournal создает таблицу журнала DDL, если ее нет
+func (s *SchemaService) EnsureJournal(ctx context.Context, db *sql.DB) error {
+	table := s.journalTable()
+	return ensureServiceTable(ctx, db, table,
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+			"id" BIGSERIAL PRIMARY KEY,
+			"table_schema" TEXT NOT NULL,
+			"table_name" TEXT NOT NULL,
+			"statement" TEXT NOT NULL,
+			"schema_hash" TEXT NOT NULL,
+			"applied_at" TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			"instance" TEXT NOT NULL,
+			"status" TEXT NOT NULL DEFAULT 'applied'
+		)`, table.Quoted()),
+		// Журналы, созданные до появления режима plan
+		fmt.Sprintf(`ALTER TABLE %s ADD COLUMN IF NOT EXISTS "status" TEXT NOT NULL DEFAULT 'applied'`, table.Quoted()),
+	)
+}
+
+// ensureServiceTable создает служебную таблицу сервиса запросами queries. Реплики,
+// запущенные одновременно, создают ее по очереди под advisory-блокировкой
+func ensureServiceTable(ctx context.Context, db *sql.DB, table TableRef, queries ...string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1, hashtext($2))`, schemaLockClass, table.String())
+	if err != nil {
+		return fmt.Errorf("failed to lock table %s: %w", table, err)
+	}
+
+	// Схему по умолчанию создаем только если ее нет, см. ensureNamespace
+	var namespaceExists bool
+	query := `SELECT EXISTS (SELECT FROM pg_namespace WHERE nspname = $1)`
+	if err := tx.QueryRowContext(ctx, query, table.Schema).Scan(&namespaceExists); err != nil {
+		return fmt.Errorf("failed to check schema existence: %w", err)
+	}
+
+	if !namespaceExists {
+		queries = append([]string{fmt.Sprintf(`CREATE SCHEMA IF NOT EXISTS %s`, QuoteIdentifier(table.Schema))}, queries...)
+	}
+	for _, query := range queries {
+		if _, err := tx.ExecContext(ctx, query); err != nil {
+			return fmt.Errorf("failed to create table %s: %w", table, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// forSchema возвращает копию сервиса, записывающую DDL в журнал с хешем схемы сообщения
+func (s *SchemaService) forSchema(schema domain.Schema) *SchemaService {
+	service := *s
+	service.schemaHash = schemaHash(schema)
+	return &service
+}
+
+// schemaHash возвращает SHA-256 схемы сообщения, по которой выполнен DDL
+func schemaHash(schema domain.Schema) string {
+	data, err := json.Marshal(schema)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// recordDDL записывает выполненный DDL в журнал. Запись идет в той же транзакции,
+// поэтому при откате DDL пропадает и запись о нем
+func (s *SchemaService) recordDDL(table TableRef, statement string) error {
+	query := fmt.Sprintf(
+		`INSERT INTO %s ("table_schema", "table_name", "statement", "schema_hash", "instance", "status")
+		VALUES ($1, $2, $3, $4, $5, $6)`,
+		s.journalTable().Quoted(),
+	)
+
+	_, err := s.db.Exec(query, table.Schema, table.Name, statement, s.schemaHash, s.Instance, journalStatusApplied)
+	if err != nil {
+		return fmt.Errorf("failed to record schema change: %w", err)
+	}
+
+	return nil
+}
+
+// recordPlannedDDL записывает запланированный DDL в журнал вне транзакции сообщения.
+// Одинаковый запрос для таблицы записывается один раз, сколько бы сообщений его ни ждало
+func (s *SchemaService) recordPlannedDDL(table TableRef, statement string) error {
+	query := fmt.Sprintf(
+		`INSERT INTO %[1]s ("table_schema", "table_name", "statement", "schema_hash", "instance", "status")
+		SELECT $1, $2, $3, $4, $5, $6
+		WHERE NOT EXISTS (
+			SELECT 1 FROM %[1]s
+			WHERE "table_schema" = $1 AND "table_name" = $2 AND "statement" = $3 AND "status" = $6
+		)`,
+		s.journalTable().Quoted(),
+	)
+
+	_, err := s.pool.Exec(query, table.Schema, table.Name, statement, s.schemaHash, s.Instance, journalStatusPlanned)
+	if err != nil {
+		return fmt.Errorf("failed to record planned schema change: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,34 @@
+package schema_database
+
+import (
+	"testing"
+
+	"crm-lead-service/internal/domain"
+)
+
+// TestSchemaHash проверяет, что хеш схемы стабилен и меняется вместе со схемой
+func TestSchemaHash(t *testing.T) {
+	schema := domain.Schema{
+		TableName: "leads",
+		Columns:   map[string]domain.ColumnInfo{"id": {Name: "id", DbType: "INT"}},
+	}
+	changed := domain.Schema{
+		TableName: "leads",
+		Columns:   map[string]domain.ColumnInfo{"id": {Name: "id", DbType: "BIGINT"}},
+	}
+
+	if schemaHash(schema) != schemaHash(schema) {
+		t.Error("Expected stable hash for the same schema")
+	}
+	if schemaHash(schema) == schemaHash(changed) {
+		t.Error("Expected different hash for changed schema")
+	}
+	if got := len(schemaHash(schema)); got != 64 {
+		t.Errorf("Expected SHA-256 hex digest, got %d chars", got)
+	}
+
+	service := &SchemaService{Namespace: NamespaceConfig{Default: "sync"}}
+	if got := service.journalTable(); got != (TableRef{Schema: "sync", Name: journalTableName}) {
+		t.Errorf("Expected journal in default schema, got %v", got)
+	}
+}
@@ -0,0 +1,88 @@
+package schema_database
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"strings"
+
+	"crm-lead-service/internal/domain"
+)
+
+type SchemaMode string
+
+const (
+	// SchemaModeApply изменения схемы выполняются сразу при обработке сообщения
+	SchemaModeApply SchemaMode = "apply"
+	// SchemaModePlan изменения схемы только вычисляются и записываются в журнал,
+	// а сообщение откладывается до их ручного применения
+	SchemaModePlan SchemaMode = "plan"
+)
+
+const (
+	journalStatusApplied = "applied"
+	journalStatusPlanned = "planned"
+)
+
+// planMetrics счетчики режима plan, доступны через expvar по /debug/vars
+var (
+	planMetrics       = expvar.NewMap("schema_plan")
+	planTablesMetrics = expvar.NewMap("schema_plan_tables")
+)
+
+// SchemaChangePendingError изменение схемы, которое в режиме plan не выполнено
+// и ждет ручного применения. Сообщение, вызвавшее его, нужно отложить
+type SchemaChangePendingError struct {
+	Table      string
+	Statements []string
+}
+
+func (e *SchemaChangePendingError) Error() string {
+	return fmt.Sprintf("schema change for table %s is pending approval: %s",
+		e.Table, strings.Join(e.Statements, "; "))
+}
+
+// planning сообщает, что сервис собирает DDL в план вместо выполнения
+func (s *SchemaService) planning() bool {
+	return s.plan != nil
+}
+
+// Plan возвращает DDL, которым CreateTable или ApplyDiff привели бы таблицу к схеме
+// сообщения, не выполняя его. Для существующей таблицы нужен diff из CompareSchemas
+func (s *SchemaService) Plan(schema domain.Schema, exists bool, diff *SchemaDiff) ([]string, error) {
+	planner := *s
+	planner.plan = &[]string{}
+
+	var err error
+	if !exists {
+		err = planner.CreateTable(schema)
+	} else {
+		err = planner.ApplyDiff(schema, diff)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return *planner.plan, nil
+}
+
+// ReportPlan выводит план в лог, учитывает его в метриках и записывает в журнал
+// со статусом planned. Запись идет мимо транзакции сообщения, которая будет откачена.
+// Возвращает SchemaChangePendingError для отложенного сообщения
+func (s *SchemaService) ReportPlan(schema domain.Schema, statements []string) error {
+	s = s.forSchema(schema)
+	table := s.Table(schema)
+
+	for _, statement := range statements {
+		log.Printf("Schema change pending approval: Table=%s, Statement=%s", table, statement)
+		if err := s.recordPlannedDDL(table, statement); err != nil {
+			return err
+		}
+	}
+
+	planMetrics.Add("pending_changes", 1)
+	planMetrics.Add("statements", int64(len(statements)))
+	planTablesMetrics.Add(table.String(), 1)
+
+	return &SchemaChangePendingError{Table: table.String(), Statements: statements}
+}
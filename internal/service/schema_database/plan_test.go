@@ -0,0 +1,44 @@
+package schema_database
+
+import (
+	"reflect"
+	"testing"
+
+	"crm-lead-service/internal/domain"
+)
+
+// TestPlan проверяет, что план содержит DDL в порядке применения и не требует соединения с БД
+func TestPlan(t *testing.T) {
+	service := &SchemaService{}
+	schema := domain.Schema{
+		TableName: "leads",
+		Columns: map[string]domain.ColumnInfo{
+			"phone": {Name: "phone", Type: "string", AllowNull: true},
+		},
+	}
+	diff := &SchemaDiff{
+		MissingColumns:     []string{"phone"},
+		TypeChanges:        []TypeChange{{Column: "amount", From: "INTEGER", To: "BIGINT"}},
+		NullabilityChanges: []NullabilityChange{{Column: "status", Backfill: "'new'"}},
+	}
+
+	statements, err := service.Plan(schema, true, diff)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	expected := []string{
+		`ALTER TABLE "public"."leads" ADD COLUMN IF NOT EXISTS "phone" TEXT NULL`,
+		`ALTER TABLE "public"."leads" ALTER COLUMN "amount" TYPE BIGINT USING "amount"::BIGINT`,
+		`UPDATE "public"."leads" SET "status" = 'new' WHERE "status" IS NULL`,
+		`ALTER TABLE "public"."leads" ALTER COLUMN "status" SET NOT NULL`,
+	}
+	if !reflect.DeepEqual(statements, expected) {
+		t.Errorf("Expected %q, got %q", expected, statements)
+	}
+
+	if service.planning() {
+		t.Error("Expected Plan to leave the service in apply mode")
+	}
+
+}
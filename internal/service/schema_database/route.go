@@ -0,0 +1,151 @@
+package schema_database
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"crm-lead-service/internal/domain"
+)
+
+// TableRoute правило выбора таблицы для tableName из сообщения
+type TableRoute struct {
+	// Source приложение-источник сообщения, пусто - любое
+	Source string `json:"source"`
+	// Match имя таблицы из сообщения: точное имя, префикс со звездочкой в конце ("crm_*", "*")
+	// или регулярное выражение между косыми чертами ("/^app1_(.+)$/")
+	Match string `json:"match"`
+	// Table таблица в БД, можно со схемой ("crm.leads"). "*" заменяется частью имени после
+	// префикса, "$1" - группой регулярного выражения
+	Table string `json:"table"`
+	// Exclude сообщения таблицы не записываются
+	Exclude bool `json:"exclude"`
+
+	regex *regexp.Regexp
+}
+
+// LoadRoutes читает файл правил вида [{"match": "lead", "table": "crm.leads"}, {"match": "*", "table": "raw_*"}].
+// Правила проверяются по порядку, применяется первое подходящее
+func LoadRoutes(path string) ([]TableRoute, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read routes file: %w", err)
+	}
+
+	var routes []TableRoute
+	if err := json.Unmarshal(data, &routes); err != nil {
+		return nil, fmt.Errorf("failed to parse routes file: %w", err)
+	}
+
+	for i := range routes {
+		if err := routes[i].compile(); err != nil {
+			return nil, fmt.Errorf("invalid route %q: %w", routes[i].Match, err)
+		}
+	}
+
+	return routes, nil
+}
+
+// compile проверяет правило и компилирует регулярное выражение
+func (r *TableRoute) compile() error {
+	switch {
+	case r.Match == "":
+		return fmt.Errorf("match is required")
+	case !r.Exclude && r.Table == "":
+		return fmt.Errorf("table is required unless the route excludes tables")
+	}
+
+	if len(r.Match) > 1 && strings.HasPrefix(r.Match, "/") && strings.HasSuffix(r.Match, "/") {
+		regex, err := regexp.Compile(r.Match[1 : len(r.Match)-1])
+		if err != nil {
+			return err
+		}
+		r.regex = regex
+		return nil
+	}
+
+	if strings.Contains(strings.TrimSuffix(r.Match, "*"), "*") {
+		return fmt.Errorf("only a trailing * is supported, use a regular expression")
+	}
+	return nil
+}
+
+// apply возвращает таблицу для tableName, если правило подходит
+func (r TableRoute) apply(source, tableName string) (string, bool) {
+	if r.Source != "" && r.Source != source {
+		return "", false
+	}
+
+	if r.regex != nil {
+		match := r.regex.FindStringSubmatchIndex(tableName)
+		if match == nil {
+			return "", false
+		}
+		return string(r.regex.ExpandString(nil, r.Table, tableName, match)), true
+	}
+
+	if prefix, found := strings.CutSuffix(r.Match, "*"); found {
+		rest, matched := strings.CutPrefix(tableName, prefix)
+		if !matched {
+			return "", false
+		}
+		return strings.ReplaceAll(r.Table, "*", rest), true
+	}
+
+	if r.Match != tableName {
+		return "", false
+	}
+	return r.Table, true
+}
+
+// route возвращает имя таблицы в БД по первому подходящему правилу, без подходящего
+// правила имя не меняется. excluded - сообщения таблицы не записываются
+func (s *SchemaService) route(source, tableName string) (name string, excluded bool) {
+	for _, route := range s.Routes {
+		if target, matched := route.apply(source, tableName); matched {
+			return target, route.Exclude
+		}
+	}
+	return tableName, false
+}
+
+// Route возвращает копию сообщения с таблицей, выбранной правилами маршрутизации:
+// tableName и schemaName (если правило задает схему) заменяются на таблицу в БД, родительские
+// таблицы внешних ключей выбираются теми же правилами, внешние ключи на исключенные таблицы
+// отбрасываются. Дальше сообщение обрабатывается
+// уже с этими именами. excluded - сообщение не нужно записывать
+func (s *SchemaService) Route(message *domain.Message) (*domain.Message, bool) {
+	if len(s.Routes) == 0 {
+		return message, false
+	}
+
+	name, excluded := s.route(message.Source, message.Schema.TableName)
+	if excluded {
+		return message, true
+	}
+
+	routed := *message
+	routed.Schema.TableName = name
+	if namespace, table, found := strings.Cut(name, "."); found {
+		routed.Schema.SchemaName, routed.Schema.TableName = namespace, table
+	}
+
+	if len(message.Schema.ForeignKeys) > 0 {
+		routed.Schema.ForeignKeys = make(map[string]domain.ForeignKey, len(message.Schema.ForeignKeys))
+		for keyName, key := range message.Schema.ForeignKeys {
+			if !strings.Contains(key.RefTable, ".") {
+				var parentExcluded bool
+				key.RefTable, parentExcluded = s.route(message.Source, key.RefTable)
+				if parentExcluded {
+					// Родительская таблица не записывается, ссылаться не на что
+					continue
+				}
+			}
+			routed.Schema.ForeignKeys[keyName] = key
+		}
+	}
+
+	return &routed, false
+}
@@ -0,0 +1,104 @@
+package schema_database
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"crm-lead-service/internal/domain"
+)
+
+// TestRoute проверяет выбор таблицы правилами маршрутизации
+func TestRoute(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "routes.json")
+	content := `[
+		{"match": "lead", "table": "crm.leads"},
+		{"source": "billing", "match": "*", "table": "billing.*"},
+		{"match": "/^app1_(\\w+)_v2$/", "table": "app1_$1"},
+		{"match": "tmp_*", "exclude": true},
+		{"match": "*", "table": "raw_*"}
+	]`
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	routes, err := LoadRoutes(path)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	service := &SchemaService{Routes: routes, Namespace: NamespaceConfig{Default: "sync"}}
+
+	tests := []struct {
+		name     string
+		source   string
+		table    string
+		expected TableRef
+		excluded bool
+	}{
+		{"Exact rule with schema", "", "lead", TableRef{Schema: "crm", Name: "leads"}, false},
+		{"Rule for source", "billing", "invoices", TableRef{Schema: "billing", Name: "invoices"}, false},
+		{"Regular expression", "", "app1_users_v2", TableRef{Schema: "sync", Name: "app1_users"}, false},
+		{"Excluded prefix", "", "tmp_import", TableRef{}, true},
+		{"Catch-all prefix", "", "users", TableRef{Schema: "sync", Name: "raw_users"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			message := &domain.Message{Source: tt.source, Schema: domain.Schema{TableName: tt.table}}
+			routed, excluded := service.Route(message)
+			if excluded != tt.excluded {
+				t.Fatalf("Expected excluded %t, got %t", tt.excluded, excluded)
+			}
+			if excluded {
+				return
+			}
+			if got := service.Table(routed.Schema); got != tt.expected {
+				t.Errorf("Expected %v, got %v", tt.expected, got)
+			}
+			if message.Schema.TableName != tt.table {
+				t.Errorf("Expected original message to stay unchanged, got %s", message.Schema.TableName)
+			}
+		})
+	}
+
+	routed, _ := service.Route(&domain.Message{Schema: domain.Schema{
+		TableName: "contacts",
+		ForeignKeys: map[string]domain.ForeignKey{
+			"lead":   {Columns: []string{"lead_id"}, RefTable: "lead", RefColumns: []string{"id"}},
+			"import": {Columns: []string{"import_id"}, RefTable: "tmp_import", RefColumns: []string{"id"}},
+		},
+	}})
+	if got := routed.Schema.ForeignKeys["lead"].RefTable; got != "crm.leads" {
+		t.Errorf("Expected foreign key to reference crm.leads, got %s", got)
+	}
+	if _, exists := routed.Schema.ForeignKeys["import"]; exists {
+		t.Error("Expected foreign key to excluded table to be dropped")
+	}
+	if err := service.ValidateIdentifiers(routed); err != nil {
+		t.Errorf("Expected routed message to pass validation, got %v", err)
+	}
+}
+
+// TestLoadRoutesInvalid проверяет отклонение некорректных правил
+func TestLoadRoutesInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"Missing table", `[{"match": "lead"}]`},
+		{"Star in the middle", `[{"match": "crm_*_log", "table": "logs"}]`},
+		{"Invalid regular expression", `[{"match": "/(lead/", "table": "leads"}]`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "routes.json")
+			if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := LoadRoutes(path); err == nil {
+				t.Error("Expected error, got nil")
+			}
+		})
+	}
+}
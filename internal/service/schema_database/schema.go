@@ -1,36 +1,215 @@
 package schema_database
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"sort"
 	"strings"
 
 	"crm-lead-service/internal/domain"
+	"crm-lead-service/pkg/database"
+
+	"github.com/lib/pq"
 )
 
+type Config struct {
+	// Mode выполнять изменения схемы или только планировать их, по умолчанию SchemaModeApply
+	Mode SchemaMode
+	// Instance имя экземпляра консьюмера для журнала DDL
+	Instance string
+	// ForeignKeys создавать внешние ключи из схемы сообщения или только записывать их,
+	// по умолчанию ForeignKeysRecord
+	ForeignKeys ForeignKeyMode
+	Identifiers IdentifierConfig
+	// Routes правила выбора таблицы для tableName из сообщения
+	Routes       []TableRoute
+	Namespace    NamespaceConfig
+	SoftDelete   SoftDeleteConfig
+	ColumnPolicy ColumnPolicyConfig
+	Cache        CacheConfig
+}
+
+// SchemaDiff расхождения между схемой сообщения и таблицей в БД
+type SchemaDiff struct {
+	RenamedColumns     []ColumnRename
+	MissingColumns     []string
+	TypeChanges        []TypeChange
+	DefaultChanges     []DefaultChange
+	NullabilityChanges []NullabilityChange
+	EnumChanges        []EnumChange
+	// AutoIncrementColumns колонки первичного ключа, которые нужно сделать автоинкрементными
+	AutoIncrementColumns []string
+	CommentChanges       []CommentChange
+	DroppedColumns       []DroppedColumn
+	RestoredColumns      []string
+}
+
+// IsEmpty сообщает, что таблица уже соответствует схеме сообщения
+func (d *SchemaDiff) IsEmpty() bool {
+	return len(d.RenamedColumns) == 0 && len(d.MissingColumns) == 0 && len(d.TypeChanges) == 0 &&
+		len(d.DefaultChanges) == 0 && len(d.NullabilityChanges) == 0 &&
+		len(d.EnumChanges) == 0 && len(d.CommentChanges) == 0 && len(d.AutoIncrementColumns) == 0 &&
+		len(d.DroppedColumns) == 0 && len(d.RestoredColumns) == 0
+}
+
 type SchemaService struct {
-	db *sql.DB
+	db database.Querier
+	// pool пул соединений для записей, которые должны пережить откат транзакции сообщения
+	pool         *sql.DB
+	Mode         SchemaMode
+	Instance     string
+	ForeignKeys  ForeignKeyMode
+	Identifiers  IdentifierConfig
+	Routes       []TableRoute
+	Namespace    NamespaceConfig
+	SoftDelete   SoftDeleteConfig
+	ColumnPolicy ColumnPolicyConfig
+	// cache общий для всех копий сервиса, nil - кеш выключен
+	cache *schemaCache
+	jobs  *backgroundJobs
+	// sightings общий для всех копий сервиса, см. ObserveSchema
+	sightings     *columnSightings
+	sequences     *sequenceCache
+	keptNullable  *keptNullableColumns
+	notifyChannel string
+	listener      *pq.Listener
+	// ddlTables таблицы, измененные в текущей транзакции: их схема не кешируется до коммита
+	ddlTables map[string]bool
+	// schemaHash хеш схемы сообщения, по которой выполняется DDL (см. forSchema)
+	schemaHash string
+	// plan собирает DDL вместо выполнения, nil - DDL выполняется (см. Plan)
+	plan *[]string
 }
 
-func NewSchemaService(db *sql.DB) *SchemaService {
-	return &SchemaService{db: db}
+func NewSchemaService(db *sql.DB, config Config) *SchemaService {
+	return &SchemaService{
+		db:            db,
+		pool:          db,
+		Mode:          config.Mode,
+		Instance:      config.Instance,
+		ForeignKeys:   config.ForeignKeys,
+		Identifiers:   config.Identifiers,
+		Routes:        config.Routes,
+		Namespace:     config.Namespace,
+		SoftDelete:    config.SoftDelete,
+		ColumnPolicy:  config.ColumnPolicy,
+		cache:         newSchemaCache(config.Cache),
+		jobs:          newBackgroundJobs(),
+		sightings:     newColumnSightings(),
+		sequences:     newSequenceCache(),
+		keptNullable:  newKeptNullableColumns(),
+		notifyChannel: config.Cache.NotifyChannel,
+	}
+}
+
+// WithTx возвращает копию сервиса, выполняющую все запросы в транзакции tx с контекстом ctx
+func (s *SchemaService) WithTx(ctx context.Context, tx *sql.Tx) *SchemaService {
+	txService := *s
+	txService.db = database.BindContext(ctx, tx)
+	txService.ddlTables = make(map[string]bool)
+	return &txService
+}
+
+// execDDL выполняет DDL над таблицей, записывает его в журнал и сбрасывает кеш таблицы,
+// в том числе при ошибке: ошибка могла быть вызвана устаревшим кешем. Другие реплики
+// получают уведомление через NOTIFY, которое PostgreSQL доставит только после коммита транзакции
+func (s *SchemaService) execDDL(table TableRef, query string) error {
+	if s.planning() {
+		*s.plan = append(*s.plan, query)
+		return nil
+	}
+
+	_, err := s.db.Exec(query)
+	s.invalidateTable(table.String())
+	if err != nil {
+		return err
+	}
+
+	if err := s.recordDDL(table, query); err != nil {
+		return err
+	}
+
+	if s.ddlTables != nil {
+		s.ddlTables[table.String()] = true
+	}
+
+	if s.cache != nil && s.notifyChannel != "" {
+		if _, err := s.db.Exec(`SELECT pg_notify($1, $2)`, s.notifyChannel, table.String()); err != nil {
+			return fmt.Errorf("failed to notify schema change: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// schemaLockClass первый ключ advisory-блокировок изменения схемы, отделяет их
+// от других advisory-блокировок в той же базе
+const schemaLockClass = 0x5344
+
+// LockTable берет advisory-блокировку изменения схемы таблицы до конца транзакции.
+// Реплики, одновременно увидевшие новую таблицу или колонку, меняют схему по очереди
+func (s *SchemaService) LockTable(table TableRef) error {
+	_, err := s.db.Exec(`SELECT pg_advisory_xact_lock($1, hashtext($2))`, schemaLockClass, table.String())
+	if err != nil {
+		return fmt.Errorf("failed to lock table %s schema: %w", table, err)
+	}
+	return nil
+}
+
+// describeTable возвращает колонки таблицы из кеша или из БД. exists=false - таблицы нет
+func (s *SchemaService) describeTable(table TableRef) (map[string]domain.ColumnInfo, bool, error) {
+	if columns, ok := s.cache.get(table.String()); ok {
+		return columns, true, nil
+	}
+
+	exists, err := s.TableExists(table)
+	if err != nil || !exists {
+		return nil, false, err
+	}
+
+	columns, err := s.GetTableColumns(table)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Схему, измененную в незакоммиченной транзакции, не видят другие воркеры
+	if !s.ddlTables[table.String()] {
+		s.cache.set(table.String(), columns)
+	}
+
+	return columns, true, nil
 }
 
 // GetTableColumns получает информацию о колонках таблицы из БД
-func (s *SchemaService) GetTableColumns(tableName string) (map[string]domain.ColumnInfo, error) {
+func (s *SchemaService) GetTableColumns(table TableRef) (map[string]domain.ColumnInfo, error) {
 	query := `
 		SELECT 
 			column_name,
 			data_type,
 			is_nullable,
 			column_default,
-			character_maximum_length
+			character_maximum_length,
+			numeric_precision,
+			numeric_scale,
+			udt_name,
+			is_identity,
+			col_description(
+				(quote_ident(table_schema) || '.' || quote_ident(table_name))::regclass,
+				ordinal_position
+			)
 		FROM information_schema.columns
-		WHERE table_name = $1
+		WHERE table_schema = $1 AND table_name = $2
 		ORDER BY ordinal_position
 	`
 
-	rows, err := s.db.Query(query, tableName)
+	// Ограничения читаем до колонок: в транзакции нельзя держать два открытых результата
+	enums, err := s.getEnumValues(table)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.Query(query, table.Schema, table.Name)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query columns: %w", err)
 	}
@@ -44,24 +223,55 @@ func (s *SchemaService) GetTableColumns(tableName string) (map[string]domain.Col
 			isNullable string
 			colDefault sql.NullString
 			maxLength  sql.NullInt64
+			precision  sql.NullInt64
+			scale      sql.NullInt64
+			udtName    string
+			isIdentity string
+			comment    sql.NullString
 		)
 
-		if err := rows.Scan(&columnName, &dataType, &isNullable, &colDefault, &maxLength); err != nil {
+		if err := rows.Scan(&columnName, &dataType, &isNullable, &colDefault, &maxLength,
+			&precision, &scale, &udtName, &isIdentity, &comment); err != nil {
 			return nil, fmt.Errorf("failed to scan column: %w", err)
 		}
 
-		var size *int
-		if maxLength.Valid {
-			s := int(maxLength.Int64)
-			size = &s
-		}
-
-		columns[columnName] = domain.ColumnInfo{
+		column := domain.ColumnInfo{
 			Name:      columnName,
 			DbType:    dataType,
 			AllowNull: isNullable == "YES",
-			Size:      size,
+			Size:      nullIntPtr(maxLength),
+		}
+		if constraint, exists := columnEnumConstraint(enums, columnName); exists {
+			column.EnumValues = enums[constraint]
 		}
+
+		if comment.Valid {
+			column.Comment = &comment.String
+		}
+
+		// Выражение по умолчанию в том же виде, что и в схеме сообщения
+		if colDefault.Valid {
+			column.DefaultValue = map[string]interface{}{"expression": colDefault.String}
+		}
+
+		// Автоинкремент: identity или serial (значение из последовательности)
+		column.AutoIncrement = isIdentity == "YES" ||
+			(colDefault.Valid && strings.HasPrefix(colDefault.String, "nextval("))
+
+		// Точность и масштаб имеют смысл только для numeric: для целых типов
+		// information_schema возвращает двоичную разрядность
+		if dataType == "numeric" {
+			column.Precision = nullIntPtr(precision)
+			column.Scale = nullIntPtr(scale)
+		}
+
+		// Для массивов data_type равен ARRAY, тип элемента - udt_name с префиксом "_"
+		if dataType == "ARRAY" {
+			column.DbType = strings.TrimPrefix(udtName, "_")
+			column.Dimension = 1
+		}
+
+		columns[columnName] = column
 	}
 
 	if err := rows.Err(); err != nil {
@@ -71,16 +281,21 @@ func (s *SchemaService) GetTableColumns(tableName string) (map[string]domain.Col
 	return columns, nil
 }
 
-func (s *SchemaService) TableExists(tableName string) (bool, error) {
+// TableExists проверяет существование таблицы. Таблица из кеша существует без запроса к БД
+func (s *SchemaService) TableExists(table TableRef) (bool, error) {
+	if _, ok := s.cache.get(table.String()); ok {
+		return true, nil
+	}
+
 	query := `
 		SELECT EXISTS (
 			SELECT FROM information_schema.tables 
-			WHERE table_name = $1
+			WHERE table_schema = $1 AND table_name = $2
 		)
 	`
 
 	var exists bool
-	err := s.db.QueryRow(query, tableName).Scan(&exists)
+	err := s.db.QueryRow(query, table.Schema, table.Name).Scan(&exists)
 	if err != nil {
 		return false, fmt.Errorf("failed to check table existence: %w", err)
 	}
@@ -88,56 +303,263 @@ func (s *SchemaService) TableExists(tableName string) (bool, error) {
 	return exists, nil
 }
 
-func (s *SchemaService) CompareSchemas(messageSchema domain.Schema) (bool, []string, error) {
-	tableName := messageSchema.TableName
+// CompareSchemas сравнивает схему сообщения с таблицей в БД: ищет недостающие колонки
+// и колонки, тип, NOT NULL или значение по умолчанию которых отличаются от ожидаемых. Если смена типа не является
+// безопасным расширением, возвращает *SchemaConflictError
+func (s *SchemaService) CompareSchemas(messageSchema domain.Schema) (*SchemaDiff, error) {
+	table := s.Table(messageSchema)
+	diff := &SchemaDiff{}
 
-	exists, err := s.TableExists(tableName)
+	dbColumns, exists, err := s.describeTable(table)
 	if err != nil {
-		return false, nil, err
+		return nil, err
 	}
 
 	if !exists {
-		return false, nil, nil
+		return diff, nil
 	}
 
-	dbColumns, err := s.GetTableColumns(tableName)
-	if err != nil {
-		return false, nil, err
+	renames := s.columnRenames(messageSchema)
+	renamedFrom := make(map[string]bool)
+
+	for columnName, column := range messageSchema.Columns {
+		dbColumn, exists := dbColumns[columnName]
+		if !exists {
+			// Колонка переименована в источнике: переименовываем старую вместо добавления пустой
+			oldName, renamed := renames[columnName]
+			oldColumn, oldExists := dbColumns[oldName]
+			if !renamed || !oldExists {
+				diff.MissingColumns = append(diff.MissingColumns, columnName)
+				continue
+			}
+			diff.RenamedColumns = append(diff.RenamedColumns, ColumnRename{
+				From: oldName,
+				To:   columnName,
+				Enum: len(oldColumn.EnumValues) > 0,
+			})
+			renamedFrom[oldName] = true
+			dbColumn = oldColumn
+			dbColumn.Name = columnName
+		}
+
+		if !deprecatedAt(dbColumn.Comment).IsZero() {
+			diff.RestoredColumns = append(diff.RestoredColumns, columnName)
+		}
+
+		change, err := s.compareColumnType(table, column, dbColumn)
+		if err != nil {
+			return nil, err
+		}
+		if change != nil {
+			diff.TypeChanges = append(diff.TypeChanges, *change)
+		}
+
+		defaultChange, nullabilityChange := s.compareColumnConstraints(messageSchema, column, dbColumn)
+		if defaultChange != nil {
+			diff.DefaultChanges = append(diff.DefaultChanges, *defaultChange)
+		}
+		if nullabilityChange != nil && !s.skipNullability(table, *nullabilityChange) {
+			diff.NullabilityChanges = append(diff.NullabilityChanges, *nullabilityChange)
+		}
+		if enumChange := compareEnumValues(column, dbColumn); enumChange != nil {
+			diff.EnumChanges = append(diff.EnumChanges, *enumChange)
+		}
+		if commentChange := compareColumnComment(column, dbColumn); commentChange != nil {
+			diff.CommentChanges = append(diff.CommentChanges, *commentChange)
+		}
+		if column.AutoIncrement && !dbColumn.AutoIncrement && isKeyColumn(messageSchema, columnName) &&
+			isIntegerType(s.mapTypeToPostgres(column)) {
+			diff.AutoIncrementColumns = append(diff.AutoIncrementColumns, columnName)
+		}
+	}
+
+	// Служебная колонка мягкого удаления, если ее нет в схеме сообщения
+	if s.hasOwnSoftDeleteColumn(messageSchema) {
+		if _, exists := dbColumns[s.SoftDelete.Column]; !exists {
+			diff.MissingColumns = append(diff.MissingColumns, s.SoftDelete.Column)
+		}
+	}
+
+	// Колонки, которых больше нет в схеме сообщения
+	if s.ColumnPolicy.Dropped == DroppedColumnDrop || s.ColumnPolicy.Dropped == DroppedColumnDeprecate {
+		for columnName, dbColumn := range dbColumns {
+			_, inMessage := messageSchema.Columns[columnName]
+			if inMessage || renamedFrom[columnName] || isKeyColumn(messageSchema, columnName) ||
+				(columnName == s.SoftDelete.Column && s.SoftDelete.Enabled(table.Name)) {
+				continue
+			}
+			dropped := DroppedColumn{
+				Name:         columnName,
+				AllowNull:    dbColumn.AllowNull,
+				DeprecatedAt: deprecatedAt(dbColumn.Comment),
+			}
+			if s.droppedColumnPending(dropped) && s.columnMissingLongEnough(table, columnName) {
+				diff.DroppedColumns = append(diff.DroppedColumns, dropped)
+			}
+		}
+	}
+
+	return diff, nil
+}
+
+// compareColumnType сравнивает тип колонки в БД с типом из схемы сообщения.
+// Неизвестные типы не сравниваются. Колонка, тип которой совпадает с прежними правилами
+// сопоставления (legacyType), не меняется: иначе после обновления сервиса первое же
+// сообщение переписывало бы таблицу (ALTER COLUMN TYPE), хотя схема источника не менялась
+func (s *SchemaService) compareColumnType(table TableRef, column, dbColumn domain.ColumnInfo) (*TypeChange, error) {
+	desired, ok := parsePgType(s.mapTypeToPostgres(column))
+	if !ok {
+		return nil, nil
+	}
+	current, ok := dbColumnType(dbColumn)
+	if !ok {
+		return nil, nil
 	}
 
-	var missingColumns []string
-	for columnName := range messageSchema.Columns {
-		if _, exists := dbColumns[columnName]; !exists {
-			missingColumns = append(missingColumns, columnName)
+	changed, reason := compareTypes(current, desired)
+	if !changed {
+		return nil, nil
+	}
+	if legacy, ok := parsePgType(legacyType(column)); ok {
+		if legacyChanged, _ := compareTypes(current, legacy); !legacyChanged {
+			return nil, nil
+		}
+	}
+	if reason != "" {
+		return nil, &SchemaConflictError{
+			Table:   table.String(),
+			Column:  dbColumn.Name,
+			Current: current.String(),
+			Desired: desired.String(),
+			Reason:  reason,
 		}
 	}
 
-	isEqual := len(missingColumns) == 0
-	return isEqual, missingColumns, nil
+	return &TypeChange{Column: dbColumn.Name, From: current.String(), To: desired.String()}, nil
+}
+
+// ApplyDiff приводит таблицу к схеме сообщения. Значения по умолчанию меняются
+// до NOT NULL, чтобы заполнить существующие NULL новым значением
+func (s *SchemaService) ApplyDiff(schema domain.Schema, diff *SchemaDiff) error {
+	s = s.forSchema(schema)
+	table := s.Table(schema)
+
+	if len(diff.RenamedColumns) > 0 {
+		if err := s.RenameColumns(table, diff.RenamedColumns); err != nil {
+			return err
+		}
+	}
+	if len(diff.MissingColumns) > 0 {
+		if err := s.AddColumns(table, schema.Columns, diff.MissingColumns); err != nil {
+			return err
+		}
+	}
+	if len(diff.TypeChanges) > 0 {
+		if err := s.AlterColumnTypes(table, diff.TypeChanges); err != nil {
+			return err
+		}
+	}
+	if len(diff.DefaultChanges) > 0 {
+		if err := s.AlterColumnDefaults(table, diff.DefaultChanges); err != nil {
+			return err
+		}
+	}
+	if len(diff.NullabilityChanges) > 0 {
+		if err := s.AlterColumnNullability(table, diff.NullabilityChanges); err != nil {
+			return err
+		}
+	}
+	if len(diff.EnumChanges) > 0 {
+		if err := s.AlterColumnEnums(table, diff.EnumChanges); err != nil {
+			return err
+		}
+	}
+	if len(diff.AutoIncrementColumns) > 0 {
+		if err := s.AlterAutoIncrement(table, schema, diff.AutoIncrementColumns); err != nil {
+			return err
+		}
+	}
+	if len(diff.RestoredColumns) > 0 {
+		if err := s.RestoreColumns(table, diff.RestoredColumns); err != nil {
+			return err
+		}
+	}
+	if len(diff.CommentChanges) > 0 {
+		if err := s.AlterColumnComments(table, diff.CommentChanges); err != nil {
+			return err
+		}
+	}
+	if len(diff.DroppedColumns) > 0 {
+		return s.HandleDroppedColumns(table, diff.DroppedColumns)
+	}
+
+	return nil
+}
+
+// AlterColumnTypes расширяет типы колонок
+func (s *SchemaService) AlterColumnTypes(table TableRef, changes []TypeChange) error {
+	for _, change := range changes {
+		query := fmt.Sprintf(`ALTER TABLE %s ALTER COLUMN %s TYPE %s USING %s::%s`,
+			table.Quoted(), QuoteIdentifier(change.Column), change.To, QuoteIdentifier(change.Column), change.To)
+
+		if err := s.execDDL(table, query); err != nil {
+			return fmt.Errorf("failed to change type of column %s from %s to %s: %w",
+				change.Column, change.From, change.To, err)
+		}
+	}
+
+	return nil
 }
 
 // AddColumns добавляет недостающие колонки в таблицу
-func (s *SchemaService) AddColumns(tableName string, columns map[string]domain.ColumnInfo, missingColumns []string) error {
+func (s *SchemaService) AddColumns(table TableRef, columns map[string]domain.ColumnInfo, missingColumns []string) error {
 	for _, columnName := range missingColumns {
 		column, exists := columns[columnName]
 		if !exists {
+			if columnName == s.SoftDelete.Column && s.SoftDelete.Enabled(table.Name) {
+				if err := s.addSoftDeleteColumn(table); err != nil {
+					return err
+				}
+			}
 			continue
 		}
 
 		columnType := s.mapTypeToPostgres(column)
+		defaultValue := columnDefault(column, columnType)
+
+		// NOT NULL колонка без значения по умолчанию не добавится в непустую таблицу:
+		// добавляем ее nullable и устанавливаем ограничение, если в таблице нет строк
 		nullable := "NULL"
-		if !column.AllowNull {
+		if !column.AllowNull && defaultValue != "" {
 			nullable = "NOT NULL"
 		}
 
 		// Экранируем имена таблицы и колонки в двойные кавычки
-		query := fmt.Sprintf(`ALTER TABLE "%s" ADD COLUMN IF NOT EXISTS "%s" %s %s`,
-			tableName, columnName, columnType, nullable)
+		query := fmt.Sprintf(`ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s %s %s`,
+			table.Quoted(), QuoteIdentifier(columnName), columnType, nullable)
+		if defaultValue != "" {
+			query += fmt.Sprintf(" DEFAULT %s", defaultValue)
+		}
+		if len(column.EnumValues) > 0 {
+			query += " " + enumCheck(columnName, column.EnumValues)
+		}
 
-		_, err := s.db.Exec(query)
+		err := s.execDDL(table, query)
 		if err != nil {
 			return fmt.Errorf("failed to add column %s: %w", columnName, err)
 		}
+
+		if comment := columnComment(column); comment != "" {
+			if err := s.execDDL(table, commentQuery(table, columnName, comment)); err != nil {
+				return fmt.Errorf("failed to comment column %s: %w", columnName, err)
+			}
+		}
+
+		if !column.AllowNull && defaultValue == "" {
+			if err := s.AlterColumnNullability(table, []NullabilityChange{{Column: columnName}}); err != nil {
+				return err
+			}
+		}
 	}
 
 	return nil
@@ -145,9 +567,25 @@ func (s *SchemaService) AddColumns(tableName string, columns map[string]domain.C
 
 // CreateTable создает таблицу на основе схемы из сообщения
 func (s *SchemaService) CreateTable(schema domain.Schema) error {
+	s = s.forSchema(schema)
+	table := s.Table(schema)
+	if err := s.ensureNamespace(table); err != nil {
+		return err
+	}
+
+	// Колонки в порядке имен, чтобы DDL одной схемы всегда совпадал
+	columnNames := make([]string, 0, len(schema.Columns))
+	for columnName := range schema.Columns {
+		columnNames = append(columnNames, columnName)
+	}
+	sort.Strings(columnNames)
+
 	var columnDefs []string
+	// sequences именованные последовательности автоинкрементных колонок: колонка -> последовательность
+	sequences := make(map[string]TableRef)
 
-	for columnName, column := range schema.Columns {
+	for _, columnName := range columnNames {
+		column := schema.Columns[columnName]
 		columnType := s.mapTypeToPostgres(column)
 		nullable := "NULL"
 		if !column.AllowNull {
@@ -155,44 +593,150 @@ func (s *SchemaService) CreateTable(schema domain.Schema) error {
 		}
 
 		// Экранируем имя колонки в двойные кавычки для защиты от зарезервированных слов
-		def := fmt.Sprintf(`"%s" %s %s`, columnName, columnType, nullable)
-
-		if column.DefaultValue != nil {
-			defaultVal := formatDefaultValue(column.DefaultValue)
-			if defaultVal != "" {
-				def += fmt.Sprintf(" DEFAULT %s", defaultVal)
+		def := fmt.Sprintf(`%s %s %s`, QuoteIdentifier(columnName), columnType, nullable)
+
+		// Для NOT NULL колонок без explicit default используется значение по типу
+		defaultValue := columnDefault(column, columnType)
+
+		// Автоинкрементный ключ: значения из именованной последовательности или identity
+		if column.AutoIncrement && isKeyColumn(schema, columnName) {
+			if sequence, named := sequenceRef(table, column); named {
+				sequences[columnName] = sequence
+				defaultValue = sequenceDefault(sequence)
+			} else if isIntegerType(columnType) {
+				def += " GENERATED BY DEFAULT AS IDENTITY"
+				defaultValue = ""
 			}
-		} else if !column.AllowNull {
-			// Добавляем дефолтное значение для NOT NULL колонок без explicit default
-			def += getDefaultForType(columnType)
+		}
+
+		if defaultValue != "" {
+			def += fmt.Sprintf(" DEFAULT %s", defaultValue)
+		}
+		if len(column.EnumValues) > 0 {
+			def += " " + enumCheck(columnName, column.EnumValues)
 		}
 
 		columnDefs = append(columnDefs, def)
 	}
 
+	if s.hasOwnSoftDeleteColumn(schema) {
+		columnDefs = append(columnDefs, s.SoftDelete.ColumnDefinition())
+	}
+
 	// Добавляем PRIMARY KEY с экранированными именами колонок
 	if len(schema.PrimaryKey) > 0 {
 		quotedPK := make([]string, len(schema.PrimaryKey))
 		for i, pk := range schema.PrimaryKey {
-			quotedPK[i] = fmt.Sprintf(`"%s"`, pk)
+			quotedPK[i] = QuoteIdentifier(pk)
 		}
 		pkDef := fmt.Sprintf("PRIMARY KEY (%s)", strings.Join(quotedPK, ", "))
 		columnDefs = append(columnDefs, pkDef)
 	}
 
-	query := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS "%s" (%s)`,
-		schema.TableName, strings.Join(columnDefs, ", "))
+	for _, columnName := range columnNames {
+		if sequence, exists := sequences[columnName]; exists {
+			query := fmt.Sprintf(`CREATE SEQUENCE IF NOT EXISTS %s`, sequence.Quoted())
+			if err := s.execDDL(table, query); err != nil {
+				return fmt.Errorf("failed to create sequence %s: %w", sequence, err)
+			}
+		}
+	}
 
-	_, err := s.db.Exec(query)
+	query := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (%s)`,
+		table.Quoted(), strings.Join(columnDefs, ", "))
+
+	err := s.execDDL(table, query)
 	if err != nil {
 		return fmt.Errorf("failed to create table: %w", err)
 	}
 
+	for _, columnName := range columnNames {
+		if sequence, exists := sequences[columnName]; exists {
+			query := fmt.Sprintf(`ALTER SEQUENCE %s OWNED BY %s.%s`, sequence.Quoted(), table.Quoted(), QuoteIdentifier(columnName))
+			if err := s.execDDL(table, query); err != nil {
+				return fmt.Errorf("failed to attach sequence %s: %w", sequence, err)
+			}
+		}
+	}
+
+	for _, columnName := range columnNames {
+		if comment := columnComment(schema.Columns[columnName]); comment != "" {
+			if err := s.execDDL(table, commentQuery(table, columnName, comment)); err != nil {
+				return fmt.Errorf("failed to comment column %s: %w", columnName, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// hasOwnSoftDeleteColumn сообщает, нужно ли управлять колонкой мягкого удаления для таблицы:
+// режим включен и колонка с таким именем не пришла в схеме сообщения
+func (s *SchemaService) hasOwnSoftDeleteColumn(schema domain.Schema) bool {
+	if !s.SoftDelete.Enabled(schema.TableName) {
+		return false
+	}
+	_, inMessage := schema.Columns[s.SoftDelete.Column]
+	return !inMessage
+}
+
+// addSoftDeleteColumn добавляет служебную колонку мягкого удаления
+func (s *SchemaService) addSoftDeleteColumn(table TableRef) error {
+	query := fmt.Sprintf(`ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s`,
+		table.Quoted(), s.SoftDelete.ColumnDefinition())
+
+	err := s.execDDL(table, query)
+	if err != nil {
+		return fmt.Errorf("failed to add soft delete column %s: %w", s.SoftDelete.Column, err)
+	}
+
 	return nil
 }
 
-// getDefaultForType возвращает дефолтное значение для типа данных
+// nullIntPtr возвращает указатель на значение или nil для NULL
+func nullIntPtr(value sql.NullInt64) *int {
+	if !value.Valid {
+		return nil
+	}
+	result := int(value.Int64)
+	return &result
+}
+
+// getDefaultForType возвращает дефолтное значение для типа данных. Тип сравнивается
+// по имени после разбора, иначе POINT или INT4RANGE получили бы DEFAULT 0
 func getDefaultForType(columnType string) string {
+	if strings.HasSuffix(strings.TrimSpace(columnType), "[]") {
+		return " DEFAULT '{}'"
+	}
+
+	parsed, ok := parsePgType(columnType)
+	if !ok {
+		return ""
+	}
+	switch parsed.name {
+	case "smallint", "integer", "bigint", "numeric", "real", "double precision":
+		return " DEFAULT 0"
+	case "boolean":
+		return " DEFAULT false"
+	case "varchar", "char", "text":
+		return " DEFAULT ''"
+	case "timestamp", "timestamptz":
+		return " DEFAULT CURRENT_TIMESTAMP"
+	case "date":
+		return " DEFAULT CURRENT_DATE"
+	case "json", "jsonb":
+		return " DEFAULT '{}'"
+	case "interval":
+		// Так PostgreSQL хранит нулевой интервал в column_default
+		return " DEFAULT '00:00:00'"
+	default:
+		return ""
+	}
+}
+
+// legacyDefaultForType возвращает значение по типу, которое давали версии сервиса
+// до разбора типов: имя типа сравнивалось по подстроке
+func legacyDefaultForType(columnType string) string {
 	upperType := strings.ToUpper(columnType)
 	switch {
 	case strings.Contains(upperType, "INT"):
@@ -242,34 +786,3 @@ func formatDefaultValue(value interface{}) string {
 		return fmt.Sprintf("%v", v)
 	}
 }
-
-// mapTypeToPostgres преобразует тип из схемы в тип PostgreSQL
-func (s *SchemaService) mapTypeToPostgres(column domain.ColumnInfo) string {
-	switch column.Type {
-	case "bigint":
-		return "BIGINT"
-	case "integer", "smallint":
-		return strings.ToUpper(column.Type)
-	case "string":
-		if column.Size != nil {
-			return fmt.Sprintf("VARCHAR(%d)", *column.Size)
-		}
-		return "TEXT"
-	case "text":
-		return "TEXT"
-	case "boolean":
-		return "BOOLEAN"
-	case "date":
-		return "DATE"
-	case "timestamp":
-		return "TIMESTAMPTZ"
-	case "double":
-		return "DOUBLE PRECISION"
-	default:
-		// По умолчанию используем dbType
-		if column.DbType != "" {
-			return strings.ToUpper(column.DbType)
-		}
-		return "TEXT"
-	}
-}
@@ -0,0 +1,209 @@
+package schema_database
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"crm-lead-service/internal/domain"
+)
+
+// AutoIncrementColumn возвращает автоинкрементную колонку первичного ключа схемы
+func AutoIncrementColumn(schema domain.Schema) (string, bool) {
+	for _, pk := range schema.PrimaryKey {
+		if column, exists := schema.Columns[pk]; exists && column.AutoIncrement {
+			return pk, true
+		}
+	}
+	return "", false
+}
+
+// sequenceRef возвращает именованную последовательность колонки. Имя без схемы
+// относится к схеме таблицы
+func sequenceRef(table TableRef, column domain.ColumnInfo) (TableRef, bool) {
+	if column.SequenceName == nil || *column.SequenceName == "" {
+		return TableRef{}, false
+	}
+	if namespace, name, found := strings.Cut(*column.SequenceName, "."); found {
+		return TableRef{Schema: namespace, Name: name}, true
+	}
+	return TableRef{Schema: table.Schema, Name: *column.SequenceName}, true
+}
+
+// sequenceDefault возвращает значение по умолчанию колонки из последовательности
+func sequenceDefault(sequence TableRef) string {
+	return fmt.Sprintf("nextval(%s::regclass)", formatDefaultValue(sequence.Quoted()))
+}
+
+// isIntegerType сообщает, что колонку этого типа можно сделать identity
+func isIntegerType(sqlType string) bool {
+	parsed, ok := parsePgType(sqlType)
+	return ok && !parsed.array && integerRank[parsed.name] > 0
+}
+
+// AlterAutoIncrement делает существующие колонки первичного ключа автоинкрементными:
+// identity или значение по умолчанию из именованной последовательности. Последовательность
+// сдвигается за максимальное значение колонки, чтобы локальные вставки не конфликтовали с реплицированными
+func (s *SchemaService) AlterAutoIncrement(table TableRef, schema domain.Schema, columns []string) error {
+	for _, columnName := range columns {
+		column := schema.Columns[columnName]
+
+		queries := []string{
+			fmt.Sprintf(`ALTER TABLE %s ALTER COLUMN %s DROP DEFAULT`, table.Quoted(), QuoteIdentifier(columnName)),
+		}
+		if sequence, named := sequenceRef(table, column); named {
+			queries = append(queries,
+				fmt.Sprintf(`CREATE SEQUENCE IF NOT EXISTS %s`, sequence.Quoted()),
+				fmt.Sprintf(`ALTER TABLE %s ALTER COLUMN %s SET DEFAULT %s`,
+					table.Quoted(), QuoteIdentifier(columnName), sequenceDefault(sequence)),
+				fmt.Sprintf(`ALTER SEQUENCE %s OWNED BY %s.%s`, sequence.Quoted(), table.Quoted(), QuoteIdentifier(columnName)),
+			)
+		} else {
+			queries = append(queries, fmt.Sprintf(`ALTER TABLE %s ALTER COLUMN %s ADD GENERATED BY DEFAULT AS IDENTITY`,
+				table.Quoted(), QuoteIdentifier(columnName)))
+		}
+
+		for _, query := range queries {
+			if err := s.execDDL(table, query); err != nil {
+				return fmt.Errorf("failed to make column %s auto increment: %w", columnName, err)
+			}
+		}
+
+		// setval меняет данные последовательности, а не схему, поэтому в журнал DDL не пишется
+		query := fmt.Sprintf(
+			`SELECT setval(pg_get_serial_sequence(%s, %s), COALESCE(MAX(%s), 0) + 1, false) FROM %s`,
+			formatDefaultValue(table.Quoted()), formatDefaultValue(columnName), QuoteIdentifier(columnName), table.Quoted())
+		if s.planning() {
+			*s.plan = append(*s.plan, query)
+		} else if _, err := s.db.Exec(query); err != nil {
+			return fmt.Errorf("failed to advance sequence of column %s: %w", columnName, err)
+		}
+	}
+
+	return nil
+}
+
+// sequenceCacheTTL сколько помнить последовательность колонки или ее отсутствие. Запись
+// сбрасывается вместе с кешем колонок таблицы, TTL нужен для изменений в обход сервиса
+const sequenceCacheTTL = 5 * time.Minute
+
+// cachedSequence последовательность колонки на момент поиска, пустое имя - последовательности нет
+type cachedSequence struct {
+	name     string
+	loadedAt time.Time
+}
+
+// sequenceCache последовательности колонок по имени таблицы, общий для всех копий сервиса.
+// Методы nil-кеша ничего не делают
+type sequenceCache struct {
+	mu     sync.Mutex
+	tables map[string]map[string]cachedSequence
+}
+
+func newSequenceCache() *sequenceCache {
+	return &sequenceCache{tables: make(map[string]map[string]cachedSequence)}
+}
+
+func (c *sequenceCache) get(tableName, column string) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	sequence, ok := c.tables[tableName][column]
+	if !ok || time.Since(sequence.loadedAt) > sequenceCacheTTL {
+		return "", false
+	}
+	return sequence.name, true
+}
+
+func (c *sequenceCache) set(tableName, column, name string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.tables[tableName] == nil {
+		c.tables[tableName] = make(map[string]cachedSequence)
+	}
+	c.tables[tableName][column] = cachedSequence{name: name, loadedAt: time.Now()}
+}
+
+func (c *sequenceCache) invalidate(tableName string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	delete(c.tables, tableName)
+	c.mu.Unlock()
+}
+
+func (c *sequenceCache) clear() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	c.tables = make(map[string]map[string]cachedSequence)
+	c.mu.Unlock()
+}
+
+// serialSequence возвращает последовательность колонки (identity или serial), пустая строка -
+// последовательности нет. Результат кешируется, чтобы вставки в таблицы без последовательности
+// не обращались к каталогу каждый раз
+func (s *SchemaService) serialSequence(table TableRef, column string) (string, error) {
+	if name, ok := s.sequences.get(table.String(), column); ok {
+		return name, nil
+	}
+
+	var name sql.NullString
+	if err := s.db.QueryRow(`SELECT pg_get_serial_sequence($1, $2)`, table.Quoted(), column).Scan(&name); err != nil {
+		return "", fmt.Errorf("failed to find sequence of %s.%s: %w", table, column, err)
+	}
+
+	// Пока транзакция с DDL таблицы не завершена, результат может не пережить откат
+	if !s.ddlTables[table.String()] {
+		s.sequences.set(table.String(), column, name.String)
+	}
+	return name.String, nil
+}
+
+// sequenceLockClass первый ключ advisory-блокировок сдвига последовательностей
+const sequenceLockClass = 0x5351
+
+// AdvanceSequence сдвигает последовательность колонки так, чтобы следующее значение было
+// больше value, и никогда не сдвигает ее назад. После setval(..., false) is_called = false
+// и следующим будет само last_value, поэтому выданным считается last_value - 1.
+// Сравнение и setval выполняются под advisory-блокировкой последовательности до конца
+// транзакции: иначе воркеры и реплики, одновременно прошедшие сравнение, могли бы вызвать
+// setval в обратном порядке. Вызывается после вставки строк с явными значениями ключа
+func (s *SchemaService) AdvanceSequence(table TableRef, column string, value int64) error {
+	sequence, err := s.serialSequence(table, column)
+	if err != nil || sequence == "" {
+		return err
+	}
+
+	if _, err := s.db.Exec(`SELECT pg_advisory_xact_lock($1, hashtext($2))`, sequenceLockClass, sequence); err != nil {
+		return fmt.Errorf("failed to lock sequence of %s.%s: %w", table, column, err)
+	}
+
+	// Имя последовательности из pg_get_serial_sequence уже экранировано
+	query := fmt.Sprintf(`
+		SELECT setval($1::regclass, $2)
+		FROM %s
+		WHERE $2 > CASE WHEN is_called THEN last_value ELSE last_value - 1 END
+	`, sequence)
+
+	if _, err := s.db.Exec(query, sequence, value); err != nil {
+		return fmt.Errorf("failed to advance sequence of %s.%s: %w", table, column, err)
+	}
+
+	return nil
+}
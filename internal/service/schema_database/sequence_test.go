@@ -0,0 +1,68 @@
+package schema_database
+
+import (
+	"reflect"
+	"testing"
+
+	"crm-lead-service/internal/domain"
+)
+
+// TestAlterAutoIncrementPlan проверяет DDL перевода ключа существующей таблицы на identity и последовательность
+func TestAlterAutoIncrementPlan(t *testing.T) {
+	service := &SchemaService{}
+	sequenceName := "leads_id_seq"
+
+	tests := []struct {
+		name     string
+		column   domain.ColumnInfo
+		expected []string
+	}{
+		{
+			"Identity",
+			domain.ColumnInfo{Name: "id", Type: "bigint", AutoIncrement: true},
+			[]string{
+				`ALTER TABLE "public"."leads" ALTER COLUMN "id" DROP DEFAULT`,
+				`ALTER TABLE "public"."leads" ALTER COLUMN "id" ADD GENERATED BY DEFAULT AS IDENTITY`,
+				`SELECT setval(pg_get_serial_sequence('"public"."leads"', 'id'), COALESCE(MAX("id"), 0) + 1, false) FROM "public"."leads"`,
+			},
+		},
+		{
+			"Named sequence",
+			domain.ColumnInfo{Name: "id", Type: "integer", AutoIncrement: true, SequenceName: &sequenceName},
+			[]string{
+				`ALTER TABLE "public"."leads" ALTER COLUMN "id" DROP DEFAULT`,
+				`CREATE SEQUENCE IF NOT EXISTS "public"."leads_id_seq"`,
+				`ALTER TABLE "public"."leads" ALTER COLUMN "id" SET DEFAULT nextval('"public"."leads_id_seq"'::regclass)`,
+				`ALTER SEQUENCE "public"."leads_id_seq" OWNED BY "public"."leads"."id"`,
+				`SELECT setval(pg_get_serial_sequence('"public"."leads"', 'id'), COALESCE(MAX("id"), 0) + 1, false) FROM "public"."leads"`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schema := domain.Schema{
+				TableName:  "leads",
+				Columns:    map[string]domain.ColumnInfo{"id": tt.column},
+				PrimaryKey: []string{"id"},
+			}
+
+			column, ok := AutoIncrementColumn(schema)
+			if !ok || column != "id" {
+				t.Fatalf("Expected id to be auto increment column, got %q", column)
+			}
+
+			statements, err := service.Plan(schema, true, &SchemaDiff{AutoIncrementColumns: []string{"id"}})
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if !reflect.DeepEqual(statements, tt.expected) {
+				t.Errorf("Expected %q, got %q", tt.expected, statements)
+			}
+		})
+	}
+
+	if isIntegerType("NUMERIC(20,0)") || !isIntegerType("BIGINT") {
+		t.Error("Expected only integer types to support identity")
+	}
+}
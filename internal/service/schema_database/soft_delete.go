@@ -0,0 +1,68 @@
+package schema_database
+
+import "fmt"
+
+type SoftDeleteColumnType string
+
+const (
+	// SoftDeleteTimestamp — колонка TIMESTAMPTZ, NULL у живых строк, время удаления у удаленных
+	SoftDeleteTimestamp SoftDeleteColumnType = "timestamp"
+	// SoftDeleteBoolean — колонка BOOLEAN NOT NULL DEFAULT false, true у удаленных строк
+	SoftDeleteBoolean SoftDeleteColumnType = "boolean"
+)
+
+// SoftDeleteConfig настройки мягкого удаления: вместо DELETE строка помечается удаленной
+type SoftDeleteConfig struct {
+	// Global включает мягкое удаление для всех таблиц
+	Global bool
+	// Tables включает мягкое удаление только для перечисленных таблиц
+	Tables map[string]bool
+	// Column имя служебной колонки (deleted_at, is_deleted и т.п.)
+	Column string
+	// ColumnType тип служебной колонки
+	ColumnType SoftDeleteColumnType
+}
+
+// Enabled сообщает, включено ли мягкое удаление для таблицы
+func (c SoftDeleteConfig) Enabled(tableName string) bool {
+	if c.Column == "" {
+		return false
+	}
+	return c.Global || c.Tables[tableName]
+}
+
+// ColumnDefinition возвращает определение служебной колонки для CREATE/ALTER TABLE
+func (c SoftDeleteConfig) ColumnDefinition() string {
+	if c.ColumnType == SoftDeleteBoolean {
+		return fmt.Sprintf(`%s BOOLEAN NOT NULL DEFAULT false`, QuoteIdentifier(c.Column))
+	}
+	return fmt.Sprintf(`%s TIMESTAMPTZ NULL`, QuoteIdentifier(c.Column))
+}
+
+// DeletedValue возвращает SQL-выражение, помечающее строку удаленной
+func (c SoftDeleteConfig) DeletedValue() string {
+	if c.ColumnType == SoftDeleteBoolean {
+		return "true"
+	}
+	return "CURRENT_TIMESTAMP"
+}
+
+// ActiveValue возвращает SQL-выражение, снимающее пометку об удалении
+func (c SoftDeleteConfig) ActiveValue() string {
+	if c.ColumnType == SoftDeleteBoolean {
+		return "false"
+	}
+	return "NULL"
+}
+
+// ActiveCondition возвращает условие "строка не удалена" для колонки с заданным префиксом таблицы
+func (c SoftDeleteConfig) ActiveCondition(tableAlias string) string {
+	column := QuoteIdentifier(c.Column)
+	if tableAlias != "" {
+		column = fmt.Sprintf(`%s.%s`, tableAlias, column)
+	}
+	if c.ColumnType == SoftDeleteBoolean {
+		return fmt.Sprintf("%s = false", column)
+	}
+	return fmt.Sprintf("%s IS NULL", column)
+}
@@ -0,0 +1,102 @@
+package schema_database
+
+import (
+	"fmt"
+	"strings"
+
+	"crm-lead-service/internal/domain"
+)
+
+// defaultNamespace схема PostgreSQL по умолчанию
+const defaultNamespace = "public"
+
+// NamespaceConfig выбор схемы PostgreSQL (namespace), в которой находится таблица
+type NamespaceConfig struct {
+	// Default схема для таблиц без явного выбора
+	Default string
+	// Prefixes схема по префиксу имени таблицы: "crm_" -> "crm". Побеждает самый длинный префикс
+	Prefixes map[string]string
+}
+
+// TableRef таблица в схеме PostgreSQL
+type TableRef struct {
+	Schema string
+	Name   string
+}
+
+// String возвращает имя таблицы для логов и ключей кеша
+func (t TableRef) String() string {
+	return t.Schema + "." + t.Name
+}
+
+// Quoted возвращает полностью квалифицированное экранированное имя для SQL
+func (t TableRef) Quoted() string {
+	return fmt.Sprintf(`%s.%s`, QuoteIdentifier(t.Schema), QuoteIdentifier(t.Name))
+}
+
+// ParseNamespaces разбирает список соответствий префиксов схемам вида "crm_:crm,billing_:billing"
+func ParseNamespaces(value string) (map[string]string, error) {
+	prefixes := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		prefix, namespace, found := strings.Cut(pair, ":")
+		prefix, namespace = strings.TrimSpace(prefix), strings.TrimSpace(namespace)
+		if !found || prefix == "" || namespace == "" {
+			return nil, fmt.Errorf("invalid namespace mapping %q, expected prefix:schema", pair)
+		}
+		prefixes[prefix] = namespace
+	}
+	return prefixes, nil
+}
+
+// Table возвращает таблицу сообщения: схема из сообщения, затем по префиксу имени,
+// затем схема по умолчанию
+func (s *SchemaService) Table(schema domain.Schema) TableRef {
+	table := TableRef{Schema: s.defaultNamespace(), Name: schema.TableName}
+
+	if schema.SchemaName != "" {
+		table.Schema = schema.SchemaName
+		return table
+	}
+
+	longest := 0
+	for prefix, namespace := range s.Namespace.Prefixes {
+		if len(prefix) > longest && strings.HasPrefix(schema.TableName, prefix) {
+			table.Schema = namespace
+			longest = len(prefix)
+		}
+	}
+
+	return table
+}
+
+// defaultNamespace возвращает схему для таблиц без явного выбора
+func (s *SchemaService) defaultNamespace() string {
+	if s.Namespace.Default == "" {
+		return defaultNamespace
+	}
+	return s.Namespace.Default
+}
+
+// ensureNamespace создает схему PostgreSQL, если ее нет. Существование проверяется заранее:
+// CREATE SCHEMA IF NOT EXISTS требует права CREATE на базу даже для существующей схемы
+func (s *SchemaService) ensureNamespace(table TableRef) error {
+	var exists bool
+	query := `SELECT EXISTS (SELECT FROM pg_namespace WHERE nspname = $1)`
+	if err := s.db.QueryRow(query, table.Schema).Scan(&exists); err != nil {
+		return fmt.Errorf("failed to check schema existence: %w", err)
+	}
+	if exists {
+		return nil
+	}
+
+	query = fmt.Sprintf(`CREATE SCHEMA IF NOT EXISTS %s`, QuoteIdentifier(table.Schema))
+	if err := s.execDDL(table, query); err != nil {
+		return fmt.Errorf("failed to create schema %s: %w", table.Schema, err)
+	}
+
+	return nil
+}
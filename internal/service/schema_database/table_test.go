@@ -0,0 +1,47 @@
+package schema_database
+
+import (
+	"testing"
+
+	"crm-lead-service/internal/domain"
+)
+
+// TestTable проверяет выбор схемы PostgreSQL для таблицы сообщения
+func TestTable(t *testing.T) {
+	prefixes, err := ParseNamespaces("crm_:crm, crm_archive_:archive")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	service := &SchemaService{Namespace: NamespaceConfig{Default: "sync", Prefixes: prefixes}}
+
+	tests := []struct {
+		name     string
+		schema   domain.Schema
+		expected TableRef
+	}{
+		{"Default schema", domain.Schema{TableName: "users"}, TableRef{Schema: "sync", Name: "users"}},
+		{"Prefix mapping", domain.Schema{TableName: "crm_leads"}, TableRef{Schema: "crm", Name: "crm_leads"}},
+		{"Longest prefix wins", domain.Schema{TableName: "crm_archive_leads"}, TableRef{Schema: "archive", Name: "crm_archive_leads"}},
+		{"Message override", domain.Schema{TableName: "crm_leads", SchemaName: "audit"}, TableRef{Schema: "audit", Name: "crm_leads"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := service.Table(tt.schema); got != tt.expected {
+				t.Errorf("Expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+
+	if got := (&SchemaService{}).Table(domain.Schema{TableName: "users"}); got.Schema != "public" {
+		t.Errorf("Expected public schema by default, got %s", got.Schema)
+	}
+
+	if got := (TableRef{Schema: "crm", Name: "leads"}).Quoted(); got != `"crm"."leads"` {
+		t.Errorf("Expected qualified name, got %s", got)
+	}
+
+	if _, err := ParseNamespaces("crm_"); err == nil {
+		t.Error("Expected error for mapping without schema")
+	}
+}
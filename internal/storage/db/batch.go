@@ -0,0 +1,227 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"crm-lead-service/internal/domain"
+	"crm-lead-service/internal/service/schema_database"
+)
+
+// writeGroup подряд идущие сообщения одной таблицы, которые пишутся одной командой
+type writeGroup struct {
+	table       schema_database.TableRef
+	eventType   domain.EventTypeEnum
+	primaryKeys []string
+	columns     []string
+	messages    []*domain.Message
+}
+
+// SaveBatch применяет пачку сообщений в одной транзакции. Сообщения группируются
+// по таблице и типу события, каждая группа пишется многострочной командой.
+// Порядок событий внутри одной таблицы сохраняется. Сообщения таблиц, исключенных
+// правилами маршрутизации, пропускаются
+func (s *Storage) SaveBatch(ctx context.Context, messages []*domain.Message) error {
+	messages, err := s.routeMessages(messages)
+	if err != nil || len(messages) == 0 {
+		return err
+	}
+
+	tx, err := s.Conn.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	txStorage := s.withTx(ctx, tx)
+	defer txStorage.SchemaService.InvalidateChanged()
+
+	if err := txStorage.saveBatch(messages); err != nil {
+		// Ошибка могла быть вызвана устаревшим кешем схемы
+		for _, message := range messages {
+			s.SchemaService.Invalidate(s.SchemaService.Table(message.Schema))
+		}
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	for _, message := range messages {
+		if !message.Redelivered {
+			s.SchemaService.ObserveSchema(message.Schema)
+		}
+		s.SchemaService.EnsureIndexes(message.Schema)
+		s.SchemaService.EnsureForeignKeys(message.Schema)
+	}
+
+	return nil
+}
+
+// routeMessages проверяет имена и выбирает таблицы для сообщений пачки, см. routeMessage.
+// Исключенные сообщения в результат не попадают
+func (s *Storage) routeMessages(messages []*domain.Message) ([]*domain.Message, error) {
+	routed := make([]*domain.Message, 0, len(messages))
+	for _, message := range messages {
+		message, err := s.routeMessage(message)
+		if err != nil {
+			return nil, err
+		}
+		if message != nil {
+			routed = append(routed, message)
+		}
+	}
+	return routed, nil
+}
+
+// saveBatch проверяет схемы и записывает группы сообщений в транзакции хранилища
+func (s *Storage) saveBatch(messages []*domain.Message) error {
+	// Схему проверяем один раз для каждой уникальной схемы в пачке
+	checked := make(map[string]bool)
+	for _, message := range messages {
+		schemaKey, err := json.Marshal(message.Schema)
+		if err != nil {
+			return fmt.Errorf("failed to marshal schema: %w", err)
+		}
+		// Повторно доставленное сообщение проверяется без поиска удаленных колонок, см. forMessage
+		key := fmt.Sprintf("%t:%s", message.Redelivered, schemaKey)
+		if checked[key] {
+			continue
+		}
+		if err := s.forMessage(message).CheckAndUpdateSchema(message.Schema); err != nil {
+			return fmt.Errorf("failed to check/update schema: %w", err)
+		}
+		checked[key] = true
+	}
+
+	encoded := make([]*domain.Message, len(messages))
+	for i, message := range messages {
+		encoded[i] = encodeMessage(message)
+	}
+
+	for _, group := range s.groupMessages(encoded) {
+		if err := s.writeGroup(group); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// groupMessages разбивает пачку на группы. Внутри таблицы соседние сообщения
+// объединяются, только если у них одинаковые тип события, первичный ключ и набор колонок,
+// поэтому относительный порядок событий одной таблицы не меняется
+func (s *Storage) groupMessages(messages []*domain.Message) []*writeGroup {
+	var groups []*writeGroup
+	lastGroup := make(map[schema_database.TableRef]*writeGroup)
+
+	for _, message := range messages {
+		table := s.SchemaService.Table(message.Schema)
+		eventType := s.eventType(message)
+
+		var columns []string
+		if eventType == domain.EventTypeInsert || eventType == domain.EventTypeUpsert {
+			columns, _ = insertValues(message.Data)
+		}
+
+		group := lastGroup[table]
+		if group != nil && group.eventType == eventType && eventType != domain.EventTypeUpdate &&
+			sameColumns(group.primaryKeys, message.Schema.PrimaryKey) && sameColumns(group.columns, columns) {
+			group.messages = append(group.messages, message)
+			continue
+		}
+
+		group = &writeGroup{
+			table:       table,
+			eventType:   eventType,
+			primaryKeys: message.Schema.PrimaryKey,
+			columns:     columns,
+			messages:    []*domain.Message{message},
+		}
+		groups = append(groups, group)
+		lastGroup[table] = group
+	}
+
+	return groups
+}
+
+// writeGroup записывает группу сообщений
+func (s *Storage) writeGroup(group *writeGroup) error {
+	switch group.eventType {
+	case domain.EventTypeInsert, domain.EventTypeUpsert:
+		if len(group.columns) == 0 {
+			return nil
+		}
+		upsert := group.eventType == domain.EventTypeUpsert
+		rows, err := uniqueRows(group, upsert)
+		if err != nil {
+			return err
+		}
+		if err := s.insertRows(group.table, group.columns, rows, group.primaryKeys, upsert); err != nil {
+			return err
+		}
+		return s.advanceSequence(group.table, group.messages[0].Schema, group.messages...)
+	case domain.EventTypeUpdate:
+		for _, message := range group.messages {
+			if err := s.UpdateData(group.table, message.Data, group.primaryKeys); err != nil {
+				return err
+			}
+		}
+		return nil
+	case domain.EventTypeDelete:
+		keys := make([][]interface{}, 0, len(group.messages))
+		for _, message := range group.messages {
+			key, err := primaryKeyValues(message)
+			if err != nil {
+				return err
+			}
+			keys = append(keys, key)
+		}
+		return s.deleteRows(group.table, group.primaryKeys, keys)
+	default:
+		return fmt.Errorf("unknown event type: %s", group.eventType)
+	}
+}
+
+// uniqueRows собирает строки группы, оставляя одну строку на первичный ключ:
+// одна команда ON CONFLICT DO UPDATE не может изменить строку дважды.
+// Для insert побеждает первое событие (как при ON CONFLICT DO NOTHING), для upsert - последнее
+func uniqueRows(group *writeGroup, upsert bool) ([][]interface{}, error) {
+	rows := make([][]interface{}, 0, len(group.messages))
+	if len(group.primaryKeys) == 0 {
+		for _, message := range group.messages {
+			_, values := insertValues(message.Data)
+			rows = append(rows, values)
+		}
+		return rows, nil
+	}
+
+	positions := make(map[string]int)
+	for _, message := range group.messages {
+		key, err := primaryKeyValues(message)
+		if err != nil {
+			return nil, err
+		}
+		keyString := fmt.Sprintf("%v", key)
+
+		_, values := insertValues(message.Data)
+		if i, exists := positions[keyString]; exists {
+			if upsert {
+				rows[i] = values
+			}
+			continue
+		}
+		positions[keyString] = len(rows)
+		rows = append(rows, values)
+	}
+
+	return rows, nil
+}
+
+// sameColumns сравнивает упорядоченные списки колонок
+func sameColumns(a, b []string) bool {
+	return strings.Join(a, "\x00") == strings.Join(b, "\x00")
+}
@@ -0,0 +1,125 @@
+package db
+
+import (
+	"testing"
+
+	"crm-lead-service/internal/domain"
+	"crm-lead-service/internal/service/schema_database"
+)
+
+func newTestMessage(table string, eventType domain.EventTypeEnum, id int, fields ...string) *domain.Message {
+	data := []domain.Fields{{Field: "id", NewValue: id}}
+	for _, field := range fields {
+		data = append(data, domain.Fields{Field: field, NewValue: field + "_value"})
+	}
+	return &domain.Message{
+		EventType: eventType,
+		Data:      data,
+		Schema:    domain.Schema{TableName: table, PrimaryKey: []string{"id"}},
+	}
+}
+
+// TestGroupMessages проверяет группировку пачки по таблице и типу события
+func TestGroupMessages(t *testing.T) {
+	t.Run("Consecutive events of one table are merged", func(t *testing.T) {
+		storage := &Storage{SchemaService: &schema_database.SchemaService{}}
+		groups := storage.groupMessages([]*domain.Message{
+			newTestMessage("users", domain.EventTypeInsert, 1, "email"),
+			newTestMessage("leads", domain.EventTypeInsert, 1, "name"),
+			newTestMessage("users", domain.EventTypeInsert, 2, "email"),
+		})
+
+		if len(groups) != 2 {
+			t.Fatalf("Expected 2 groups, got %d", len(groups))
+		}
+		if groups[0].table.Name != "users" || len(groups[0].messages) != 2 {
+			t.Errorf("Expected users group with 2 messages, got %s with %d", groups[0].table, len(groups[0].messages))
+		}
+	})
+
+	t.Run("Event type change starts a new group", func(t *testing.T) {
+		storage := &Storage{SchemaService: &schema_database.SchemaService{}}
+		groups := storage.groupMessages([]*domain.Message{
+			newTestMessage("users", domain.EventTypeInsert, 1, "email"),
+			newTestMessage("users", domain.EventTypeDelete, 1),
+			newTestMessage("users", domain.EventTypeInsert, 1, "email"),
+		})
+
+		if len(groups) != 3 {
+			t.Fatalf("Expected 3 groups to keep event order, got %d", len(groups))
+		}
+	})
+
+	t.Run("Different column sets are not merged", func(t *testing.T) {
+		storage := &Storage{SchemaService: &schema_database.SchemaService{}}
+		groups := storage.groupMessages([]*domain.Message{
+			newTestMessage("users", domain.EventTypeUpsert, 1, "email"),
+			newTestMessage("users", domain.EventTypeUpsert, 2, "email", "name"),
+		})
+
+		if len(groups) != 2 {
+			t.Fatalf("Expected 2 groups, got %d", len(groups))
+		}
+	})
+
+	t.Run("Updates are never merged", func(t *testing.T) {
+		storage := &Storage{SchemaService: &schema_database.SchemaService{}}
+		groups := storage.groupMessages([]*domain.Message{
+			newTestMessage("users", domain.EventTypeUpdate, 1, "email"),
+			newTestMessage("users", domain.EventTypeUpdate, 2, "email"),
+		})
+
+		if len(groups) != 2 {
+			t.Fatalf("Expected 2 groups, got %d", len(groups))
+		}
+	})
+
+	t.Run("Upsert mode turns inserts and updates into one group", func(t *testing.T) {
+		storage := &Storage{SchemaService: &schema_database.SchemaService{}, Upsert: true}
+		groups := storage.groupMessages([]*domain.Message{
+			newTestMessage("users", domain.EventTypeInsert, 1, "email"),
+			newTestMessage("users", domain.EventTypeUpdate, 2, "email"),
+		})
+
+		if len(groups) != 1 {
+			t.Fatalf("Expected 1 group, got %d", len(groups))
+		}
+		if groups[0].eventType != domain.EventTypeUpsert {
+			t.Errorf("Expected upsert group, got %s", groups[0].eventType)
+		}
+	})
+}
+
+// TestUniqueRows проверяет дедупликацию строк по первичному ключу
+func TestUniqueRows(t *testing.T) {
+	first := newTestMessage("users", domain.EventTypeInsert, 1, "email")
+	second := newTestMessage("users", domain.EventTypeInsert, 1, "email")
+	second.Data[1].NewValue = "second"
+
+	group := &writeGroup{
+		table:       schema_database.TableRef{Schema: "public", Name: "users"},
+		primaryKeys: []string{"id"},
+		columns:     []string{"id", "email"},
+		messages:    []*domain.Message{first, second},
+	}
+
+	t.Run("Insert keeps the first row", func(t *testing.T) {
+		rows, err := uniqueRows(group, false)
+		if err != nil {
+			t.Fatalf("uniqueRows() returned unexpected error: %v", err)
+		}
+		if len(rows) != 1 || rows[0][1] != "email_value" {
+			t.Errorf("Expected first row to win, got %v", rows)
+		}
+	})
+
+	t.Run("Upsert keeps the last row", func(t *testing.T) {
+		rows, err := uniqueRows(group, true)
+		if err != nil {
+			t.Fatalf("uniqueRows() returned unexpected error: %v", err)
+		}
+		if len(rows) != 1 || rows[0][1] != "second" {
+			t.Errorf("Expected last row to win, got %v", rows)
+		}
+	})
+}
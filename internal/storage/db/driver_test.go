@@ -0,0 +1,157 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"crm-lead-service/internal/service/schema_database"
+	"crm-lead-service/pkg/database"
+)
+
+// fakeResponse ответ фейковой БД на запросы, содержащие match
+type fakeResponse struct {
+	match        string
+	columns      []string
+	rows         [][]driver.Value
+	rowsAffected int64
+	err          error
+}
+
+// fakeQuery выполненный запрос
+type fakeQuery struct {
+	query string
+	args  []interface{}
+}
+
+// fakeDB драйвер database/sql для тестов: записывает запросы и отвечает на них
+// первым подходящим ответом. Запросы без ответа изменяют одну строку и ничего не возвращают
+type fakeDB struct {
+	mu        sync.Mutex
+	responses []fakeResponse
+	queries   []fakeQuery
+}
+
+func newFakeDB(t *testing.T, responses ...fakeResponse) (*fakeDB, *sql.DB) {
+	fake := &fakeDB{responses: responses}
+	db := sql.OpenDB(fake)
+	t.Cleanup(func() { db.Close() })
+	return fake, db
+}
+
+// newTestStorage возвращает хранилище поверх фейковой БД
+func newTestStorage(t *testing.T, config Config, responses ...fakeResponse) (*fakeDB, *Storage) {
+	fake, db := newFakeDB(t, responses...)
+	return fake, &Storage{
+		Conn:          &database.ConnectionDatabase{DB: db},
+		SchemaService: schema_database.NewSchemaService(db, config.Schema),
+		Upsert:        config.Upsert,
+		db:            db,
+	}
+}
+
+// executed возвращает выполненные запросы
+func (f *fakeDB) executed() []fakeQuery {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]fakeQuery(nil), f.queries...)
+}
+
+// find возвращает первый выполненный запрос, содержащий match
+func (f *fakeDB) find(match string) (fakeQuery, bool) {
+	for _, query := range f.executed() {
+		if strings.Contains(query.query, match) {
+			return query, true
+		}
+	}
+	return fakeQuery{}, false
+}
+
+func (f *fakeDB) record(query string, args []driver.NamedValue) fakeResponse {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	values := make([]interface{}, len(args))
+	for i, arg := range args {
+		values[i] = arg.Value
+	}
+	f.queries = append(f.queries, fakeQuery{query: query, args: values})
+
+	for _, response := range f.responses {
+		if strings.Contains(query, response.match) {
+			return response
+		}
+	}
+	return fakeResponse{rowsAffected: 1}
+}
+
+func (f *fakeDB) Connect(context.Context) (driver.Conn, error) { return &fakeConn{db: f}, nil }
+func (f *fakeDB) Driver() driver.Driver                        { return fakeDriver{db: f} }
+
+type fakeDriver struct {
+	db *fakeDB
+}
+
+func (d fakeDriver) Open(string) (driver.Conn, error) { return &fakeConn{db: d.db}, nil }
+
+type fakeConn struct {
+	db *fakeDB
+}
+
+func (c *fakeConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("prepared statements are not supported")
+}
+
+func (c *fakeConn) Close() error { return nil }
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	c.db.record("BEGIN", nil)
+	return c, nil
+}
+
+func (c *fakeConn) Commit() error {
+	c.db.record("COMMIT", nil)
+	return nil
+}
+
+func (c *fakeConn) Rollback() error {
+	c.db.record("ROLLBACK", nil)
+	return nil
+}
+
+func (c *fakeConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	response := c.db.record(query, args)
+	if response.err != nil {
+		return nil, response.err
+	}
+	return driver.RowsAffected(response.rowsAffected), nil
+}
+
+func (c *fakeConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	response := c.db.record(query, args)
+	if response.err != nil {
+		return nil, response.err
+	}
+	return &fakeRows{columns: response.columns, rows: response.rows}, nil
+}
+
+type fakeRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.columns }
+func (r *fakeRows) Close() error      { return nil }
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
@@ -1,7 +1,11 @@
 package db
 
 import (
+	"context"
+	"database/sql"
+	"encoding/json"
 	"fmt"
+	"strconv"
 	"strings"
 
 	"crm-lead-service/internal/domain"
@@ -9,42 +13,255 @@ import (
 	"crm-lead-service/pkg/database"
 )
 
+type Config struct {
+	Schema schema_database.Config
+	// Upsert заставляет события insert и update писать через INSERT ... ON CONFLICT DO UPDATE
+	Upsert bool
+}
+
 type Storage struct {
 	Conn          *database.ConnectionDatabase
 	SchemaService *schema_database.SchemaService
+	Upsert        bool
+	// db выполняет запросы: пул соединений или текущая транзакция
+	db database.Querier
 }
 
-func NewStorage(db *database.ConnectionDatabase) (*Storage, error) {
+func NewStorage(db *database.ConnectionDatabase, config Config) (*Storage, error) {
+	schemaService := schema_database.NewSchemaService(db.DB, config.Schema)
+	if err := schemaService.EnsureJournal(context.Background(), db.DB); err != nil {
+		return nil, err
+	}
+	if err := schemaService.EnsureForeignKeyTable(context.Background(), db.DB); err != nil {
+		return nil, err
+	}
+	if db.DSN != "" {
+		schemaService.ListenInvalidations(db.DSN)
+	}
+
 	return &Storage{
 		Conn:          db,
-		SchemaService: schema_database.NewSchemaService(db.DB),
+		SchemaService: schemaService,
+		Upsert:        config.Upsert,
+		db:            db.DB,
 	}, nil
 }
 
-func (s *Storage) SaveMessage(message *domain.Message) error {
-	tableName := message.Schema.TableName
+// Close останавливает фоновые подписки хранилища. Соединение с БД закрывается отдельно
+func (s *Storage) Close() error {
+	return s.SchemaService.Close()
+}
+
+// withTx возвращает копию хранилища, выполняющую все запросы в транзакции tx с контекстом ctx
+func (s *Storage) withTx(ctx context.Context, tx *sql.Tx) *Storage {
+	txStorage := *s
+	txStorage.db = database.BindContext(ctx, tx)
+	txStorage.SchemaService = s.SchemaService.WithTx(ctx, tx)
+	return &txStorage
+}
+
+// SaveMessage применяет сообщение в одной транзакции: проверка таблицы, DDL и запись данных.
+// При ошибке или отмене ctx транзакция откатывается и база остается в состоянии до сообщения.
+// Сообщение таблицы, исключенной правилами маршрутизации, пропускается
+func (s *Storage) SaveMessage(ctx context.Context, message *domain.Message) error {
+	message, err := s.routeMessage(message)
+	if err != nil || message == nil {
+		return err
+	}
+
+	tx, err := s.Conn.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	txStorage := s.withTx(ctx, tx)
+	defer txStorage.SchemaService.InvalidateChanged()
+
+	if err := txStorage.saveMessage(message); err != nil {
+		// Ошибка могла быть вызвана устаревшим кешем схемы
+		s.SchemaService.Invalidate(s.SchemaService.Table(message.Schema))
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	if !message.Redelivered {
+		s.SchemaService.ObserveSchema(message.Schema)
+	}
+	s.SchemaService.EnsureIndexes(message.Schema)
+	s.SchemaService.EnsureForeignKeys(message.Schema)
 
-	if err := s.CheckAndUpdateSchema(message.Schema); err != nil {
+	return nil
+}
+
+// routeMessage проверяет имена из сообщения до того, как они попадут в SQL, и выбирает
+// таблицу правилами маршрутизации. nil - таблица исключена и сообщение не записывается
+func (s *Storage) routeMessage(message *domain.Message) (*domain.Message, error) {
+	routed, excluded := s.SchemaService.Route(message)
+	if excluded {
+		return nil, nil
+	}
+	if err := s.SchemaService.ValidateIdentifiers(message); err != nil {
+		return nil, err
+	}
+	return routed, nil
+}
+
+// Table возвращает таблицу в БД, в которую будет записано сообщение, с учетом правил маршрутизации
+func (s *Storage) Table(message *domain.Message) schema_database.TableRef {
+	routed, _ := s.SchemaService.Route(message)
+	return s.SchemaService.Table(routed.Schema)
+}
+
+// forMessage возвращает хранилище для проверки схемы сообщения: повторно доставленное
+// сообщение не помечает и не удаляет колонки, которых нет в его схеме
+func (s *Storage) forMessage(message *domain.Message) *Storage {
+	if !message.Redelivered {
+		return s
+	}
+	storage := *s
+	storage.SchemaService = s.SchemaService.ForRedelivery()
+	return &storage
+}
+
+func (s *Storage) saveMessage(message *domain.Message) error {
+	message = encodeMessage(message)
+	table := s.SchemaService.Table(message.Schema)
+
+	if err := s.forMessage(message).CheckAndUpdateSchema(message.Schema); err != nil {
 		return fmt.Errorf("failed to check/update schema: %w", err)
 	}
 
 	// Определяем тип операции
-	switch message.EventType {
+	switch s.eventType(message) {
+	case domain.EventTypeUpsert:
+		if err := s.UpsertData(table, message.Data, message.Schema.PrimaryKey); err != nil {
+			return err
+		}
+		return s.advanceSequence(table, message.Schema, message)
 	case domain.EventTypeInsert:
-		return s.InsertData(tableName, message.Data)
+		if err := s.InsertData(table, message.Data, message.Schema.PrimaryKey); err != nil {
+			return err
+		}
+		return s.advanceSequence(table, message.Schema, message)
 	case domain.EventTypeUpdate:
-		return s.UpdateData(tableName, message.Data, message.Schema.PrimaryKey)
+		return s.UpdateData(table, message.Data, message.Schema.PrimaryKey)
+	case domain.EventTypeDelete:
+		return s.DeleteData(table, message)
 	default:
 		return fmt.Errorf("unknown event type: %s", message.EventType)
 	}
 }
 
-// CheckAndUpdateSchema проверяет и обновляет схему таблицы
+// encodeMessage возвращает копию сообщения, значения которой приведены к типам колонок:
+// JSON-объекты и массивы нельзя передать драйверу как есть (см. EncodeValue)
+func encodeMessage(message *domain.Message) *domain.Message {
+	encoded := *message
+	encoded.Data = make([]domain.Fields, len(message.Data))
+	for i, field := range message.Data {
+		column := message.Schema.Columns[field.Field]
+		field.NewValue = schema_database.EncodeValue(column, field.NewValue)
+		field.OldValue = schema_database.EncodeValue(column, field.OldValue)
+		encoded.Data[i] = field
+	}
+	return &encoded
+}
+
+// advanceSequence сдвигает последовательность автоинкрементного ключа за максимальное
+// значение из записанных сообщений, чтобы локальные вставки в реплику не конфликтовали с ними
+func (s *Storage) advanceSequence(table schema_database.TableRef, schema domain.Schema, messages ...*domain.Message) error {
+	column, ok := schema_database.AutoIncrementColumn(schema)
+	if !ok {
+		return nil
+	}
+
+	var maxValue int64
+	found := false
+	for _, message := range messages {
+		value, exists := message.GetFieldValue(column)
+		if !exists {
+			continue
+		}
+		number, ok := int64Value(value)
+		if !ok {
+			continue
+		}
+		if !found || number > maxValue {
+			maxValue = number
+			found = true
+		}
+	}
+	if !found {
+		return nil
+	}
+
+	return s.SchemaService.AdvanceSequence(table, column, maxValue)
+}
+
+// int64Value приводит значение ключа из JSON к целому числу
+func int64Value(value interface{}) (int64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return int64(v), v == float64(int64(v))
+	case int:
+		return int64(v), true
+	case int64:
+		return v, true
+	case json.Number:
+		number, err := v.Int64()
+		return number, err == nil
+	case string:
+		number, err := strconv.ParseInt(v, 10, 64)
+		return number, err == nil
+	default:
+		return 0, false
+	}
+}
+
+// eventType возвращает операцию, которой будет записано сообщение, с учетом режима upsert
+func (s *Storage) eventType(message *domain.Message) domain.EventTypeEnum {
+	switch message.EventType {
+	case domain.EventTypeInsert, domain.EventTypeUpdate:
+		if s.Upsert && len(message.Schema.PrimaryKey) > 0 {
+			return domain.EventTypeUpsert
+		}
+	case domain.EventTypeUpsert:
+		// Без первичного ключа конфликт определить нельзя
+		if len(message.Schema.PrimaryKey) == 0 {
+			return domain.EventTypeInsert
+		}
+	}
+	return message.EventType
+}
+
+// CheckAndUpdateSchema проверяет и обновляет схему таблицы. Схема меняется под
+// advisory-блокировкой таблицы, после получения которой таблица проверяется повторно:
+// пока блокировку держала другая реплика, она могла уже выполнить те же изменения
 func (s *Storage) CheckAndUpdateSchema(schema domain.Schema) error {
-	tableName := schema.TableName
+	table := s.SchemaService.Table(schema)
+
+	// В установившемся режиме схема совпадает и блокировка не нужна
+	exists, diff, err := s.compareSchema(schema)
+	if err != nil {
+		return err
+	}
+	if exists && diff.IsEmpty() {
+		return nil
+	}
+
+	if s.SchemaService.Mode == schema_database.SchemaModePlan {
+		return s.planSchema(schema)
+	}
+
+	if err := s.SchemaService.LockTable(table); err != nil {
+		return err
+	}
+	s.SchemaService.Invalidate(table)
 
-	// Проверяем существование таблицы
-	exists, err := s.SchemaService.TableExists(tableName)
+	exists, diff, err = s.compareSchema(schema)
 	if err != nil {
 		return err
 	}
@@ -54,68 +271,158 @@ func (s *Storage) CheckAndUpdateSchema(schema domain.Schema) error {
 		return s.SchemaService.CreateTable(schema)
 	}
 
-	// Сравниваем схемы
-	isEqual, missingColumns, err := s.SchemaService.CompareSchemas(schema)
+	// Если схемы не совпадают - добавляем колонки и меняем существующие
+	return s.SchemaService.ApplyDiff(schema, diff)
+}
+
+// planSchema в режиме plan вычисляет DDL для схемы сообщения и записывает его в журнал
+// вместо выполнения. Кеш сбрасывается, чтобы не откладывать сообщение из-за устаревшей схемы
+func (s *Storage) planSchema(schema domain.Schema) error {
+	s.SchemaService.Invalidate(s.SchemaService.Table(schema))
+
+	exists, diff, err := s.compareSchema(schema)
 	if err != nil {
 		return err
 	}
+	if exists && diff.IsEmpty() {
+		return nil
+	}
 
-	// Если схемы не совпадают - добавляем недостающие колонки
-	if !isEqual {
-		return s.SchemaService.AddColumns(tableName, schema.Columns, missingColumns)
+	statements, err := s.SchemaService.Plan(schema, exists, diff)
+	if err != nil {
+		return err
+	}
+	if len(statements) == 0 {
+		return nil
 	}
 
-	return nil
+	return s.SchemaService.ReportPlan(schema, statements)
 }
 
-func (s *Storage) InsertData(tableName string, data []domain.Fields) error {
-	if len(data) == 0 {
+// compareSchema проверяет существование таблицы и сравнивает ее со схемой сообщения
+func (s *Storage) compareSchema(schema domain.Schema) (bool, *schema_database.SchemaDiff, error) {
+	exists, err := s.SchemaService.TableExists(s.SchemaService.Table(schema))
+	if err != nil || !exists {
+		return false, nil, err
+	}
+
+	diff, err := s.SchemaService.CompareSchemas(schema)
+	if err != nil {
+		return false, nil, err
+	}
+
+	return true, diff, nil
+}
+
+// maxQueryParams ограничение PostgreSQL на число параметров в одной команде
+const maxQueryParams = 65535
+
+// InsertData вставляет строку, существующие строки не перезаписываются.
+// При мягком удалении строка, ранее помеченная удаленной, перезаписывается и восстанавливается
+func (s *Storage) InsertData(table schema_database.TableRef, data []domain.Fields, primaryKeys []string) error {
+	columns, values := insertValues(data)
+	if len(columns) == 0 {
+		return nil
+	}
+
+	return s.insertRows(table, columns, [][]interface{}{values}, primaryKeys, false)
+}
+
+// UpsertData вставляет строку или перезаписывает существующую одним
+// INSERT ... ON CONFLICT (pk) DO UPDATE, поэтому результат не зависит от порядка событий
+func (s *Storage) UpsertData(table schema_database.TableRef, data []domain.Fields, primaryKeys []string) error {
+	columns, values := insertValues(data)
+	if len(columns) == 0 {
 		return nil
 	}
 
+	return s.insertRows(table, columns, [][]interface{}{values}, primaryKeys, true)
+}
+
+// insertRows вставляет строки с одинаковым набором колонок многострочным INSERT.
+// Если параметров больше, чем допускает PostgreSQL, строки разбиваются на несколько команд
+func (s *Storage) insertRows(table schema_database.TableRef, columns []string, rows [][]interface{}, primaryKeys []string, upsert bool) error {
+	onConflict := "ON CONFLICT DO NOTHING"
+	if len(primaryKeys) > 0 {
+		if upsert {
+			onConflict = s.conflictUpdate(table, columns, primaryKeys, false)
+		} else if s.SchemaService.SoftDelete.Enabled(table.Name) {
+			onConflict = s.conflictUpdate(table, columns, primaryKeys, true)
+		}
+	}
+
+	rowsPerQuery := maxQueryParams / len(columns)
+	for start := 0; start < len(rows); start += rowsPerQuery {
+		end := start + rowsPerQuery
+		if end > len(rows) {
+			end = len(rows)
+		}
+
+		var tuples []string
+		var values []interface{}
+		for _, row := range rows[start:end] {
+			placeholders := make([]string, len(row))
+			for i, value := range row {
+				values = append(values, value)
+				placeholders[i] = fmt.Sprintf("$%d", len(values))
+			}
+			tuples = append(tuples, fmt.Sprintf("(%s)", strings.Join(placeholders, ", ")))
+		}
+
+		query := fmt.Sprintf(
+			`INSERT INTO %s (%s) VALUES %s %s`,
+			table.Quoted(),
+			quoteColumns(columns),
+			strings.Join(tuples, ", "),
+			onConflict,
+		)
+
+		_, err := s.db.Exec(query, values...)
+		if err != nil {
+			if upsert {
+				return fmt.Errorf("failed to upsert data: %w", err)
+			}
+			return fmt.Errorf("failed to insert data: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// insertValues собирает колонки и значения для INSERT
+func insertValues(data []domain.Fields) ([]string, []interface{}) {
 	var columns []string
 	var values []interface{}
-	var placeholders []string
-	paramIndex := 1
 
 	for _, field := range data {
 		// Пропускаем NULL значения, чтобы использовались DEFAULT из схемы
 		if field.NewValue == nil {
 			continue
 		}
-		// Экранируем имя колонки в двойные кавычки
-		columns = append(columns, fmt.Sprintf(`"%s"`, field.Field))
+		columns = append(columns, field.Field)
 		values = append(values, field.NewValue)
-		placeholders = append(placeholders, fmt.Sprintf("$%d", paramIndex))
-		paramIndex++
-	}
-
-	if len(columns) == 0 {
-		return nil
 	}
 
-	query := fmt.Sprintf(
-		`INSERT INTO "%s" (%s) VALUES (%s) ON CONFLICT DO NOTHING`,
-		tableName,
-		strings.Join(columns, ", "),
-		strings.Join(placeholders, ", "),
-	)
+	return columns, values
+}
 
-	_, err := s.Conn.DB.Exec(query, values...)
-	if err != nil {
-		return fmt.Errorf("failed to insert data: %w", err)
+// quoteColumns экранирует имена колонок в двойные кавычки и соединяет через запятую
+func quoteColumns(columns []string) string {
+	quoted := make([]string, len(columns))
+	for i, column := range columns {
+		quoted[i] = schema_database.QuoteIdentifier(column)
 	}
-
-	return nil
+	return strings.Join(quoted, ", ")
 }
 
 // UpdateData обновляет данные в таблице
-func (s *Storage) UpdateData(tableName string, data []domain.Fields, primaryKeys []string) error {
+func (s *Storage) UpdateData(table schema_database.TableRef, data []domain.Fields, primaryKeys []string) error {
 	if len(data) == 0 {
 		return nil
 	}
 
 	var setClauses []string
+	var setColumns []string
 	var whereClause []string
 	var values []interface{}
 	valueIndex := 1
@@ -143,7 +450,8 @@ func (s *Storage) UpdateData(tableName string, data []domain.Fields, primaryKeys
 
 		if !isPrimaryKey && field.NewValue != nil {
 			// Экранируем имя колонки в двойные кавычки
-			setClauses = append(setClauses, fmt.Sprintf(`"%s" = $%d`, field.Field, valueIndex))
+			setClauses = append(setClauses, fmt.Sprintf(`%s = $%d`, schema_database.QuoteIdentifier(field.Field), valueIndex))
+			setColumns = append(setColumns, field.Field)
 			values = append(values, field.NewValue)
 			valueIndex++
 		}
@@ -153,7 +461,7 @@ func (s *Storage) UpdateData(tableName string, data []domain.Fields, primaryKeys
 	for _, pk := range primaryKeys {
 		if val, exists := pkValues[pk]; exists {
 			// Экранируем имя колонки в двойные кавычки
-			whereClause = append(whereClause, fmt.Sprintf(`"%s" = $%d`, pk, valueIndex))
+			whereClause = append(whereClause, fmt.Sprintf(`%s = $%d`, schema_database.QuoteIdentifier(pk), valueIndex))
 			values = append(values, val)
 			valueIndex++
 		}
@@ -167,14 +475,19 @@ func (s *Storage) UpdateData(tableName string, data []domain.Fields, primaryKeys
 		return fmt.Errorf("no primary key values found")
 	}
 
+	// Запись ранее удаленной строки снимает пометку об удалении
+	if restore := s.restoreClause(table, setColumns); restore != "" {
+		setClauses = append(setClauses, restore)
+	}
+
 	query := fmt.Sprintf(
-		`UPDATE "%s" SET %s WHERE %s`,
-		tableName,
+		`UPDATE %s SET %s WHERE %s`,
+		table.Quoted(),
 		strings.Join(setClauses, ", "),
 		strings.Join(whereClause, " AND "),
 	)
 
-	result, err := s.Conn.DB.Exec(query, values...)
+	result, err := s.db.Exec(query, values...)
 	if err != nil {
 		return fmt.Errorf("failed to update data: %w", err)
 	}
@@ -186,8 +499,152 @@ func (s *Storage) UpdateData(tableName string, data []domain.Fields, primaryKeys
 
 	if rowsAffected == 0 {
 		// Если запись не найдена, пытаемся вставить
-		return s.InsertData(tableName, data)
+		return s.InsertData(table, data, primaryKeys)
 	}
 
 	return nil
 }
+
+// conflictUpdate формирует ON CONFLICT (pk) DO UPDATE для вставляемых колонок.
+// При onlyDeleted перезаписывается только мягко удаленная строка
+func (s *Storage) conflictUpdate(table schema_database.TableRef, columns []string, primaryKeys []string, onlyDeleted bool) string {
+	softDelete := s.SchemaService.SoftDelete
+
+	quotedPK := make([]string, len(primaryKeys))
+	for i, pk := range primaryKeys {
+		quotedPK[i] = schema_database.QuoteIdentifier(pk)
+	}
+
+	var setClauses []string
+	for _, column := range columns {
+		if isPrimaryKey(column, primaryKeys) {
+			continue
+		}
+		quoted := schema_database.QuoteIdentifier(column)
+		setClauses = append(setClauses, fmt.Sprintf(`%s = EXCLUDED.%s`, quoted, quoted))
+	}
+	if restore := s.restoreClause(table, columns); restore != "" {
+		setClauses = append(setClauses, restore)
+	}
+
+	if len(setClauses) == 0 {
+		return fmt.Sprintf("ON CONFLICT (%s) DO NOTHING", strings.Join(quotedPK, ", "))
+	}
+
+	onConflict := fmt.Sprintf(
+		`ON CONFLICT (%s) DO UPDATE SET %s`,
+		strings.Join(quotedPK, ", "),
+		strings.Join(setClauses, ", "),
+	)
+	if onlyDeleted {
+		onConflict += fmt.Sprintf(" WHERE NOT (%s)", softDelete.ActiveCondition(schema_database.QuoteIdentifier(table.Name)))
+	}
+
+	return onConflict
+}
+
+// restoreClause возвращает SET, снимающий пометку об удалении, или пустую строку, если
+// мягкое удаление выключено. Если колонку мягкого удаления записывает само сообщение,
+// используется его значение: PostgreSQL не допускает двух присваиваний одной колонке
+func (s *Storage) restoreClause(table schema_database.TableRef, columns []string) string {
+	softDelete := s.SchemaService.SoftDelete
+	if !softDelete.Enabled(table.Name) {
+		return ""
+	}
+	for _, column := range columns {
+		if column == softDelete.Column {
+			return ""
+		}
+	}
+	return fmt.Sprintf(`%s = %s`, schema_database.QuoteIdentifier(softDelete.Column), softDelete.ActiveValue())
+}
+
+// isPrimaryKey сообщает, входит ли колонка в первичный ключ
+func isPrimaryKey(column string, primaryKeys []string) bool {
+	for _, pk := range primaryKeys {
+		if column == pk {
+			return true
+		}
+	}
+	return false
+}
+
+// DeleteData удаляет строку по значениям первичного ключа из Data.
+// При мягком удалении строка только помечается удаленной
+func (s *Storage) DeleteData(table schema_database.TableRef, message *domain.Message) error {
+	key, err := primaryKeyValues(message)
+	if err != nil {
+		return err
+	}
+
+	return s.deleteRows(table, message.Schema.PrimaryKey, [][]interface{}{key})
+}
+
+// deleteRows удаляет строки по списку значений первичного ключа одной командой
+func (s *Storage) deleteRows(table schema_database.TableRef, primaryKeys []string, keys [][]interface{}) error {
+	rowsPerQuery := maxQueryParams / len(primaryKeys)
+	for start := 0; start < len(keys); start += rowsPerQuery {
+		end := start + rowsPerQuery
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		var tuples []string
+		var values []interface{}
+		for _, key := range keys[start:end] {
+			placeholders := make([]string, len(key))
+			for i, value := range key {
+				values = append(values, value)
+				placeholders[i] = fmt.Sprintf("$%d", len(values))
+			}
+			tuples = append(tuples, fmt.Sprintf("(%s)", strings.Join(placeholders, ", ")))
+		}
+
+		whereClause := fmt.Sprintf("(%s) IN (%s)", quoteColumns(primaryKeys), strings.Join(tuples, ", "))
+
+		query := fmt.Sprintf(
+			`DELETE FROM %s WHERE %s`,
+			table.Quoted(),
+			whereClause,
+		)
+
+		softDelete := s.SchemaService.SoftDelete
+		if softDelete.Enabled(table.Name) {
+			// Повторное удаление не перезаписывает исходную пометку
+			query = fmt.Sprintf(
+				`UPDATE %s SET %s = %s WHERE %s AND %s`,
+				table.Quoted(),
+				schema_database.QuoteIdentifier(softDelete.Column),
+				softDelete.DeletedValue(),
+				whereClause,
+				softDelete.ActiveCondition(""),
+			)
+		}
+
+		_, err := s.db.Exec(query, values...)
+		if err != nil {
+			return fmt.Errorf("failed to delete data: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// primaryKeyValues возвращает значения первичного ключа сообщения в порядке Schema.PrimaryKey
+func primaryKeyValues(message *domain.Message) ([]interface{}, error) {
+	primaryKeys := message.Schema.PrimaryKey
+	if len(primaryKeys) == 0 {
+		return nil, fmt.Errorf("no primary key defined for table %s", message.Schema.TableName)
+	}
+
+	values := make([]interface{}, len(primaryKeys))
+	for i, pk := range primaryKeys {
+		val, exists := message.GetKeyValue(pk)
+		if !exists {
+			return nil, fmt.Errorf("no value for primary key %s", pk)
+		}
+		values[i] = val
+	}
+
+	return values, nil
+}
@@ -0,0 +1,690 @@
+package db
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"crm-lead-service/internal/domain"
+	"crm-lead-service/internal/service/schema_database"
+)
+
+var testTable = schema_database.TableRef{Schema: "public", Name: "users"}
+
+// TestDeleteData проверяет SQL удаления строки по первичному ключу из сообщения
+func TestDeleteData(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		message *domain.Message
+		query   string
+		args    []interface{}
+		wantErr bool
+	}{
+		{
+			name: "Key from old value",
+			message: &domain.Message{
+				EventType: domain.EventTypeDelete,
+				Schema:    domain.Schema{TableName: "users", PrimaryKey: []string{"id"}},
+				Data:      []domain.Fields{{Field: "id", OldValue: 7}, {Field: "email", OldValue: "a@b.c"}},
+			},
+			query: `DELETE FROM "public"."users" WHERE ("id") IN (($1))`,
+			args:  []interface{}{int64(7)},
+		},
+		{
+			name: "Composite key in schema order",
+			message: &domain.Message{
+				EventType: domain.EventTypeDelete,
+				Schema:    domain.Schema{TableName: "users", PrimaryKey: []string{"tenant_id", "id"}},
+				Data:      []domain.Fields{{Field: "id", OldValue: 7}, {Field: "tenant_id", NewValue: 2}},
+			},
+			query: `DELETE FROM "public"."users" WHERE ("tenant_id", "id") IN (($1, $2))`,
+			args:  []interface{}{int64(2), int64(7)},
+		},
+		{
+			name:   "Soft delete marks active row",
+			config: softDeleteConfig(schema_database.SoftDeleteTimestamp),
+			message: &domain.Message{
+				EventType: domain.EventTypeDelete,
+				Schema:    domain.Schema{TableName: "users", PrimaryKey: []string{"id"}},
+				Data:      []domain.Fields{{Field: "id", OldValue: 7}},
+			},
+			query: `UPDATE "public"."users" SET "deleted_at" = CURRENT_TIMESTAMP WHERE ("id") IN (($1)) AND "deleted_at" IS NULL`,
+			args:  []interface{}{int64(7)},
+		},
+		{
+			name:   "Boolean soft delete",
+			config: softDeleteConfig(schema_database.SoftDeleteBoolean),
+			message: &domain.Message{
+				EventType: domain.EventTypeDelete,
+				Schema:    domain.Schema{TableName: "users", PrimaryKey: []string{"id"}},
+				Data:      []domain.Fields{{Field: "id", OldValue: 7}},
+			},
+			query: `UPDATE "public"."users" SET "deleted_at" = true WHERE ("id") IN (($1)) AND "deleted_at" = false`,
+			args:  []interface{}{int64(7)},
+		},
+		{
+			name: "Missing key value",
+			message: &domain.Message{
+				EventType: domain.EventTypeDelete,
+				Schema:    domain.Schema{TableName: "users", PrimaryKey: []string{"id"}},
+				Data:      []domain.Fields{{Field: "email", OldValue: "a@b.c"}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "No primary key",
+			message: &domain.Message{
+				EventType: domain.EventTypeDelete,
+				Schema:    domain.Schema{TableName: "users"},
+				Data:      []domain.Fields{{Field: "id", OldValue: 7}},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake, storage := newTestStorage(t, tt.config)
+
+			err := storage.DeleteData(testTable, tt.message)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("Expected error, got nil")
+				}
+				if queries := fake.executed(); len(queries) != 0 {
+					t.Errorf("Expected no queries, got %v", queries)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("DeleteData() returned unexpected error: %v", err)
+			}
+
+			assertQueries(t, fake, fakeQuery{query: tt.query, args: tt.args})
+		})
+	}
+}
+
+// TestUpdateData проверяет SQL обновления строки и снятие пометки мягкого удаления
+func TestUpdateData(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+		data   []domain.Fields
+		query  string
+		args   []interface{}
+	}{
+		{
+			name:  "Update by primary key",
+			data:  []domain.Fields{{Field: "id", NewValue: 7}, {Field: "email", NewValue: "a@b.c"}, {Field: "name"}},
+			query: `UPDATE "public"."users" SET "email" = $1 WHERE "id" = $2`,
+			args:  []interface{}{"a@b.c", int64(7)},
+		},
+		{
+			name:   "Soft delete mark is cleared",
+			config: softDeleteConfig(schema_database.SoftDeleteTimestamp),
+			data:   []domain.Fields{{Field: "id", NewValue: 7}, {Field: "email", NewValue: "a@b.c"}},
+			query:  `UPDATE "public"."users" SET "email" = $1, "deleted_at" = NULL WHERE "id" = $2`,
+			args:   []interface{}{"a@b.c", int64(7)},
+		},
+		{
+			name:   "Soft delete column from message is assigned once",
+			config: softDeleteConfig(schema_database.SoftDeleteTimestamp),
+			data:   []domain.Fields{{Field: "id", NewValue: 7}, {Field: "deleted_at", NewValue: "2024-12-02T10:00:00Z"}},
+			query:  `UPDATE "public"."users" SET "deleted_at" = $1 WHERE "id" = $2`,
+			args:   []interface{}{"2024-12-02T10:00:00Z", int64(7)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake, storage := newTestStorage(t, tt.config)
+
+			if err := storage.UpdateData(testTable, tt.data, []string{"id"}); err != nil {
+				t.Fatalf("UpdateData() returned unexpected error: %v", err)
+			}
+
+			assertQueries(t, fake, fakeQuery{query: tt.query, args: tt.args})
+		})
+	}
+}
+
+// TestInsertData проверяет SQL вставки строки
+func TestInsertData(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+		data   []domain.Fields
+		query  string
+		args   []interface{}
+	}{
+		{
+			name:  "Existing row is kept",
+			data:  []domain.Fields{{Field: "id", NewValue: 7}, {Field: "email", NewValue: "a@b.c"}, {Field: "name"}},
+			query: `INSERT INTO "public"."users" ("id", "email") VALUES ($1, $2) ON CONFLICT DO NOTHING`,
+			args:  []interface{}{int64(7), "a@b.c"},
+		},
+		{
+			name:   "Soft deleted row is restored",
+			config: softDeleteConfig(schema_database.SoftDeleteTimestamp),
+			data:   []domain.Fields{{Field: "id", NewValue: 7}, {Field: "email", NewValue: "a@b.c"}},
+			query: `INSERT INTO "public"."users" ("id", "email") VALUES ($1, $2) ON CONFLICT ("id") DO UPDATE SET ` +
+				`"email" = EXCLUDED."email", "deleted_at" = NULL WHERE NOT ("users"."deleted_at" IS NULL)`,
+			args: []interface{}{int64(7), "a@b.c"},
+		},
+		{
+			name:   "Soft delete column from message is assigned once",
+			config: softDeleteConfig(schema_database.SoftDeleteBoolean),
+			data:   []domain.Fields{{Field: "id", NewValue: 7}, {Field: "deleted_at", NewValue: false}},
+			query: `INSERT INTO "public"."users" ("id", "deleted_at") VALUES ($1, $2) ON CONFLICT ("id") DO UPDATE SET ` +
+				`"deleted_at" = EXCLUDED."deleted_at" WHERE NOT ("users"."deleted_at" = false)`,
+			args: []interface{}{int64(7), false},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake, storage := newTestStorage(t, tt.config)
+
+			if err := storage.InsertData(testTable, tt.data, []string{"id"}); err != nil {
+				t.Fatalf("InsertData() returned unexpected error: %v", err)
+			}
+
+			assertQueries(t, fake, fakeQuery{query: tt.query, args: tt.args})
+		})
+	}
+}
+
+// TestUpsertData проверяет SQL вставки с перезаписью существующей строки
+func TestUpsertData(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      Config
+		primaryKeys []string
+		data        []domain.Fields
+		query       string
+		args        []interface{}
+	}{
+		{
+			name:        "Existing row is overwritten",
+			primaryKeys: []string{"id"},
+			data:        []domain.Fields{{Field: "id", NewValue: 7}, {Field: "email", NewValue: "a@b.c"}},
+			query:       `INSERT INTO "public"."users" ("id", "email") VALUES ($1, $2) ON CONFLICT ("id") DO UPDATE SET "email" = EXCLUDED."email"`,
+			args:        []interface{}{int64(7), "a@b.c"},
+		},
+		{
+			name:        "Composite key",
+			primaryKeys: []string{"tenant_id", "id"},
+			data:        []domain.Fields{{Field: "tenant_id", NewValue: 2}, {Field: "id", NewValue: 7}, {Field: "email", NewValue: "a@b.c"}},
+			query: `INSERT INTO "public"."users" ("tenant_id", "id", "email") VALUES ($1, $2, $3) ` +
+				`ON CONFLICT ("tenant_id", "id") DO UPDATE SET "email" = EXCLUDED."email"`,
+			args: []interface{}{int64(2), int64(7), "a@b.c"},
+		},
+		{
+			name:        "Only key columns",
+			primaryKeys: []string{"id"},
+			data:        []domain.Fields{{Field: "id", NewValue: 7}},
+			query:       `INSERT INTO "public"."users" ("id") VALUES ($1) ON CONFLICT ("id") DO NOTHING`,
+			args:        []interface{}{int64(7)},
+		},
+		{
+			name:        "Soft deleted row is restored",
+			config:      softDeleteConfig(schema_database.SoftDeleteBoolean),
+			primaryKeys: []string{"id"},
+			data:        []domain.Fields{{Field: "id", NewValue: 7}, {Field: "email", NewValue: "a@b.c"}},
+			query: `INSERT INTO "public"."users" ("id", "email") VALUES ($1, $2) ` +
+				`ON CONFLICT ("id") DO UPDATE SET "email" = EXCLUDED."email", "deleted_at" = false`,
+			args: []interface{}{int64(7), "a@b.c"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake, storage := newTestStorage(t, tt.config)
+
+			if err := storage.UpsertData(testTable, tt.data, tt.primaryKeys); err != nil {
+				t.Fatalf("UpsertData() returned unexpected error: %v", err)
+			}
+
+			assertQueries(t, fake, fakeQuery{query: tt.query, args: tt.args})
+		})
+	}
+}
+
+// TestUpdateMissingRow проверяет, что update несуществующей строки вставляет ее
+func TestUpdateMissingRow(t *testing.T) {
+	fake, storage := newTestStorage(t, Config{}, fakeResponse{match: "UPDATE", rowsAffected: 0})
+
+	data := []domain.Fields{{Field: "id", NewValue: 7}, {Field: "email", NewValue: "a@b.c"}}
+	if err := storage.UpdateData(testTable, data, []string{"id"}); err != nil {
+		t.Fatalf("UpdateData() returned unexpected error: %v", err)
+	}
+
+	assertQueries(t, fake,
+		fakeQuery{query: `UPDATE "public"."users" SET "email" = $1 WHERE "id" = $2`, args: []interface{}{"a@b.c", int64(7)}},
+		fakeQuery{query: `INSERT INTO "public"."users" ("id", "email") VALUES ($1, $2) ON CONFLICT DO NOTHING`, args: []interface{}{int64(7), "a@b.c"}},
+	)
+}
+
+// TestEventType проверяет выбор операции для события с учетом режима upsert
+func TestEventType(t *testing.T) {
+	tests := []struct {
+		name       string
+		upsert     bool
+		eventType  domain.EventTypeEnum
+		primaryKey []string
+		expected   domain.EventTypeEnum
+	}{
+		{"Insert", false, domain.EventTypeInsert, []string{"id"}, domain.EventTypeInsert},
+		{"Update in upsert mode", true, domain.EventTypeUpdate, []string{"id"}, domain.EventTypeUpsert},
+		{"Insert in upsert mode without key", true, domain.EventTypeInsert, nil, domain.EventTypeInsert},
+		{"Upsert without key", false, domain.EventTypeUpsert, nil, domain.EventTypeInsert},
+		{"Delete in upsert mode", true, domain.EventTypeDelete, []string{"id"}, domain.EventTypeDelete},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := &Storage{Upsert: tt.upsert}
+			message := &domain.Message{EventType: tt.eventType, Schema: domain.Schema{PrimaryKey: tt.primaryKey}}
+			if got := storage.eventType(message); got != tt.expected {
+				t.Errorf("Expected %s, got %s", tt.expected, got)
+			}
+		})
+	}
+}
+
+// softDeleteConfig включает мягкое удаление с колонкой deleted_at для всех таблиц
+func softDeleteConfig(columnType schema_database.SoftDeleteColumnType) Config {
+	return Config{Schema: schema_database.Config{SoftDelete: schema_database.SoftDeleteConfig{
+		Global:     true,
+		Column:     "deleted_at",
+		ColumnType: columnType,
+	}}}
+}
+
+// assertQueries сравнивает выполненные запросы с ожидаемыми
+func assertQueries(t *testing.T, fake *fakeDB, expected ...fakeQuery) {
+	t.Helper()
+
+	queries := fake.executed()
+	if len(queries) != len(expected) {
+		t.Fatalf("Expected %d queries, got %d: %v", len(expected), len(queries), queries)
+	}
+	for i := range expected {
+		if queries[i].query != expected[i].query {
+			t.Errorf("Query %d:\nexpected %s\n     got %s", i, expected[i].query, queries[i].query)
+		}
+		if !reflect.DeepEqual(queries[i].args, expected[i].args) {
+			t.Errorf("Query %d: expected args %v, got %v", i, expected[i].args, queries[i].args)
+		}
+	}
+}
+
+// usersTable ответы фейковой БД для существующей таблицы users(id, email), совпадающей с testSchema
+func usersTable() []fakeResponse {
+	return []fakeResponse{
+		{match: "information_schema.tables", columns: []string{"exists"}, rows: [][]driver.Value{{true}}},
+		{match: "FROM pg_constraint", columns: []string{"conname", "pg_get_constraintdef"}},
+		{
+			match: "information_schema.columns",
+			columns: []string{"column_name", "data_type", "is_nullable", "column_default", "character_maximum_length",
+				"numeric_precision", "numeric_scale", "udt_name", "is_identity", "col_description"},
+			rows: [][]driver.Value{
+				{"id", "integer", "NO", nil, nil, int64(32), int64(0), "int4", "NO", nil},
+				{"email", "text", "YES", nil, nil, nil, nil, "text", "NO", nil},
+			},
+		},
+	}
+}
+
+// testSchema схема таблицы users из usersTable
+func testSchema() domain.Schema {
+	return domain.Schema{
+		TableName: "users",
+		Columns: map[string]domain.ColumnInfo{
+			"id":    {Name: "id", Type: "integer"},
+			"email": {Name: "email", Type: "text", AllowNull: true},
+		},
+		PrimaryKey: []string{"id"},
+	}
+}
+
+// TestSaveMessageTransaction проверяет, что проверка схемы и запись сообщения идут
+// в одной транзакции, а ошибка записи откатывает ее
+func TestSaveMessageTransaction(t *testing.T) {
+	message := &domain.Message{
+		EventType: domain.EventTypeUpdate,
+		Schema:    testSchema(),
+		Data:      []domain.Fields{{Field: "id", NewValue: 7}, {Field: "email", NewValue: "a@b.c"}},
+	}
+
+	tests := []struct {
+		name    string
+		err     error
+		outcome string
+	}{
+		{"Write is committed", nil, "COMMIT"},
+		{"Failed write is rolled back", errors.New("connection reset"), "ROLLBACK"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			responses := append([]fakeResponse{{match: "UPDATE", rowsAffected: 1, err: tt.err}}, usersTable()...)
+			fake, storage := newTestStorage(t, Config{}, responses...)
+
+			err := storage.SaveMessage(context.Background(), message)
+			if (err != nil) != (tt.err != nil) {
+				t.Fatalf("SaveMessage() error = %v, expected %v", err, tt.err)
+			}
+
+			var statements []string
+			for _, query := range fake.executed() {
+				statements = append(statements, strings.Fields(query.query)[0])
+			}
+			expected := []string{"BEGIN", "SELECT", "SELECT", "SELECT", "SELECT", "UPDATE", tt.outcome}
+			if !reflect.DeepEqual(statements, expected) {
+				t.Errorf("Expected statements %v, got %v", expected, statements)
+			}
+		})
+	}
+}
+
+// TestDroppedColumnDetection проверяет, что колонка помечается устаревшей, только если ее нет
+// в MissingMessages свежих сообщениях подряд, а повторно доставленные сообщения не учитываются
+func TestDroppedColumnDetection(t *testing.T) {
+	tests := []struct {
+		name            string
+		missingMessages int
+		redelivered     []bool
+		deprecated      []bool
+	}{
+		{"Fresh message", 0, []bool{false}, []bool{true}},
+		{"Redelivered message", 0, []bool{true}, []bool{false}},
+		{"Consecutive fresh messages", 2, []bool{false, false}, []bool{false, true}},
+		{"Redelivered messages are not counted", 2, []bool{true, false, true}, []bool{false, false, false}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := Config{Schema: schema_database.Config{ColumnPolicy: schema_database.ColumnPolicyConfig{
+				Dropped:         schema_database.DroppedColumnDeprecate,
+				MissingMessages: tt.missingMessages,
+			}}}
+			fake, storage := newTestStorage(t, config, usersTable()...)
+
+			for i, redelivered := range tt.redelivered {
+				message := &domain.Message{
+					EventType: domain.EventTypeInsert,
+					Schema: domain.Schema{
+						TableName:  "users",
+						Columns:    map[string]domain.ColumnInfo{"id": {Name: "id", Type: "integer"}},
+						PrimaryKey: []string{"id"},
+					},
+					Data:        []domain.Fields{{Field: "id", NewValue: 7}},
+					Redelivered: redelivered,
+				}
+				before := len(fake.executed())
+
+				if err := storage.SaveMessage(context.Background(), message); err != nil {
+					t.Fatalf("SaveMessage() returned unexpected error: %v", err)
+				}
+
+				deprecated := false
+				for _, query := range fake.executed()[before:] {
+					if strings.HasPrefix(query.query, `COMMENT ON COLUMN "public"."users"."email"`) {
+						deprecated = true
+					}
+				}
+				if deprecated != tt.deprecated[i] {
+					t.Errorf("Message %d: expected deprecated=%t, got %t", i+1, tt.deprecated[i], deprecated)
+				}
+			}
+		})
+	}
+}
+
+// TestSchemaLock проверяет, что блокировка таблицы берется, только если схему нужно
+// изменить, и что после блокировки таблица читается из каталога заново
+func TestSchemaLock(t *testing.T) {
+	withName := testSchema()
+	withName.Columns["name"] = domain.ColumnInfo{Name: "name", Type: "text", AllowNull: true}
+
+	tests := []struct {
+		name     string
+		schema   domain.Schema
+		expected []string
+	}{
+		{"Matching schema", testSchema(), []string{"BEGIN", "tables", "tables", "columns", "INSERT", "COMMIT"}},
+		{"Missing column", withName, []string{"BEGIN", "tables", "tables", "columns", "lock", "tables", "tables", "columns", "ALTER", "journal", "INSERT", "COMMIT"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake, storage := newTestStorage(t, Config{}, usersTable()...)
+
+			message := &domain.Message{
+				EventType: domain.EventTypeInsert,
+				Schema:    tt.schema,
+				Data:      []domain.Fields{{Field: "id", NewValue: 7}},
+			}
+			if err := storage.SaveMessage(context.Background(), message); err != nil {
+				t.Fatalf("SaveMessage() returned unexpected error: %v", err)
+			}
+
+			var statements []string
+			for _, query := range fake.executed() {
+				switch {
+				case strings.Contains(query.query, "pg_advisory_xact_lock"):
+					statements = append(statements, "lock")
+				case strings.Contains(query.query, "information_schema.tables"):
+					statements = append(statements, "tables")
+				case strings.Contains(query.query, "information_schema.columns"):
+					statements = append(statements, "columns")
+				case strings.Contains(query.query, "_sdr_schema_migrations"):
+					statements = append(statements, "journal")
+				case strings.Fields(query.query)[0] == "SELECT":
+					// Ограничения и последовательности к блокировке отношения не имеют
+				default:
+					statements = append(statements, strings.Fields(query.query)[0])
+				}
+			}
+			if !reflect.DeepEqual(statements, tt.expected) {
+				t.Errorf("Expected statements %v, got %v", tt.expected, statements)
+			}
+		})
+	}
+}
+
+// TestAdvanceSequence проверяет, что последовательность ключа только сдвигается вперед
+// с учетом is_called под блокировкой последовательности, а ее поиск (в том числе отсутствие) кешируется
+func TestAdvanceSequence(t *testing.T) {
+	schema := testSchema()
+	schema.Columns["id"] = domain.ColumnInfo{Name: "id", Type: "integer", AutoIncrement: true}
+
+	tests := []struct {
+		name     string
+		sequence driver.Value
+		setval   int
+	}{
+		{"Table with sequence", "public.users_id_seq", 2},
+		{"Table without sequence", nil, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			responses := usersTable()
+			// Ключ уже identity, поэтому схема не меняется
+			responses[2].rows[0][8] = "YES"
+			responses = append(responses, fakeResponse{
+				match: "pg_get_serial_sequence", columns: []string{"pg_get_serial_sequence"}, rows: [][]driver.Value{{tt.sequence}},
+			})
+			fake, storage := newTestStorage(t, Config{}, responses...)
+
+			// Меньший ключ приходит после большего и не должен сдвинуть последовательность назад
+			for _, id := range []int{100, 50} {
+				message := &domain.Message{
+					EventType: domain.EventTypeInsert,
+					Schema:    schema,
+					Data:      []domain.Fields{{Field: "id", NewValue: id}},
+				}
+				if err := storage.SaveMessage(context.Background(), message); err != nil {
+					t.Fatalf("SaveMessage() returned unexpected error: %v", err)
+				}
+			}
+
+			lookups, setvals := 0, 0
+			locked := false
+			for _, query := range fake.executed() {
+				switch {
+				case strings.Contains(query.query, "pg_get_serial_sequence"):
+					lookups++
+				case strings.Contains(query.query, "pg_advisory_xact_lock"):
+					locked = reflect.DeepEqual(query.args, []interface{}{int64(0x5351), "public.users_id_seq"})
+				case strings.Contains(query.query, "setval"):
+					setvals++
+					// Сравнение с текущим значением и setval выполняются под блокировкой последовательности
+					if !locked {
+						t.Errorf("Expected sequence lock before setval, got queries %v", fake.executed())
+					}
+					locked = false
+					expected := "WHERE $2 > CASE WHEN is_called THEN last_value ELSE last_value - 1 END"
+					if !strings.Contains(query.query, "FROM public.users_id_seq") || !strings.Contains(query.query, expected) {
+						t.Errorf("Unexpected setval query: %s", query.query)
+					}
+				}
+			}
+			if lookups != 1 {
+				t.Errorf("Expected one sequence lookup, got %d", lookups)
+			}
+			if setvals != tt.setval {
+				t.Errorf("Expected %d setval queries, got %d", tt.setval, setvals)
+			}
+		})
+	}
+}
+
+// TestKeptNullableColumn проверяет, что колонка, оставленная nullable из-за NULL в ней,
+// не сканируется и не блокирует таблицу на каждом следующем сообщении
+func TestKeptNullableColumn(t *testing.T) {
+	responses := append([]fakeResponse{
+		{match: "IS NULL)", columns: []string{"exists"}, rows: [][]driver.Value{{true}}},
+	}, usersTable()...)
+	responses[3].rows = append(responses[3].rows,
+		[]driver.Value{"token", "bytea", "YES", nil, nil, nil, nil, "bytea", "NO", nil})
+	fake, storage := newTestStorage(t, Config{}, responses...)
+
+	schema := testSchema()
+	schema.Columns["token"] = domain.ColumnInfo{Name: "token", Type: "binary"}
+
+	scans := func() (scans, locks int) {
+		for _, query := range fake.executed() {
+			switch {
+			case strings.Contains(query.query, "IS NULL)"):
+				scans++
+			case strings.Contains(query.query, "pg_advisory_xact_lock"):
+				locks++
+			}
+		}
+		return scans, locks
+	}
+
+	for _, id := range []int{7, 8} {
+		message := &domain.Message{
+			EventType: domain.EventTypeInsert,
+			Schema:    schema,
+			Data:      []domain.Fields{{Field: "id", NewValue: id}},
+		}
+		if err := storage.SaveMessage(context.Background(), message); err != nil {
+			t.Fatalf("SaveMessage() returned unexpected error: %v", err)
+		}
+
+		// NULL ищутся только при первом сообщении
+		if scanned, locked := scans(); scanned != 1 || locked != 1 {
+			t.Errorf("Message %d: expected one null scan and one lock in total, got %d and %d", id, scanned, locked)
+		}
+	}
+
+	if _, found := fake.find("SET NOT NULL"); found {
+		t.Error("Expected column with NULL values to stay nullable")
+	}
+}
+
+// TestSchemaJournal проверяет, что DDL и его запись в журнале выполняются в транзакции
+// сообщения и фиксируются или откатываются вместе с ней, а setval в журнал не попадает
+func TestSchemaJournal(t *testing.T) {
+	withName := testSchema()
+	withName.Columns["name"] = domain.ColumnInfo{Name: "name", Type: "text", AllowNull: true}
+	autoIncrement := testSchema()
+	autoIncrement.Columns["id"] = domain.ColumnInfo{Name: "id", Type: "integer", AutoIncrement: true}
+
+	tests := []struct {
+		name     string
+		schema   domain.Schema
+		err      error
+		outcome  string
+		journals []string
+	}{
+		{"Committed with the message", withName, nil, "COMMIT",
+			[]string{`ALTER TABLE "public"."users" ADD COLUMN IF NOT EXISTS "name" TEXT NULL`}},
+		{"Rolled back with the message", withName, errors.New("connection reset"), "ROLLBACK",
+			[]string{`ALTER TABLE "public"."users" ADD COLUMN IF NOT EXISTS "name" TEXT NULL`}},
+		{"Sequence advance is not journaled", autoIncrement, nil, "COMMIT", []string{
+			`ALTER TABLE "public"."users" ALTER COLUMN "id" DROP DEFAULT`,
+			`ALTER TABLE "public"."users" ALTER COLUMN "id" ADD GENERATED BY DEFAULT AS IDENTITY`,
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			responses := append([]fakeResponse{
+				{match: `INSERT INTO "public"."users"`, rowsAffected: 1, err: tt.err},
+				{match: "pg_get_serial_sequence($1, $2)", columns: []string{"pg_get_serial_sequence"}, rows: [][]driver.Value{{nil}}},
+			}, usersTable()...)
+			fake, storage := newTestStorage(t, Config{}, responses...)
+
+			message := &domain.Message{
+				EventType: domain.EventTypeInsert,
+				Schema:    tt.schema,
+				Data:      []domain.Fields{{Field: "id", NewValue: 7}},
+			}
+			err := storage.SaveMessage(context.Background(), message)
+			if (err != nil) != (tt.err != nil) {
+				t.Fatalf("SaveMessage() error = %v, expected %v", err, tt.err)
+			}
+
+			queries := fake.executed()
+			var journals []string
+			for i, query := range queries {
+				statement := strings.Fields(query.query)[0]
+				if (statement == "BEGIN" && i != 0) || ((statement == "COMMIT" || statement == "ROLLBACK") && i != len(queries)-1) {
+					t.Fatalf("Expected a single transaction, got queries %v", queries)
+				}
+				if !strings.Contains(query.query, "_sdr_schema_migrations") {
+					continue
+				}
+				// Запись журнала идет сразу за своим DDL
+				journal := query.args[2].(string)
+				if i == 0 || queries[i-1].query != journal {
+					t.Errorf("Expected journal entry right after %s", journal)
+				}
+				journals = append(journals, journal)
+			}
+
+			if !reflect.DeepEqual(journals, tt.journals) {
+				t.Errorf("Expected journal entries %v, got %v", tt.journals, journals)
+			}
+			if last := queries[len(queries)-1].query; last != tt.outcome {
+				t.Errorf("Expected transaction to end with %s, got %s", tt.outcome, last)
+			}
+			if tt.schema.Columns["id"].AutoIncrement {
+				if _, found := fake.find("COALESCE(MAX"); !found {
+					t.Error("Expected sequence to be advanced past existing keys")
+				}
+			}
+		})
+	}
+}
@@ -3,18 +3,31 @@ package main
 import (
 	"context"
 	"crm-lead-service/cmd/app"
+	"crm-lead-service/internal/service/consumer_rabbitmq"
+	"crm-lead-service/internal/service/schema_database"
+	storageDb "crm-lead-service/internal/storage/db"
 	"crm-lead-service/pkg/database"
 	"crm-lead-service/pkg/rabbitmq"
+	_ "expvar"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
+	"regexp"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 )
 
 func main() {
+	configConsumer := getConfigConsumer()
 	configRabbit := getConfigRabbitMQ()
+	// Брокер должен отдавать не меньше сообщений, чем одновременно помещается в пачки всех воркеров
+	if minPrefetch := configConsumer.BatchSize * configConsumer.Workers; configRabbit.Prefetch < minPrefetch {
+		configRabbit.Prefetch = minPrefetch
+	}
 	clientRabbit, err := configRabbit.NewConnectionRabbit()
 	if err != nil {
 		log.Fatal(err)
@@ -26,13 +39,32 @@ func main() {
 		log.Fatal(err)
 	}
 
-	handler := app.NewHandler(clientRabbit, clientDb, configRabbit.RabbitQueue)
+	handler, err := app.NewHandler(clientRabbit, clientDb, app.Config{
+		QueueName: configRabbit.RabbitQueue,
+		Storage:   getConfigStorage(),
+		Consumer:  configConsumer,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Метрики expvar (в том числе режима plan) отдаются по /debug/vars
+	if addr := os.Getenv("METRICS_ADDR"); addr != "" {
+		go func() {
+			if err := http.ListenAndServe(addr, nil); err != nil {
+				log.Printf("Metrics server stopped: %v", err)
+			}
+		}()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
 	stateCh := make(chan bool, 1)
 
 	// Запускаем обработку в горутине и отслеживаем состояние
 	go func() {
-		state, err := handler.Run()
+		state, err := handler.Run(ctx)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -46,18 +78,34 @@ func main() {
 	select {
 	case <-quit:
 		log.Println("Received shutdown signal...")
+
+		// Останавливаем консьюмер и ждем, пока допишется сообщение в обработке.
+		// Через ShutdownTimeout консьюмер сам откатит запись, небольшой запас нужен на Nack
+		cancel()
+		select {
+		case <-stateCh:
+		case <-time.After(configConsumer.ShutdownTimeout + time.Second):
+			log.Println("Consumer did not stop in time, closing connections...")
+		}
 	case state := <-stateCh:
 		if !state {
 			log.Println("System state is false, shutting down...")
 		}
 	}
 
-	_, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
 	err = clientRabbit.CloseRabbitMQ()
 	if err != nil {
-		log.Fatalf("Error closing RabbitMQ connection: %v", err)
+		log.Printf("Error closing RabbitMQ connection: %v", err)
+	}
+
+	err = handler.DB.Close()
+	if err != nil {
+		log.Printf("Error closing storage: %v", err)
+	}
+
+	err = clientDb.Close()
+	if err != nil {
+		log.Fatalf("Error closing database connection: %v", err)
 	}
 }
 
@@ -73,6 +121,10 @@ func getConfigRabbitMQ() *rabbitmq.Config {
 	if err != nil {
 		log.Fatal(err)
 	}
+	rabbit.Prefetch = getEnvInt("RABBITMQ_PREFETCH", 0)
+	rabbit.DeadLetterExchange = os.Getenv("RABBITMQ_DEAD_LETTER_EXCHANGE")
+	rabbit.DeadLetterQueue = getDeadLetterQueue()
+	rabbit.ParkingQueue = os.Getenv("RABBITMQ_PARKING_QUEUE")
 	return rabbit
 }
 
@@ -89,3 +141,162 @@ func getConfigDatabase() *database.Config {
 	}
 	return db
 }
+
+func getConfigStorage() storageDb.Config {
+	softDelete := schema_database.SoftDeleteConfig{
+		Global:     os.Getenv("SOFT_DELETE") == "true",
+		Tables:     make(map[string]bool),
+		Column:     os.Getenv("SOFT_DELETE_COLUMN"),
+		ColumnType: schema_database.SoftDeleteColumnType(os.Getenv("SOFT_DELETE_COLUMN_TYPE")),
+	}
+	for _, table := range strings.Split(os.Getenv("SOFT_DELETE_TABLES"), ",") {
+		if table = strings.TrimSpace(table); table != "" {
+			softDelete.Tables[table] = true
+		}
+	}
+	if softDelete.Column == "" {
+		softDelete.Column = "deleted_at"
+	}
+	switch softDelete.ColumnType {
+	case "":
+		softDelete.ColumnType = schema_database.SoftDeleteTimestamp
+	case schema_database.SoftDeleteTimestamp, schema_database.SoftDeleteBoolean:
+	default:
+		log.Fatalf("unknown SOFT_DELETE_COLUMN_TYPE: %s", softDelete.ColumnType)
+	}
+
+	columnPolicy := schema_database.ColumnPolicyConfig{
+		Dropped:         schema_database.DroppedColumnPolicy(os.Getenv("SCHEMA_DROPPED_COLUMNS")),
+		GracePeriod:     time.Duration(getEnvInt("SCHEMA_DROP_GRACE_PERIOD_HOURS", 168)) * time.Hour,
+		MissingMessages: getEnvInt("SCHEMA_DROP_AFTER_MESSAGES", 10),
+	}
+	switch columnPolicy.Dropped {
+	case "":
+		columnPolicy.Dropped = schema_database.DroppedColumnIgnore
+	case schema_database.DroppedColumnIgnore, schema_database.DroppedColumnDeprecate, schema_database.DroppedColumnDrop:
+	default:
+		log.Fatalf("unknown SCHEMA_DROPPED_COLUMNS: %s", columnPolicy.Dropped)
+	}
+	if columnPolicy.MissingMessages < 1 {
+		log.Fatalf("SCHEMA_DROP_AFTER_MESSAGES must be at least 1, got %d", columnPolicy.MissingMessages)
+	}
+	if path := os.Getenv("SCHEMA_RENAMES_FILE"); path != "" {
+		renames, err := schema_database.LoadRenames(path)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		columnPolicy.Renames = renames
+	}
+
+	prefixes, err := schema_database.ParseNamespaces(os.Getenv("DB_SCHEMA_PREFIXES"))
+	if err != nil {
+		log.Fatalf("invalid DB_SCHEMA_PREFIXES: %v", err)
+	}
+
+	identifiers := schema_database.IdentifierConfig{AllowedTables: make(map[string]bool)}
+	if pattern := os.Getenv("IDENTIFIER_PATTERN"); pattern != "" {
+		identifiers.Pattern, err = regexp.Compile(pattern)
+		if err != nil {
+			log.Fatalf("invalid IDENTIFIER_PATTERN: %v", err)
+		}
+	}
+	for _, table := range strings.Split(os.Getenv("ALLOWED_TABLES"), ",") {
+		if table = strings.TrimSpace(table); table != "" {
+			identifiers.AllowedTables[table] = true
+		}
+	}
+
+	var routes []schema_database.TableRoute
+	if path := os.Getenv("TABLE_ROUTES_FILE"); path != "" {
+		routes, err = schema_database.LoadRoutes(path)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+	}
+
+	mode := schema_database.SchemaMode(os.Getenv("SCHEMA_MODE"))
+	switch mode {
+	case "":
+		mode = schema_database.SchemaModeApply
+	case schema_database.SchemaModeApply, schema_database.SchemaModePlan:
+	default:
+		log.Fatalf("unknown SCHEMA_MODE: %s", mode)
+	}
+
+	foreignKeys := schema_database.ForeignKeyMode(os.Getenv("SCHEMA_FOREIGN_KEYS"))
+	switch foreignKeys {
+	case "":
+		foreignKeys = schema_database.ForeignKeysRecord
+	case schema_database.ForeignKeysRecord, schema_database.ForeignKeysCreate:
+	default:
+		log.Fatalf("unknown SCHEMA_FOREIGN_KEYS: %s", foreignKeys)
+	}
+
+	instance := os.Getenv("INSTANCE_ID")
+	if instance == "" {
+		instance, _ = os.Hostname()
+	}
+
+	return storageDb.Config{
+		Schema: schema_database.Config{
+			Mode:        mode,
+			Instance:    instance,
+			ForeignKeys: foreignKeys,
+			Identifiers: identifiers,
+			Routes:      routes,
+			Namespace: schema_database.NamespaceConfig{
+				Default:  os.Getenv("DB_SCHEMA"),
+				Prefixes: prefixes,
+			},
+			SoftDelete:   softDelete,
+			ColumnPolicy: columnPolicy,
+			Cache: schema_database.CacheConfig{
+				Enabled:       os.Getenv("SCHEMA_CACHE") != "false",
+				TTL:           time.Duration(getEnvInt("SCHEMA_CACHE_TTL_MS", 0)) * time.Millisecond,
+				NotifyChannel: os.Getenv("SCHEMA_CACHE_NOTIFY_CHANNEL"),
+			},
+		},
+		Upsert: os.Getenv("UPSERT_MODE") == "true",
+	}
+}
+
+func getConfigConsumer() consumer_rabbitmq.Config {
+	return consumer_rabbitmq.Config{
+		BatchSize:    getEnvInt("BATCH_SIZE", 1),
+		BatchTimeout: time.Duration(getEnvInt("BATCH_TIMEOUT_MS", 200)) * time.Millisecond,
+		// Dead letter и очередь отложенных объявляются клиентом RabbitMQ с теми же именами
+		DeadLetterExchange: os.Getenv("RABBITMQ_DEAD_LETTER_EXCHANGE"),
+		DeadLetterQueue:    getDeadLetterQueue(),
+		ParkingQueue:       os.Getenv("RABBITMQ_PARKING_QUEUE"),
+		MaxAttempts:        getEnvInt("MAX_ATTEMPTS", 5),
+		RetryBaseDelay:     time.Duration(getEnvInt("RETRY_BASE_DELAY_MS", 1000)) * time.Millisecond,
+		RetryMaxDelay:      time.Duration(getEnvInt("RETRY_MAX_DELAY_MS", 60000)) * time.Millisecond,
+		ParentRetryDelay:   time.Duration(getEnvInt("PARENT_RETRY_DELAY_MS", 5000)) * time.Millisecond,
+		ParentMaxAttempts:  getEnvInt("PARENT_MAX_ATTEMPTS", 120),
+		ShutdownTimeout:    time.Duration(getEnvInt("SHUTDOWN_TIMEOUT_MS", 10000)) * time.Millisecond,
+		Workers:            getEnvInt("WORKERS", 1),
+	}
+}
+
+// getDeadLetterQueue возвращает очередь dead letter. Без exchange и очереди сообщения,
+// которые нельзя записать, было бы некуда деть, поэтому по умолчанию это <RABBITMQ_QUEUE>.dlq
+func getDeadLetterQueue() string {
+	queue := os.Getenv("RABBITMQ_DEAD_LETTER_QUEUE")
+	if queue == "" && os.Getenv("RABBITMQ_DEAD_LETTER_EXCHANGE") == "" {
+		queue = os.Getenv("RABBITMQ_QUEUE") + ".dlq"
+	}
+	return queue
+}
+
+// getEnvInt читает целое число из переменной окружения, пустое значение - значение по умолчанию
+func getEnvInt(name string, defaultValue int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatalf("invalid %s: %v", name, err)
+	}
+	return number
+}
@@ -1,6 +1,7 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 
@@ -17,6 +18,46 @@ type Config struct {
 
 type ConnectionDatabase struct {
 	DB *sql.DB
+	// DSN строка подключения, нужна для отдельных соединений (LISTEN/NOTIFY)
+	DSN string
+}
+
+// Querier общий интерфейс *sql.DB и *sql.Tx, позволяет выполнять одни и те же
+// запросы как вне транзакции, так и внутри нее
+type Querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// ContextQuerier методы *sql.DB и *sql.Tx с контекстом
+type ContextQuerier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// BindContext возвращает Querier, выполняющий все запросы с контекстом ctx:
+// отмена контекста прерывает выполняющийся запрос
+func BindContext(ctx context.Context, q ContextQuerier) Querier {
+	return &contextQuerier{ctx: ctx, q: q}
+}
+
+type contextQuerier struct {
+	ctx context.Context
+	q   ContextQuerier
+}
+
+func (c *contextQuerier) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return c.q.ExecContext(c.ctx, query, args...)
+}
+
+func (c *contextQuerier) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return c.q.QueryContext(c.ctx, query, args...)
+}
+
+func (c *contextQuerier) QueryRow(query string, args ...interface{}) *sql.Row {
+	return c.q.QueryRowContext(c.ctx, query, args...)
 }
 
 func GetConfig(host, port, user, password, name string) (*Config, error) {
@@ -29,9 +70,14 @@ func GetConfig(host, port, user, password, name string) (*Config, error) {
 	}, nil
 }
 
-func (d Config) NewConnection() (*ConnectionDatabase, error) {
-	dsn := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
+// DSN возвращает строку подключения к базе данных
+func (d Config) DSN() string {
+	return fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
 		d.Host, d.Port, d.User, d.Password, d.Name)
+}
+
+func (d Config) NewConnection() (*ConnectionDatabase, error) {
+	dsn := d.DSN()
 
 	db, err := sql.Open("postgres", dsn)
 	if err != nil {
@@ -44,7 +90,8 @@ func (d Config) NewConnection() (*ConnectionDatabase, error) {
 	}
 
 	return &ConnectionDatabase{
-		DB: db,
+		DB:  db,
+		DSN: dsn,
 	}, nil
 }
 
@@ -1,22 +1,81 @@
 package rabbitmq
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
+const (
+	// defaultPrefetch сколько неподтвержденных сообщений брокер отдает консьюмеру по умолчанию
+	defaultPrefetch = 10
+	// reconnectMinDelay и reconnectMaxDelay границы задержки между попытками переподключения
+	reconnectMinDelay = time.Second
+	reconnectMaxDelay = 30 * time.Second
+	// publishConfirmTimeout сколько ждать подтверждения публикации от брокера
+	publishConfirmTimeout = 30 * time.Second
+)
+
+// ErrClientClosed возвращается операциями закрытого клиента
+var ErrClientClosed = errors.New("rabbitmq client is closed")
+
 type Config struct {
 	RabbitURL   string
 	RabbitUser  string
 	RabbitPass  string
 	RabbitQueue string
+	// Prefetch лимит неподтвержденных сообщений на канал, должен быть не меньше размера пачки
+	Prefetch int
+	// DeadLetterExchange и DeadLetterQueue куда складываются сообщения, которые нельзя обработать.
+	// Если exchange не задан, сообщения публикуются напрямую в очередь
+	DeadLetterExchange string
+	DeadLetterQueue    string
+	// ParkingQueue очередь отложенных сообщений, ждущих ручного изменения схемы или родительской строки
+	ParkingQueue string
 }
 
+// Client соединение с RabbitMQ, которое само восстанавливается после разрыва:
+// переподключается с растущей задержкой, заново объявляет очереди и QoS
+// и продолжает отдавать сообщения в канал, полученный из Consume
 type Client struct {
+	// RabbitmqConn и RabbitmqChannel текущие соединение и канал, заменяются при переподключении
 	RabbitmqConn    *amqp.Connection
 	RabbitmqChannel *amqp.Channel
+
+	config Config
+	// returns сообщения, возвращенные брокером с текущего канала (mandatory без подходящей очереди)
+	returns chan amqp.Return
+	// publishMu публикации идут по одной, см. Publish
+	publishMu   sync.Mutex
+	mu          sync.RWMutex
+	delayQueues map[string]delayQueue
+	// ready закрыт, пока канал работает; при разрыве заменяется новым открытым каналом
+	ready  chan struct{}
+	done   chan struct{}
+	closed bool
+	// consumerSeq счетчик для уникальных consumer tag
+	consumerSeq uint64
+	// subscription возвращает канал для подписок и сигнал его готовности, см. currentSubscriber
+	subscription func() (subscriber, chan struct{})
+}
+
+// subscriber операции канала, нужные подписке на очередь (реализуется *amqp.Channel)
+type subscriber interface {
+	Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error)
+	Cancel(consumer string, noWait bool) error
+	IsClosed() bool
+}
+
+// delayQueue параметры очереди ожидания, нужны для повторного объявления после переподключения
+type delayQueue struct {
+	target string
+	ttl    time.Duration
 }
 
 func GetConfig(url, user, password, queue string) (*Config, error) {
@@ -29,7 +88,14 @@ func GetConfig(url, user, password, queue string) (*Config, error) {
 }
 
 func (c *Config) NewConnectionRabbit() (*Client, error) {
-	clientRabbit := &Client{}
+	clientRabbit := &Client{
+		config:      *c,
+		delayQueues: make(map[string]delayQueue),
+		ready:       make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	clientRabbit.subscription = clientRabbit.currentSubscriber
+
 	var err error
 	maxRetries := 5
 	for i := 0; i < maxRetries; i++ {
@@ -45,14 +111,44 @@ func (c *Config) NewConnectionRabbit() (*Client, error) {
 		return nil, fmt.Errorf("failed to connect to RabbitMQ after %d attempts: %w", maxRetries, err)
 	}
 
-	clientRabbit.RabbitmqChannel, err = clientRabbit.RabbitmqConn.Channel()
+	clientRabbit.RabbitmqChannel, clientRabbit.returns, err = clientRabbit.openChannel(clientRabbit.RabbitmqConn)
+	if err != nil {
+		clientRabbit.RabbitmqConn.Close()
+		return nil, err
+	}
+	close(clientRabbit.ready)
+
+	go clientRabbit.watch()
 
+	return clientRabbit, nil
+}
+
+// openChannel открывает канал в режиме подтверждения публикаций (publisher confirms)
+// и объявляет на нем очереди и QoS. Возвращает канал и канал возвращенных брокером сообщений
+func (c *Client) openChannel(conn *amqp.Connection) (*amqp.Channel, chan amqp.Return, error) {
+	channel, err := conn.Channel()
 	if err != nil {
-		return nil, fmt.Errorf("ошибка создания канала: %w", err)
+		return nil, nil, fmt.Errorf("ошибка создания канала: %w", err)
+	}
+
+	if err := channel.Confirm(false); err != nil {
+		channel.Close()
+		return nil, nil, fmt.Errorf("failed to enable publisher confirms: %w", err)
 	}
+	returns := channel.NotifyReturn(make(chan amqp.Return, 1))
 
-	_, err = clientRabbit.RabbitmqChannel.QueueDeclare(
-		c.RabbitQueue,
+	if err := c.declareTopology(channel); err != nil {
+		channel.Close()
+		return nil, nil, err
+	}
+
+	return channel, returns, nil
+}
+
+// declareTopology объявляет основную очередь, dead letter, очередь отложенных, очереди ожидания и QoS
+func (c *Client) declareTopology(channel *amqp.Channel) error {
+	_, err := channel.QueueDeclare(
+		c.config.RabbitQueue,
 		true,
 		false,
 		false,
@@ -60,32 +156,412 @@ func (c *Config) NewConnectionRabbit() (*Client, error) {
 		nil,
 	)
 	if err != nil {
-		return nil, fmt.Errorf("failed to declare queue: %w", err)
+		return fmt.Errorf("failed to declare queue: %w", err)
+	}
+
+	err = declareDeadLetter(channel, c.config.DeadLetterExchange, c.config.DeadLetterQueue)
+	if err != nil {
+		return err
+	}
+
+	if c.config.ParkingQueue != "" {
+		_, err = channel.QueueDeclare(
+			c.config.ParkingQueue,
+			true,
+			false,
+			false,
+			false,
+			nil,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to declare parking queue: %w", err)
+		}
+	}
+
+	c.mu.RLock()
+	delayQueues := make(map[string]delayQueue, len(c.delayQueues))
+	for name, queue := range c.delayQueues {
+		delayQueues[name] = queue
+	}
+	c.mu.RUnlock()
+
+	for name, queue := range delayQueues {
+		if err := declareDelayQueue(channel, name, queue.target, queue.ttl); err != nil {
+			return err
+		}
+	}
+
+	prefetch := c.config.Prefetch
+	if prefetch <= 0 {
+		prefetch = defaultPrefetch
 	}
 
 	// батч
-	err = clientRabbit.RabbitmqChannel.Qos(
-		10,
+	err = channel.Qos(
+		prefetch,
 		0,
 		false,
 	)
 	if err != nil {
-		return nil, fmt.Errorf("failed to set QoS: %w", err)
+		return fmt.Errorf("failed to set QoS: %w", err)
 	}
 
-	return clientRabbit, nil
+	return nil
+}
+
+// watch следит за закрытием соединения и канала и восстанавливает их.
+// Если закрылся только канал, он открывается заново на том же соединении
+func (c *Client) watch() {
+	for {
+		c.mu.RLock()
+		conn, channel := c.RabbitmqConn, c.RabbitmqChannel
+		c.mu.RUnlock()
+
+		connClosed := conn.NotifyClose(make(chan *amqp.Error, 1))
+		channelClosed := channel.NotifyClose(make(chan *amqp.Error, 1))
+
+		select {
+		case <-c.done:
+			return
+		case amqpErr := <-connClosed:
+			log.Printf("RabbitMQ connection closed: %v", amqpErr)
+		case amqpErr := <-channelClosed:
+			log.Printf("RabbitMQ channel closed: %v", amqpErr)
+		}
+
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			return
+		}
+		c.ready = make(chan struct{})
+		c.mu.Unlock()
+
+		if !c.reconnect() {
+			return
+		}
+	}
+}
+
+// reconnect восстанавливает канал (и при необходимости соединение) с растущей задержкой.
+// Возвращает false, если клиент закрыли во время переподключения
+func (c *Client) reconnect() bool {
+	delay := reconnectMinDelay
+
+	c.mu.RLock()
+	conn := c.RabbitmqConn
+	c.mu.RUnlock()
+
+	for attempt := 1; ; attempt++ {
+		var err error
+		if conn.IsClosed() {
+			conn, err = amqp.Dial(c.config.RabbitURL)
+		}
+
+		var channel *amqp.Channel
+		var returns chan amqp.Return
+		if err == nil {
+			channel, returns, err = c.openChannel(conn)
+		}
+
+		if err == nil {
+			c.mu.Lock()
+			if c.closed {
+				c.mu.Unlock()
+				channel.Close()
+				conn.Close()
+				return false
+			}
+			c.RabbitmqConn = conn
+			c.RabbitmqChannel = channel
+			c.returns = returns
+			close(c.ready)
+			c.mu.Unlock()
+
+			log.Printf("RabbitMQ reconnected after %d attempt(s)", attempt)
+			return true
+		}
+
+		log.Printf("RabbitMQ reconnect attempt %d failed, next in %s: %v", attempt, delay, err)
+
+		select {
+		case <-c.done:
+			if !conn.IsClosed() {
+				conn.Close()
+			}
+			return false
+		case <-time.After(delay):
+		}
+
+		delay *= 2
+		if delay > reconnectMaxDelay {
+			delay = reconnectMaxDelay
+		}
+	}
+}
+
+// current возвращает текущий канал и сигнал его готовности
+func (c *Client) current() (*amqp.Channel, chan struct{}) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.RabbitmqChannel, c.ready
+}
+
+// currentSubscriber возвращает текущий канал клиента для подписок
+func (c *Client) currentSubscriber() (subscriber, chan struct{}) {
+	channel, ready := c.current()
+	return channel, ready
+}
+
+// Consume подписывается на очередь. Возвращаемый канал переживает переподключения:
+// после восстановления соединения подписка создается заново.
+// При отмене ctx подписка отменяется на брокере и канал закрывается; уже полученные,
+// но не подтвержденные сообщения брокер вернет в очередь при закрытии канала
+func (c *Client) Consume(ctx context.Context, queueName string) (<-chan amqp.Delivery, error) {
+	consumerTag := fmt.Sprintf("ctag-%s-%d", queueName, atomic.AddUint64(&c.consumerSeq, 1))
+
+	channel, _ := c.subscription()
+	deliveries, err := channel.Consume(
+		queueName,   // queue
+		consumerTag, // consumer
+		false,       // auto-ack (отключаем автоматическое подтверждение)
+		false,       // exclusive
+		false,       // no-local
+		false,       // no-wait
+		nil,         // args
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to register a consumer: %w", err)
+	}
+
+	out := make(chan amqp.Delivery)
+	go func() {
+		defer close(out)
+		for {
+			if !c.forward(ctx, consumerTag, deliveries, out) {
+				return
+			}
+
+			// Канал закрылся - ждем переподключения и подписываемся заново
+			for {
+				channel, ready := c.subscription()
+				select {
+				case <-ctx.Done():
+					return
+				case <-c.done:
+					return
+				case <-ready:
+				}
+
+				deliveries, err = channel.Consume(queueName, consumerTag, false, false, false, false, nil)
+				if err == nil {
+					log.Printf("Resumed consuming from queue: %s", queueName)
+					break
+				}
+
+				log.Printf("Failed to resume consuming from queue %s: %v", queueName, err)
+				select {
+				case <-ctx.Done():
+					return
+				case <-c.done:
+					return
+				case <-time.After(reconnectMinDelay):
+				}
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+// forward перекладывает сообщения подписки в out. Возвращает true, если подписка
+// оборвалась вместе с каналом, и false, если консьюмер остановлен
+func (c *Client) forward(ctx context.Context, consumerTag string, deliveries <-chan amqp.Delivery, out chan<- amqp.Delivery) bool {
+	for {
+		select {
+		case <-ctx.Done():
+			c.cancel(consumerTag)
+			return false
+		case <-c.done:
+			return false
+		case delivery, ok := <-deliveries:
+			if !ok {
+				return true
+			}
+			select {
+			case out <- delivery:
+			case <-ctx.Done():
+				c.cancel(consumerTag)
+				return false
+			case <-c.done:
+				return false
+			}
+		}
+	}
+}
+
+// cancel останавливает доставку сообщений подписчику на брокере
+func (c *Client) cancel(consumerTag string) {
+	channel, _ := c.subscription()
+	if channel.IsClosed() {
+		return
+	}
+	if err := channel.Cancel(consumerTag, false); err != nil {
+		log.Printf("Error cancelling consumer %s: %v", consumerTag, err)
+	}
+}
+
+// declareDeadLetter объявляет exchange и очередь для необрабатываемых сообщений
+func declareDeadLetter(channel *amqp.Channel, exchange, queue string) error {
+	if exchange != "" {
+		err := channel.ExchangeDeclare(
+			exchange,
+			amqp.ExchangeFanout,
+			true,
+			false,
+			false,
+			false,
+			nil,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to declare dead letter exchange: %w", err)
+		}
+	}
+
+	if queue == "" {
+		return nil
+	}
+
+	_, err := channel.QueueDeclare(
+		queue,
+		true,
+		false,
+		false,
+		false,
+		nil,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to declare dead letter queue: %w", err)
+	}
+
+	if exchange != "" {
+		err = channel.QueueBind(queue, "", exchange, false, nil)
+		if err != nil {
+			return fmt.Errorf("failed to bind dead letter queue: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// DeclareDelayQueue объявляет очередь ожидания: сообщения лежат в ней ttl,
+// затем брокер перекладывает их в очередь target через default exchange.
+// Очередь запоминается и объявляется заново после переподключения
+func (c *Client) DeclareDelayQueue(name, target string, ttl time.Duration) error {
+	c.mu.Lock()
+	c.delayQueues[name] = delayQueue{target: target, ttl: ttl}
+	c.mu.Unlock()
+
+	channel, _ := c.current()
+	return declareDelayQueue(channel, name, target, ttl)
+}
+
+func declareDelayQueue(channel *amqp.Channel, name, target string, ttl time.Duration) error {
+	_, err := channel.QueueDeclare(
+		name,
+		true,
+		false,
+		false,
+		false,
+		amqp.Table{
+			"x-message-ttl":             ttl.Milliseconds(),
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": target,
+		},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to declare delay queue %s: %w", name, err)
+	}
+	return nil
+}
+
+// Publish публикует сообщение в exchange с routing key через текущий канал и ждет,
+// пока брокер подтвердит, что сохранил его (publisher confirms). Сообщение публикуется
+// с mandatory: если брокер не нашел для него ни одной очереди, возвращается ошибка.
+// Только после nil полученный оригинал можно подтверждать
+func (c *Client) Publish(exchange, routingKey string, msg amqp.Publishing) error {
+	// Публикации идут по одной: возврат приходит раньше подтверждения и относится
+	// к единственному сообщению, которое ждет подтверждения
+	c.publishMu.Lock()
+	defer c.publishMu.Unlock()
+
+	c.mu.RLock()
+	channel, returns := c.RabbitmqChannel, c.returns
+	c.mu.RUnlock()
+
+	// Возврат публикации, которая не дождалась подтверждения, относится не к этому сообщению
+	drainReturns(returns)
+
+	ctx, cancel := context.WithTimeout(context.Background(), publishConfirmTimeout)
+	defer cancel()
+
+	confirmation, err := channel.PublishWithDeferredConfirmWithContext(ctx, exchange, routingKey, true, false, msg)
+	if err != nil {
+		return fmt.Errorf("failed to publish message: %w", err)
+	}
+
+	acked, err := confirmation.WaitContext(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to wait for publish confirmation: %w", err)
+	}
+	if !acked {
+		return fmt.Errorf("message was not confirmed by broker")
+	}
+
+	select {
+	case returned, ok := <-returns:
+		if ok {
+			return fmt.Errorf("message was returned by broker: %d %s", returned.ReplyCode, returned.ReplyText)
+		}
+	default:
+	}
+
+	return nil
+}
+
+// drainReturns отбрасывает возвраты, оставшиеся от предыдущих публикаций
+func drainReturns(returns chan amqp.Return) {
+	for {
+		select {
+		case _, ok := <-returns:
+			if !ok {
+				return
+			}
+		default:
+			return
+		}
+	}
 }
 
 func (c *Client) CloseRabbitMQ() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return ErrClientClosed
+	}
+	c.closed = true
+	close(c.done)
+	channel, conn := c.RabbitmqChannel, c.RabbitmqConn
+	c.mu.Unlock()
 
-	if c.RabbitmqChannel != nil {
-		err := c.RabbitmqChannel.Close()
+	if channel != nil && !channel.IsClosed() {
+		err := channel.Close()
 		if err != nil {
 			return err
 		}
 	}
-	if c.RabbitmqConn != nil {
-		err := c.RabbitmqConn.Close()
+	if conn != nil && !conn.IsClosed() {
+		err := conn.Close()
 		if err != nil {
 			return err
 		}